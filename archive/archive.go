@@ -0,0 +1,422 @@
+// Package archive packs files and directories into a single stream for a
+// transfer, and unpacks them again on the other side. The stream starts
+// with a manifest of every entry's name, type, size, mode, modification time
+// and symlink target, followed by the regular files' contents in manifest
+// order.
+package archive
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/djreed/faart/log"
+)
+
+const (
+	// Every archive starts with MAGIC and the format version, then the
+	// length of the JSON manifest that follows
+	MAGIC          = "FAARTARC"
+	FORMAT_VERSION = 1
+
+	VERSION_POINTER = len(MAGIC)
+	VERSION_SIZE    = 1
+
+	MANIFEST_LENGTH_POINTER = VERSION_POINTER + VERSION_SIZE
+	MANIFEST_LENGTH_SIZE    = 4
+
+	HEADER_SIZE = MANIFEST_LENGTH_POINTER + MANIFEST_LENGTH_SIZE
+
+	// Larger manifests are refused rather than read into memory
+	MAX_MANIFEST_SIZE = 64 << 20
+
+	// Prefix of the temporary files entries are written to before being
+	// renamed into place
+	TEMP_PREFIX = ".faart-"
+)
+
+type EntryType string
+
+const (
+	TYPE_FILE    EntryType = "file"
+	TYPE_DIR     EntryType = "dir"
+	TYPE_SYMLINK EntryType = "symlink"
+)
+
+var (
+	// The stream isn't an archive, or is one from a later format
+	ErrNotArchive = errors.New("not a faart archive")
+	// An entry would land outside the directory being unpacked into
+	ErrUnsafePath = errors.New("archive entry escapes the target directory")
+)
+
+// One file, directory or symlink
+type Entry struct {
+	// Slash separated, relative to the directory the archive is unpacked
+	// into; each argument to Scan becomes a top-level name
+	Path    string      `json:"path"`
+	Type    EntryType   `json:"type"`
+	Size    int64       `json:"size,omitempty"`
+	Mode    os.FileMode `json:"mode"`
+	ModTime time.Time   `json:"mtime"`
+	Target  string      `json:"target,omitempty"`
+
+	// Where a regular file's contents are read from when packing
+	source string
+}
+
+type Manifest struct {
+	Entries []Entry `json:"entries"`
+}
+
+// Lists everything under paths, which may be files, directories or
+// symlinks; symlinks are kept as links rather than followed. Anything
+// else, such as a socket or device, is left out.
+func Scan(paths []string) (*Manifest, error) {
+	manifest := &Manifest{}
+	names := make(map[string]bool)
+	for _, root := range paths {
+		name := filepath.Base(filepath.Clean(root))
+		if name == "." || name == ".." || name == string(filepath.Separator) {
+			return nil, fmt.Errorf("can't name %q in an archive; pass the files in it instead", root)
+		}
+		if names[name] {
+			return nil, fmt.Errorf("two arguments are both named %q", name)
+		}
+		names[name] = true
+
+		err := filepath.Walk(root, func(source string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			relative, err := filepath.Rel(root, source)
+			if err != nil {
+				return err
+			}
+			entry := Entry{
+				Path:    path.Join(name, filepath.ToSlash(relative)),
+				Mode:    info.Mode().Perm(),
+				ModTime: info.ModTime(),
+			}
+
+			switch {
+			case info.Mode().IsRegular():
+				entry.Type = TYPE_FILE
+				entry.Size = info.Size()
+				entry.source = source
+			case info.IsDir():
+				entry.Type = TYPE_DIR
+			case info.Mode()&os.ModeSymlink != 0:
+				entry.Type = TYPE_SYMLINK
+				if entry.Target, err = os.Readlink(source); err != nil {
+					return err
+				}
+			default:
+				log.ERR.Printf("[archive] skipping %s: not a file, directory or symlink\n", source)
+				return nil
+			}
+			manifest.Entries = append(manifest.Entries, entry)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return manifest, nil
+}
+
+// Writes the archive: the header, the manifest, then each file's contents
+func (m *Manifest) Pack(w io.Writer) error {
+	encoded, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if len(encoded) > MAX_MANIFEST_SIZE {
+		return fmt.Errorf("manifest of %d entries is too large", len(m.Entries))
+	}
+
+	header := make([]byte, HEADER_SIZE)
+	copy(header, MAGIC)
+	header[VERSION_POINTER] = FORMAT_VERSION
+	binary.LittleEndian.PutUint32(header[MANIFEST_LENGTH_POINTER:], uint32(len(encoded)))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	if _, err := w.Write(encoded); err != nil {
+		return err
+	}
+
+	for _, entry := range m.Entries {
+		if entry.Type != TYPE_FILE {
+			continue
+		}
+		if err := packFile(w, entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Copies exactly the size the manifest promised, failing if the file has
+// since shrunk or grown
+func packFile(w io.Writer, entry Entry) error {
+	file, err := os.Open(entry.source)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	copied, err := io.Copy(w, io.LimitReader(file, entry.Size+1))
+	if err != nil {
+		return err
+	}
+	if copied != entry.Size {
+		return fmt.Errorf("%s changed size while being sent", entry.source)
+	}
+	return nil
+}
+
+// The archive as a stream to read from, packed as it's read
+func (m *Manifest) Reader() io.Reader {
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(m.Pack(w))
+	}()
+	return r
+}
+
+// Reads an archive's header and manifest, leaving r at the first file's
+// contents
+func ReadManifest(r io.Reader) (*Manifest, error) {
+	header := make([]byte, HEADER_SIZE)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, ErrNotArchive
+	}
+	if string(header[:len(MAGIC)]) != MAGIC || header[VERSION_POINTER] != FORMAT_VERSION {
+		return nil, ErrNotArchive
+	}
+	length := binary.LittleEndian.Uint32(header[MANIFEST_LENGTH_POINTER:])
+	if length > MAX_MANIFEST_SIZE {
+		return nil, ErrNotArchive
+	}
+
+	encoded := make([]byte, length)
+	if _, err := io.ReadFull(r, encoded); err != nil {
+		return nil, err
+	}
+	manifest := &Manifest{}
+	if err := json.Unmarshal(encoded, manifest); err != nil {
+		return nil, err
+	}
+	for _, entry := range manifest.Entries {
+		if !safe(entry.Path) {
+			return nil, fmt.Errorf("%q: %s", entry.Path, ErrUnsafePath)
+		}
+		if entry.Type == TYPE_FILE && entry.Size < 0 {
+			return nil, fmt.Errorf("%q has a negative size", entry.Path)
+		}
+	}
+	return manifest, nil
+}
+
+// Whether p is a clean, relative path that stays where it's put
+func safe(p string) bool {
+	if p == "" || p != path.Clean(p) || path.IsAbs(p) || p == ".." || strings.HasPrefix(p, "../") {
+		return false
+	}
+	// Backslashes and drive letters mean something on Windows
+	return !strings.ContainsAny(p, "\\:\x00")
+}
+
+// Rebuilds the archive r holds under dir, which is created if need be.
+// Nothing is written outside dir: names are checked, and nothing is
+// written through a symlink, whether the archive made it or it was there
+// already. Every file is written to a temporary file beside it, and only
+// renamed into place once r has ended cleanly, so a file is never seen half
+// written and a stream that fails its final check leaves none behind.
+// Directories get their modes and times last, once their contents are in.
+func Unpack(r io.Reader, dir string) error {
+	manifest, err := ReadManifest(r)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	var staged []stagedFile
+	defer func() {
+		for _, file := range staged {
+			os.Remove(file.temporary)
+		}
+	}()
+
+	// Symlinks wait until everything else is in, so nothing goes through them
+	var links, dirs []Entry
+	for _, entry := range manifest.Entries {
+		switch entry.Type {
+		case TYPE_FILE:
+			var file stagedFile
+			file, err = unpackFile(r, dir, entry)
+			if err == nil {
+				staged = append(staged, file)
+			}
+		case TYPE_DIR:
+			err = unpackDir(dir, entry)
+			dirs = append(dirs, entry)
+		case TYPE_SYMLINK:
+			links = append(links, entry)
+		default:
+			err = fmt.Errorf("%q has unknown type %q", entry.Path, entry.Type)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// Anything past the last file means the archive isn't what it said, and
+	// the stream's own end may yet turn up a failure
+	if trailing, err := io.ReadFull(r, make([]byte, 1)); trailing > 0 {
+		return errors.New("archive has data past its last file")
+	} else if err != io.EOF {
+		return err
+	}
+
+	for len(staged) > 0 {
+		if err := os.Rename(staged[0].temporary, staged[0].target); err != nil {
+			return err
+		}
+		log.ERR.Printf("[unpacked] %s (%d)\n", staged[0].entry.Path, staged[0].entry.Size)
+		staged = staged[1:]
+	}
+	for _, entry := range links {
+		if err := unpackSymlink(dir, entry); err != nil {
+			return err
+		}
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		target, err := resolve(dir, dirs[i].Path)
+		if err != nil {
+			return err
+		}
+		if err := os.Chmod(target, dirs[i].Mode.Perm()); err != nil {
+			return err
+		}
+		if err := os.Chtimes(target, dirs[i].ModTime, dirs[i].ModTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A file written out in full, waiting to be renamed into place
+type stagedFile struct {
+	entry     Entry
+	temporary string
+	target    string
+}
+
+// Where p goes under dir, making any missing parent directories on the way
+// and refusing to pass through anything but a real directory
+func resolve(dir, p string) (string, error) {
+	if !safe(p) {
+		return "", fmt.Errorf("%q: %s", p, ErrUnsafePath)
+	}
+	parts := strings.Split(p, "/")
+	target := dir
+	for _, part := range parts[:len(parts)-1] {
+		target = filepath.Join(target, part)
+		info, err := os.Lstat(target)
+		if os.IsNotExist(err) {
+			if err := os.Mkdir(target, 0700); err != nil {
+				return "", err
+			}
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		if !info.IsDir() {
+			return "", fmt.Errorf("%q: %s", p, ErrUnsafePath)
+		}
+	}
+	return filepath.Join(target, parts[len(parts)-1]), nil
+}
+
+func unpackDir(dir string, entry Entry) error {
+	target, err := resolve(dir, entry.Path)
+	if err != nil {
+		return err
+	}
+	info, err := os.Lstat(target)
+	if os.IsNotExist(err) {
+		// Owner-writable until its contents are in
+		return os.Mkdir(target, 0700)
+	} else if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%q: %s", entry.Path, ErrUnsafePath)
+	}
+	return nil
+}
+
+func unpackFile(r io.Reader, dir string, entry Entry) (stagedFile, error) {
+	target, err := resolve(dir, entry.Path)
+	if err != nil {
+		return stagedFile{}, err
+	}
+	temporary, err := ioutil.TempFile(filepath.Dir(target), TEMP_PREFIX+filepath.Base(target)+"-")
+	if err != nil {
+		return stagedFile{}, err
+	}
+	staged := stagedFile{entry: entry, temporary: temporary.Name(), target: target}
+
+	if _, err := io.CopyN(temporary, r, entry.Size); err != nil {
+		temporary.Close()
+		os.Remove(staged.temporary)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return stagedFile{}, err
+	}
+	if err := temporary.Chmod(entry.Mode.Perm()); err != nil {
+		temporary.Close()
+		os.Remove(staged.temporary)
+		return stagedFile{}, err
+	}
+	if err := temporary.Close(); err != nil {
+		os.Remove(staged.temporary)
+		return stagedFile{}, err
+	}
+	if err := os.Chtimes(staged.temporary, entry.ModTime, entry.ModTime); err != nil {
+		os.Remove(staged.temporary)
+		return stagedFile{}, err
+	}
+	return staged, nil
+}
+
+// Makes the link beside its final name, then renames it over whatever's
+// there; a link's own times can't be set portably, so they're left alone
+func unpackSymlink(dir string, entry Entry) error {
+	target, err := resolve(dir, entry.Path)
+	if err != nil {
+		return err
+	}
+	temporary := filepath.Join(filepath.Dir(target), TEMP_PREFIX+filepath.Base(target)+fmt.Sprintf("-%d", time.Now().UnixNano()))
+	if err := os.Symlink(entry.Target, temporary); err != nil {
+		return err
+	}
+	if err := os.Rename(temporary, target); err != nil {
+		os.Remove(temporary)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package archive
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "faart-archive")
+	require.NoError(t, err)
+	return dir
+}
+
+func TestRoundTrip(t *testing.T) {
+	source := tempDir(t)
+	defer os.RemoveAll(source)
+	tree := filepath.Join(source, "tree")
+	require.NoError(t, os.MkdirAll(filepath.Join(tree, "nested", "empty"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(tree, "a.txt"), []byte("alpha"), 0640))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(tree, "nested", "run.sh"), []byte("#!/bin/sh\n"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(source, "single"), bytes.Repeat([]byte{1}, 100000), 0600))
+	require.NoError(t, os.Symlink("../a.txt", filepath.Join(tree, "nested", "link")))
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	require.NoError(t, os.Chtimes(filepath.Join(tree, "a.txt"), mtime, mtime))
+	require.NoError(t, os.Chtimes(filepath.Join(tree, "nested"), mtime, mtime))
+
+	manifest, err := Scan([]string{tree, filepath.Join(source, "single")})
+	require.NoError(t, err)
+	var packed bytes.Buffer
+	require.NoError(t, manifest.Pack(&packed))
+
+	target := tempDir(t)
+	defer os.RemoveAll(target)
+	require.NoError(t, Unpack(&packed, target))
+
+	contents, err := ioutil.ReadFile(filepath.Join(target, "tree", "a.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "alpha", string(contents))
+	info, err := os.Stat(filepath.Join(target, "tree", "a.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+	assert.True(t, mtime.Equal(info.ModTime()))
+
+	info, err = os.Stat(filepath.Join(target, "tree", "nested", "run.sh"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0755), info.Mode().Perm())
+	info, err = os.Stat(filepath.Join(target, "tree", "nested"))
+	require.NoError(t, err)
+	assert.True(t, mtime.Equal(info.ModTime()))
+	info, err = os.Stat(filepath.Join(target, "tree", "nested", "empty"))
+	require.NoError(t, err)
+	assert.True(t, info.IsDir())
+
+	link, err := os.Readlink(filepath.Join(target, "tree", "nested", "link"))
+	require.NoError(t, err)
+	assert.Equal(t, "../a.txt", link)
+	contents, err = ioutil.ReadFile(filepath.Join(target, "single"))
+	require.NoError(t, err)
+	assert.Len(t, contents, 100000)
+
+	// No temporary files are left behind
+	leftovers, _ := filepath.Glob(filepath.Join(target, "*", TEMP_PREFIX+"*"))
+	assert.Empty(t, leftovers)
+}
+
+// Packs entries as given, skipping Scan's checks
+func pack(t *testing.T, entries ...Entry) *bytes.Buffer {
+	var packed bytes.Buffer
+	require.NoError(t, (&Manifest{Entries: entries}).Pack(&packed))
+	return &packed
+}
+
+func TestUnpackRefusesTraversal(t *testing.T) {
+	for _, name := range []string{"../escape", "/etc/escape", "a/../../escape", "a/./b", "", "a\\..\\b"} {
+		target := tempDir(t)
+		err := Unpack(pack(t, Entry{Path: name, Type: TYPE_DIR, Mode: 0755}), target)
+		assert.Error(t, err, name)
+		os.RemoveAll(target)
+	}
+
+	// Nor through a symlink, whether the archive made it or it was there
+	outside := tempDir(t)
+	defer os.RemoveAll(outside)
+	target := tempDir(t)
+	defer os.RemoveAll(target)
+
+	err := Unpack(pack(t,
+		Entry{Path: "link", Type: TYPE_SYMLINK, Target: outside},
+		Entry{Path: "link/escape", Type: TYPE_DIR, Mode: 0755},
+	), target)
+	assert.Error(t, err)
+	require.NoError(t, os.Symlink(outside, filepath.Join(target, "existing")))
+	err = Unpack(pack(t, Entry{Path: "existing/escape", Type: TYPE_DIR, Mode: 0755}), target)
+	assert.Error(t, err)
+
+	escaped, _ := ioutil.ReadDir(outside)
+	assert.Empty(t, escaped)
+}
+
+func TestUnpackRefusesOthers(t *testing.T) {
+	target := tempDir(t)
+	defer os.RemoveAll(target)
+
+	assert.Equal(t, ErrNotArchive, Unpack(bytes.NewReader([]byte("just some bytes")), target))
+
+	// A file cut short never appears under its name
+	packed := pack(t)
+	truncated := append(packed.Bytes()[:0:0], packed.Bytes()...)
+	truncated = bytes.Replace(truncated, []byte(`"entries":null`), []byte(`"entries":[{"path":"short","type":"file","size":10,"mode":420,"mtime":"2020-01-01T00:00:00Z"}]`), 1)
+	truncated[MANIFEST_LENGTH_POINTER] += byte(len(truncated) - packed.Len())
+	err := Unpack(bytes.NewReader(append(truncated, "12345"...)), target)
+	assert.Error(t, err)
+	_, err = os.Stat(filepath.Join(target, "short"))
+	assert.True(t, os.IsNotExist(err))
+	leftovers, _ := filepath.Glob(filepath.Join(target, TEMP_PREFIX+"*"))
+	assert.Empty(t, leftovers)
+}
+
+// Yields err once the archive before it has been read
+type failingReader struct{ err error }
+
+func (r failingReader) Read([]byte) (int, error) { return 0, r.err }
+
+func TestUnpackCommitsNothingOnFailedStream(t *testing.T) {
+	source := tempDir(t)
+	defer os.RemoveAll(source)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(source, "whole"), []byte("every byte"), 0644))
+	manifest, err := Scan([]string{filepath.Join(source, "whole")})
+	require.NoError(t, err)
+	var packed bytes.Buffer
+	require.NoError(t, manifest.Pack(&packed))
+
+	target := tempDir(t)
+	defer os.RemoveAll(target)
+	failure := errors.New("stream failed its check")
+	assert.Equal(t, failure, Unpack(io.MultiReader(&packed, failingReader{failure}), target))
+
+	left, _ := ioutil.ReadDir(target)
+	assert.Empty(t, left)
+}
@@ -0,0 +1,172 @@
+package faart
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// Most bytes a stream holds for its reader, unless Config.ReceiveBuffer
+// says otherwise; the peer is told how much room is left
+const STREAM_BUFFER = 1 << 20
+
+// Bytes a stream or transfer has received in order but not yet read
+type streamBuffer struct {
+	lock     sync.Mutex
+	data     []byte
+	capacity int
+
+	// Returned once the data runs out: io.EOF after the peer's FIN, or why
+	// the stream ended. Anything written after that is dropped.
+	err error
+
+	// When a blocked Read gives up; zero for never
+	deadline time.Time
+
+	// Signalled whenever a reader or writer may be able to make progress
+	readable chan struct{}
+	writable chan struct{}
+
+	// Called instead of waiting, if set, when a Read finds nothing to hand
+	// out; a simulation parks its reader there until there's more. The
+	// writer is the simulation itself, so it doesn't wait for room either.
+	park func()
+}
+
+func newStreamBuffer(capacity int) *streamBuffer {
+	return &streamBuffer{
+		capacity: capacity,
+		readable: make(chan struct{}, 1),
+		writable: make(chan struct{}, 1),
+	}
+}
+
+// Blocks while the buffer is full
+func (b *streamBuffer) Write(data []byte) (int, error) {
+	for {
+		b.lock.Lock()
+		if b.err != nil {
+			b.lock.Unlock()
+			return len(data), nil
+		}
+		if len(b.data) < b.capacity || b.park != nil {
+			b.data = append(b.data, data...)
+			b.lock.Unlock()
+			signal(b.readable)
+			return len(data), nil
+		}
+		b.lock.Unlock()
+		<-b.writable
+	}
+}
+
+func (b *streamBuffer) Read(data []byte) (int, error) {
+	for {
+		b.lock.Lock()
+		if len(b.data) > 0 {
+			read := copy(data, b.data)
+			b.data = b.data[read:]
+			if len(b.data) == 0 {
+				b.data = nil
+			} else {
+				// Pass the wakeup on to any other reader
+				signal(b.readable)
+			}
+			b.lock.Unlock()
+			signal(b.writable)
+			return read, nil
+		}
+		err, deadline := b.err, b.deadline
+		b.lock.Unlock()
+
+		if err != nil {
+			signal(b.readable)
+			return 0, err
+		}
+		if b.park != nil {
+			b.park()
+			continue
+		}
+		if err := waitUntil(b.readable, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Bytes it will take before it's full
+func (b *streamBuffer) free() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if len(b.data) >= b.capacity {
+		return 0
+	}
+	return b.capacity - len(b.data)
+}
+
+// Whether a Read would return without waiting
+func (b *streamBuffer) ready() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return len(b.data) > 0 || b.err != nil
+}
+
+func (b *streamBuffer) SetDeadline(deadline time.Time) {
+	b.lock.Lock()
+	b.deadline = deadline
+	b.lock.Unlock()
+	signal(b.readable)
+}
+
+// Reads end with io.EOF once what's buffered has been read
+func (b *streamBuffer) finish() {
+	b.end(io.EOF, false)
+}
+
+// Drops whatever is buffered; reads fail with err from here on
+func (b *streamBuffer) discard(err error) {
+	b.end(err, true)
+}
+
+func (b *streamBuffer) end(err error, drop bool) {
+	b.lock.Lock()
+	if b.err == nil || drop {
+		b.err = err
+	}
+	if drop {
+		b.data = nil
+	}
+	b.lock.Unlock()
+	signal(b.readable)
+	signal(b.writable)
+}
+
+// Wakes whoever is waiting on ch, without blocking if nobody is
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// Waits for ch to be signalled, giving up with errDeadline once deadline
+// passes (never, if it's zero)
+func waitUntil(ch chan struct{}, deadline time.Time) error {
+	if deadline.IsZero() {
+		<-ch
+		return nil
+	}
+
+	wait := time.Until(deadline)
+	if wait <= 0 {
+		return errDeadline
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-ch:
+		return nil
+	case <-timer.C:
+		return errDeadline
+	}
+}
@@ -0,0 +1,373 @@
+package faart
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/djreed/faart/packet"
+)
+
+const (
+	// A checkpoint's files, named by the content's ID in hex
+	CHECKPOINT_PART_SUFFIX    = ".part"
+	CHECKPOINT_JOURNAL_SUFFIX = ".part.journal"
+
+	// Each journal record is a range written to the .part file
+	CHECKPOINT_RECORD_SIZE = 16
+
+	// Records held back before the .part file is synced and they're
+	// written to the journal
+	CHECKPOINT_SYNC_RECORDS = 256
+)
+
+// The sender skipped data the checkpoint should have held, but doesn't
+var errCheckpointIncomplete = errors.New("faart: checkpoint is missing data the sender skipped")
+
+// Where a resumable transfer's compressed stream is kept as it arrives,
+// so whatever made it across survives either end dying. The stream goes in
+// a .part file, holes and all, and every range written to it is then
+// appended to a journal. The journal starts with the content's ID. Its
+// records are held back and written in batches, each only once the .part
+// file has been synced, so after a crash it never claims a range that
+// didn't reach the disk; a range it hasn't recorded is only sent again. The
+// transfer's reader reads the stream back out of the .part file as the
+// ranges fill in, and once it has read all of it the files are removed.
+type checkpoint struct {
+	partPath    string
+	journalPath string
+
+	part    *os.File
+	journal *os.File
+	// Records of ranges written to part but not yet synced
+	records   []byte
+	closeOnce sync.Once
+
+	// Guards everything below; ready is signalled whenever held grows or
+	// the transfer ends
+	lock  sync.Mutex
+	ready *sync.Cond
+	held  rangeSet
+	// Where the stream ends, once the FIN has said
+	length packet.OffsetVal
+	ended  bool
+	// Why reading stops short, once the transfer has failed
+	err error
+	// How far the reader has got
+	read packet.OffsetVal
+}
+
+// Picks up the checkpoint for id in dir, or starts a new one
+func openCheckpoint(dir string, id packet.ContentID) (*checkpoint, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	name := filepath.Join(dir, hex.EncodeToString(id[:]))
+	c := &checkpoint{
+		partPath:    name + CHECKPOINT_PART_SUFFIX,
+		journalPath: name + CHECKPOINT_JOURNAL_SUFFIX,
+	}
+	c.ready = sync.NewCond(&c.lock)
+
+	var err error
+	if c.part, err = os.OpenFile(c.partPath, os.O_RDWR|os.O_CREATE, 0600); err != nil {
+		return nil, err
+	}
+	if err := c.load(id); err != nil {
+		c.part.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Replays the journal into held, then rewrites it with the ranges merged
+// so it doesn't grow without bound across attempts
+func (c *checkpoint) load(id packet.ContentID) error {
+	journal, err := ioutil.ReadFile(c.journalPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(journal) >= len(id) && bytes.Equal(journal[:len(id)], id[:]) {
+		// A record cut short by a crash is dropped
+		for records := journal[len(id):]; len(records) >= CHECKPOINT_RECORD_SIZE; records = records[CHECKPOINT_RECORD_SIZE:] {
+			c.held.add(readRecord(records))
+		}
+	}
+
+	info, err := c.part.Stat()
+	if err != nil {
+		return err
+	}
+	c.held.clip(packet.OffsetVal(info.Size()))
+
+	compacted := append([]byte(nil), id[:]...)
+	for _, r := range c.held {
+		compacted = append(compacted, record(r)...)
+	}
+	temporary := c.journalPath + ".tmp"
+	if err := writeSynced(temporary, compacted); err != nil {
+		return err
+	}
+	if err := os.Rename(temporary, c.journalPath); err != nil {
+		return err
+	}
+
+	c.journal, err = os.OpenFile(c.journalPath, os.O_WRONLY|os.O_APPEND, 0600)
+	return err
+}
+
+// Writes data to a new file at path, making sure it's on disk before the
+// file is renamed into place
+func writeSynced(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func record(r packet.ByteRange) []byte {
+	b := make([]byte, CHECKPOINT_RECORD_SIZE)
+	binary.LittleEndian.PutUint64(b, uint64(r.Start))
+	binary.LittleEndian.PutUint64(b[8:], uint64(r.End))
+	return b
+}
+
+func readRecord(b []byte) packet.ByteRange {
+	return packet.ByteRange{
+		Start: packet.OffsetVal(binary.LittleEndian.Uint64(b)),
+		End:   packet.OffsetVal(binary.LittleEndian.Uint64(b[8:])),
+	}
+}
+
+// Ranges of the stream a sender still has to send
+func (c *checkpoint) missing() []packet.ByteRange {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.held.missing()
+}
+
+// Writes a datagram's contents to the .part file, then records them,
+// syncing once enough records are held back
+func (c *checkpoint) save(datagram packet.Datagram) error {
+	if c == nil {
+		return nil
+	}
+
+	payload := datagram.Payload()
+	start := datagram.Headers().Offset()
+	if _, err := c.part.WriteAt(payload, int64(start)); err != nil {
+		return err
+	}
+	written := packet.ByteRange{Start: start, End: start + packet.OffsetVal(len(payload))}
+	c.records = append(c.records, record(written)...)
+	if len(c.records) >= CHECKPOINT_SYNC_RECORDS*CHECKPOINT_RECORD_SIZE {
+		if err := c.flush(); err != nil {
+			return err
+		}
+	}
+
+	c.lock.Lock()
+	c.held.add(written)
+	c.lock.Unlock()
+	c.ready.Broadcast()
+	return nil
+}
+
+// Syncs the .part file, then appends the records held back to the journal
+// and syncs that too. Records that fail to go out are kept for next time.
+func (c *checkpoint) flush() error {
+	if len(c.records) == 0 {
+		return nil
+	}
+	if err := c.part.Sync(); err != nil {
+		return err
+	}
+	if _, err := c.journal.Write(c.records); err != nil {
+		return err
+	}
+	c.records = c.records[:0]
+	return c.journal.Sync()
+}
+
+// Reads the stream back in order, waiting for each range to arrive
+func (c *checkpoint) Read(data []byte) (int, error) {
+	c.lock.Lock()
+	for {
+		if c.err != nil {
+			c.lock.Unlock()
+			return 0, c.err
+		}
+		if c.ended && c.read >= c.length {
+			c.lock.Unlock()
+			c.remove()
+			return 0, io.EOF
+		}
+		if c.held.runFrom(c.read) > 0 {
+			break
+		}
+		c.ready.Wait()
+	}
+
+	available := c.held.runFrom(c.read)
+	if c.ended && c.length-c.read < available {
+		available = c.length - c.read
+	}
+	if available < packet.OffsetVal(len(data)) {
+		data = data[:available]
+	}
+	offset := c.read
+	c.lock.Unlock()
+
+	read, err := c.part.ReadAt(data, int64(offset))
+	c.lock.Lock()
+	c.read += packet.OffsetVal(read)
+	c.lock.Unlock()
+	if err == io.EOF && read == len(data) {
+		err = nil
+	}
+	return read, err
+}
+
+// Ends the stream at length, once the transfer has finished, or fails the
+// reader with err; the files are kept for the next attempt. Returns why the
+// transfer failed, if it did. Only the run loop calls this, after its last
+// save.
+func (c *checkpoint) finish(length packet.OffsetVal, err error) error {
+	flushErr := c.flush()
+	c.lock.Lock()
+	if err == nil && c.held.runFrom(0) < length {
+		err = errCheckpointIncomplete
+	}
+	if err == nil && flushErr != nil {
+		err = flushErr
+	}
+	c.length = length
+	c.ended = true
+	if c.err == nil {
+		c.err = err
+	}
+	c.lock.Unlock()
+	c.ready.Broadcast()
+
+	if err != nil {
+		c.close()
+	}
+	return err
+}
+
+// Fails the reader with err, unless it has already read everything. The
+// run loop lets go of the files itself, if it's still going.
+func (c *checkpoint) stop(err error) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	if c.err == nil && !(c.ended && c.read >= c.length) {
+		c.err = err
+	}
+	ended := c.ended
+	c.lock.Unlock()
+	c.ready.Broadcast()
+
+	if ended {
+		c.close()
+	}
+}
+
+// Lets go of the files, keeping them for the next attempt
+func (c *checkpoint) close() {
+	if c == nil {
+		return
+	}
+	c.closeOnce.Do(func() {
+		c.journal.Close()
+		c.part.Close()
+	})
+}
+
+// Deletes the files once the whole stream has been read back out of them
+func (c *checkpoint) remove() {
+	c.close()
+	os.Remove(c.partPath)
+	os.Remove(c.journalPath)
+}
+
+// Sorted ranges of a stream, none touching or overlapping another
+type rangeSet []packet.ByteRange
+
+func (s *rangeSet) add(r packet.ByteRange) {
+	if r.Start >= r.End {
+		return
+	}
+	ranges := *s
+	// The ranges r touches or overlaps are ranges[first:last]
+	first := sort.Search(len(ranges), func(i int) bool { return ranges[i].End >= r.Start })
+	last := sort.Search(len(ranges), func(i int) bool { return ranges[i].Start > r.End })
+	if first < last {
+		if ranges[first].Start < r.Start {
+			r.Start = ranges[first].Start
+		}
+		if ranges[last-1].End > r.End {
+			r.End = ranges[last-1].End
+		}
+	}
+
+	merged := append(append(ranges[:first:first], r), ranges[last:]...)
+	*s = merged
+}
+
+// How many bytes are held without a break from offset on
+func (s rangeSet) runFrom(offset packet.OffsetVal) packet.OffsetVal {
+	for _, r := range s {
+		if r.Contains(offset) {
+			return r.End - offset
+		}
+	}
+	return 0
+}
+
+// Every hole from the start of the stream, ending with everything past
+// the last range held
+func (s rangeSet) missing() []packet.ByteRange {
+	var holes []packet.ByteRange
+	var from packet.OffsetVal
+	for _, r := range s {
+		if r.Start > from {
+			holes = append(holes, packet.ByteRange{Start: from, End: r.Start})
+		}
+		from = r.End
+	}
+	return append(holes, packet.ByteRange{Start: from, End: packet.STREAM_END})
+}
+
+// Forgets anything held past size
+func (s *rangeSet) clip(size packet.OffsetVal) {
+	ranges := *s
+	kept := ranges[:0]
+	for _, r := range ranges {
+		if r.Start >= size {
+			break
+		}
+		if r.End > size {
+			r.End = size
+		}
+		kept = append(kept, r)
+	}
+	*s = kept
+}
@@ -0,0 +1,180 @@
+package faart
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/djreed/faart/packet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRangeSet(t *testing.T) {
+	var held rangeSet
+	held.add(packet.ByteRange{Start: 10, End: 20})
+	held.add(packet.ByteRange{Start: 30, End: 40})
+	held.add(packet.ByteRange{Start: 50, End: 60})
+	held.add(packet.ByteRange{Start: 0, End: 5})
+	// Touching ranges merge, and one spanning several swallows them
+	held.add(packet.ByteRange{Start: 20, End: 25})
+	held.add(packet.ByteRange{Start: 35, End: 55})
+	assert.Equal(t, rangeSet{{Start: 0, End: 5}, {Start: 10, End: 25}, {Start: 30, End: 60}}, held)
+
+	assert.Equal(t, packet.OffsetVal(5), held.runFrom(0))
+	assert.Equal(t, packet.OffsetVal(0), held.runFrom(5))
+	assert.Equal(t, packet.OffsetVal(20), held.runFrom(40))
+	assert.Equal(t, []packet.ByteRange{{Start: 5, End: 10}, {Start: 25, End: 30}, {Start: 60, End: packet.STREAM_END}}, held.missing())
+
+	held.clip(35)
+	assert.Equal(t, rangeSet{{Start: 0, End: 5}, {Start: 10, End: 25}, {Start: 30, End: 35}}, held)
+}
+
+func TestCheckpointSurvivesRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "faart-checkpoint")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	id, _ := packet.ContentIDOf(bytes.NewReader([]byte("content")))
+
+	datagrams, stream := syntheticDatagrams(0, 0, 4)
+	c, err := openCheckpoint(dir, id)
+	require.NoError(t, err)
+	assert.Equal(t, []packet.ByteRange{{Start: 0, End: packet.STREAM_END}}, c.missing())
+	require.NoError(t, c.save(datagrams[0]))
+	require.NoError(t, c.save(datagrams[2]))
+	c.finish(0, ErrIdle)
+
+	// A record torn in half by a crash is ignored
+	journal, err := os.OpenFile(c.journalPath, os.O_WRONLY|os.O_APPEND, 0600)
+	require.NoError(t, err)
+	journal.Write(record(packet.ByteRange{Start: 0, End: 1 << 20})[:CHECKPOINT_RECORD_SIZE/2])
+	journal.Close()
+
+	c, err = openCheckpoint(dir, id)
+	require.NoError(t, err)
+	assert.Equal(t, []packet.ByteRange{
+		{Start: datagrams[1].Headers().Offset(), End: datagrams[2].Headers().Offset()},
+		{Start: datagrams[3].Headers().Offset(), End: packet.STREAM_END},
+	}, c.missing())
+
+	// Filling in the holes lets the reader have the whole stream, after
+	// which the files go
+	require.NoError(t, c.save(datagrams[1]))
+	require.NoError(t, c.save(datagrams[3]))
+	require.NoError(t, c.finish(packet.OffsetVal(len(stream)), nil))
+	read, err := ioutil.ReadAll(c)
+	require.NoError(t, err)
+	assert.Equal(t, stream, read)
+	left, _ := filepath.Glob(filepath.Join(dir, "*"))
+	assert.Empty(t, left)
+
+	// A checkpoint for other content starts from nothing
+	other, _ := packet.ContentIDOf(bytes.NewReader([]byte("other")))
+	c, err = openCheckpoint(dir, other)
+	require.NoError(t, err)
+	assert.Equal(t, []packet.ByteRange{{Start: 0, End: packet.STREAM_END}}, c.missing())
+	assert.Equal(t, errCheckpointIncomplete, c.finish(10, nil))
+}
+
+func TestCheckpointRecordsOnlySyncedRanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "faart-checkpoint")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	id, _ := packet.ContentIDOf(bytes.NewReader([]byte("content")))
+	records := func(c *checkpoint) int {
+		journal, err := ioutil.ReadFile(c.journalPath)
+		require.NoError(t, err)
+		return (len(journal) - len(id)) / CHECKPOINT_RECORD_SIZE
+	}
+
+	c, err := openCheckpoint(dir, id)
+	require.NoError(t, err)
+	datagrams, _ := syntheticDatagrams(0, 0, CHECKPOINT_SYNC_RECORDS+1)
+
+	// Nothing is recorded until a whole batch has been synced to the .part
+	// file, so a crash before then loses the batch rather than the data
+	for _, datagram := range datagrams[:CHECKPOINT_SYNC_RECORDS-1] {
+		require.NoError(t, c.save(datagram))
+	}
+	assert.Zero(t, records(c))
+	require.NoError(t, c.save(datagrams[CHECKPOINT_SYNC_RECORDS-1]))
+	assert.Equal(t, CHECKPOINT_SYNC_RECORDS, records(c))
+
+	// and the rest go when the transfer ends
+	require.NoError(t, c.save(datagrams[CHECKPOINT_SYNC_RECORDS]))
+	assert.Equal(t, CHECKPOINT_SYNC_RECORDS, records(c))
+	c.finish(0, ErrIdle)
+	assert.Equal(t, CHECKPOINT_SYNC_RECORDS+1, records(c))
+}
+
+func TestResumeTransfer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "faart-checkpoints")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	listener, err := ListenConfig("127.0.0.1:0", Config{Checkpoints: dir, IdleTimeout: 300 * time.Millisecond})
+	require.NoError(t, err)
+	defer listener.Close()
+
+	source := make([]byte, 2<<20)
+	rand.New(rand.NewSource(1)).Read(source)
+	id, err := packet.ContentIDOf(bytes.NewReader(source))
+	require.NoError(t, err)
+	config := Config{ContentID: id}
+
+	// The first sender dies partway through
+	quietly(func() {
+		conn, err := DialConfig(context.Background(), listener.Addr().String(), config)
+		require.NoError(t, err)
+		first, err := listener.Accept()
+		require.NoError(t, err)
+
+		_, err = conn.Write(source[:len(source)/2])
+		require.NoError(t, err)
+		_, err = io.ReadFull(first, make([]byte, len(source)*3/8))
+		require.NoError(t, err)
+		conn.out.fail(errors.New("killed"))
+		conn.conn.Close()
+
+		// Once it has gone idle everything it took in is on disk, and once
+		// it's closed the listener has let go of it
+		_, err = ioutil.ReadAll(first)
+		assert.Equal(t, ErrIdle, err)
+		first.Close()
+	})
+	parts, _ := filepath.Glob(filepath.Join(dir, "*"+CHECKPOINT_PART_SUFFIX))
+	require.Len(t, parts, 1)
+
+	// The next one only sends what didn't make it
+	var sent packet.PacketCount
+	sentDone := make(chan error, 1)
+	go func() {
+		conn, err := DialConfig(context.Background(), listener.Addr().String(), config)
+		if err != nil {
+			sentDone <- err
+			return
+		}
+		conn.Write(source)
+		err = conn.Close()
+		sent = conn.out.packets.Count()
+		sentDone <- err
+	}()
+
+	second, err := listener.Accept()
+	require.NoError(t, err)
+	received, err := ioutil.ReadAll(second)
+	require.NoError(t, err)
+	require.NoError(t, <-sentDone)
+	assert.True(t, bytes.Equal(source, received))
+	assert.True(t, int(sent)*packet.PACKET_SIZE < len(source)*3/4, "sent %d datagrams", sent)
+
+	left, _ := filepath.Glob(filepath.Join(dir, "*"))
+	assert.Empty(t, left)
+}
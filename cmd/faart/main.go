@@ -0,0 +1,234 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/djreed/faart"
+	"github.com/djreed/faart/congestion"
+	"github.com/djreed/faart/identity"
+	"github.com/djreed/faart/log"
+	"github.com/djreed/faart/netem"
+	"github.com/djreed/faart/packet"
+	"golang.org/x/crypto/ed25519"
+)
+
+const (
+	USAGE        = "usage: faart <command> [flags]\n\ncommands:\n  keygen   make an identity key pair for the key exchange\n  netem    relay UDP traffic through an impaired link\n  sim      simulate a transfer over an impaired link in virtual time"
+	KEYGEN_USAGE = "usage: faart keygen [-o file] [-comment text]"
+	NETEM_USAGE  = "usage: faart netem -upstream host:port [-listen addr] [-loss p] [-latency d] [-jitter d] [-reorder p] [-duplicate p] [-corrupt p] [-rate speed] [-mtu bytes] [-shrink-mtu bytes -shrink-after d] [-seed n]"
+	SIM_USAGE    = "usage: faart sim [-size bytes] [-limit d] [-cc newreno|cubic] [-window packets] [-fec xor|rs] [-key file | -passphrase phrase] [-cipher aes-gcm|chacha20-poly1305] [-datagram-size N] [-receive-buffer bytes] [-read-rate bytes] [-v] [-loss p] [-latency d] [-jitter d] [-reorder p] [-duplicate p] [-corrupt p] [-rate speed] [-mtu bytes] [-shrink-mtu bytes -shrink-after d] [-seed n]"
+)
+
+// ./faart keygen [-o file] [-comment text]
+// ./faart netem -upstream <recv_host>:<recv_port> [flags]
+// ./faart sim [flags]
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, USAGE)
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "keygen":
+		err = keygenMain(os.Args[2:])
+	case "netem":
+		err = netemMain(os.Args[2:])
+	case "sim":
+		err = simMain(os.Args[2:])
+	default:
+		fmt.Fprintln(os.Stderr, USAGE)
+		os.Exit(2)
+	}
+	if err != nil {
+		exit(err)
+	}
+}
+
+// Writes a new identity to a private key file and its .pub, printing the
+// public key to pass on to peers
+func keygenMain(args []string) error {
+	keygenFlags := flag.NewFlagSet("keygen", flag.ExitOnError)
+	keygenFlags.Usage = func() {
+		fmt.Fprintln(keygenFlags.Output(), KEYGEN_USAGE)
+		keygenFlags.PrintDefaults()
+	}
+	defaultPath, _ := identity.DefaultPath(identity.DEFAULT_IDENTITY)
+	path := keygenFlags.String("o", defaultPath, "private key file to write; the public key goes next to it with .pub on the end")
+	comment := keygenFlags.String("comment", "", "note to keep with the public key, such as user@host")
+	keygenFlags.Parse(args)
+
+	if *path == "" {
+		return errors.New("must pass -o")
+	}
+	private, err := identity.Generate()
+	if err != nil {
+		return err
+	}
+	if err := identity.WriteKeyPair(*path, private, *comment); err != nil {
+		return err
+	}
+
+	public := private.Public().(ed25519.PublicKey)
+	log.ERR.Printf("[keygen] wrote %s and %s%s, fingerprint %s\n", *path, *path, identity.PUBLIC_SUFFIX, identity.Fingerprint(public))
+	fmt.Println(identity.FormatPublicKey(public, *comment))
+	return nil
+}
+
+// Relays traffic to the upstream receiver through an impaired link until
+// interrupted, then reports what it did to the traffic
+func netemMain(args []string) error {
+	netemFlags := flag.NewFlagSet("netem", flag.ExitOnError)
+	netemFlags.Usage = func() {
+		fmt.Fprintln(netemFlags.Output(), NETEM_USAGE)
+		netemFlags.PrintDefaults()
+	}
+	listen := netemFlags.String("listen", ":0", "address to listen on for senders (port 0 picks one at random)")
+	upstream := netemFlags.String("upstream", "", "address of the receiver to relay to")
+	link := linkFlags(netemFlags)
+	netemFlags.Parse(args)
+
+	if *upstream == "" {
+		netemFlags.Usage()
+		return errors.New("must pass -upstream")
+	}
+
+	config, err := link()
+	if err != nil {
+		return err
+	}
+
+	proxy, err := netem.Listen(*listen, *upstream, config)
+	if err != nil {
+		return err
+	}
+	log.ERR.Printf("[bound] %d\n", proxy.Addr().(*net.UDPAddr).Port)
+
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt, syscall.SIGTERM)
+	<-interrupted
+
+	proxy.Close()
+	up, down := proxy.Stats()
+	log.ERR.Printf("[netem] upstream: %s\n", up)
+	log.ERR.Printf("[netem] downstream: %s\n", down)
+	return nil
+}
+
+// Runs a single transfer in virtual time and reports how it went; a run
+// that fails can be replayed exactly with the same flags
+func simMain(args []string) error {
+	simFlags := flag.NewFlagSet("sim", flag.ExitOnError)
+	simFlags.Usage = func() {
+		fmt.Fprintln(simFlags.Output(), SIM_USAGE)
+		simFlags.PrintDefaults()
+	}
+	size := simFlags.Int64("size", faart.SIMULATION_SIZE, "bytes to transfer")
+	limit := simFlags.Duration("limit", faart.SIMULATION_LIMIT, "give up after this much virtual time")
+	congestionFlag := simFlags.String("cc", congestion.NEWRENO, "congestion control algorithm: newreno or cubic")
+	window := simFlags.Int("window", congestion.MAX_WINDOW, "maximum number of packets in flight")
+	fec := simFlags.String("fec", "", "forward error correction: xor or rs (off unless set)")
+	keyFile := simFlags.String("key", "", "seal every packet with the pre-shared key in this file (32 bytes, raw or hex)")
+	passphrase := simFlags.String("passphrase", "", "seal every packet with a key derived from this passphrase")
+	cipher := simFlags.String("cipher", "aes-gcm", "AEAD to seal packets with: aes-gcm or chacha20-poly1305")
+	datagramSize := simFlags.Int("datagram-size", packet.DATAGRAM_SIZE, "largest datagram to probe the link for, in bytes")
+	receiveBuffer := simFlags.Int("receive-buffer", faart.TRANSFER_BUFFER, "bytes the receiver holds for a reader that's behind")
+	readRate := simFlags.Int64("read-rate", 0, "bytes a second the receiving application reads (as fast as they arrive unless set)")
+	verbose := simFlags.Bool("v", false, "log every packet, as the sender and receiver would")
+	link := linkFlags(simFlags)
+	simFlags.Parse(args)
+
+	config, err := link()
+	if err != nil {
+		return err
+	}
+	sender := faart.Config{Congestion: *congestionFlag, MaxWindow: *window, DatagramSize: *datagramSize, ReceiveBuffer: *receiveBuffer}
+	if *fec != "" {
+		if sender.FEC, err = packet.ParseFECScheme(*fec); err != nil {
+			return err
+		}
+	}
+	if sender.Key, err = packet.KeyFrom(*keyFile, *passphrase); err != nil {
+		return err
+	}
+	if sender.Cipher, err = packet.ParseCipher(*cipher); err != nil {
+		return err
+	}
+	if !*verbose {
+		log.ERR.SetOutput(ioutil.Discard)
+	}
+
+	started := time.Now()
+	result, err := faart.Simulate(faart.Simulation{
+		Size:     *size,
+		Link:     config,
+		Config:   sender,
+		Limit:    *limit,
+		ReadRate: *readRate,
+	})
+	log.ERR.SetOutput(os.Stderr)
+
+	log.ERR.Printf("[sim] %d bytes in %s of virtual time (%s real), %d events\n", *size, result.Elapsed, time.Since(started), result.Events)
+	log.ERR.Printf("[sim] %d packets sent, %d acks received, %d timeout retransmits, %d fast retransmits\n",
+		result.PacketsSent, result.AcksReceived, result.RTORetransmits, result.FastRetransmits)
+	log.ERR.Printf("[sim] settled on %d byte datagrams\n", result.DatagramSize)
+	log.ERR.Printf("[sim] receiver read %d bytes, %d window probes\n", result.Received, result.WindowProbes)
+	if sender.FEC != 0 {
+		log.ERR.Printf("[sim] %d parity sent, %d packets recovered\n", result.ParitySent, result.Recovered)
+	}
+	log.ERR.Printf("[netem] upstream: %s\n", result.Upstream)
+	log.ERR.Printf("[netem] downstream: %s\n", result.Downstream)
+	return err
+}
+
+// Defines the flags describing an impaired link on flags, returning a
+// function that reads them back once parsed
+func linkFlags(flags *flag.FlagSet) func() (netem.Config, error) {
+	loss := flags.Float64("loss", 0, "chance each datagram is dropped, from 0 to 1")
+	latency := flags.Duration("latency", 0, "delay added to every datagram")
+	jitter := flags.Duration("jitter", 0, "up to this much more or less delay on each datagram")
+	reorder := flags.Float64("reorder", 0, "chance a datagram skips the latency and overtakes those ahead of it")
+	duplicate := flags.Float64("duplicate", 0, "chance a datagram is delivered twice")
+	corrupt := flags.Float64("corrupt", 0, "chance one byte of a datagram is flipped")
+	rate := flags.String("rate", "", "link speed, such as 100kbit or 0.1mbit (unlimited unless set)")
+	mtu := flags.Int("mtu", 0, "drop datagrams longer than this many bytes (no limit unless set)")
+	shrunkMTU := flags.Int("shrink-mtu", 0, "drop the MTU to this many bytes once -shrink-after has passed")
+	shrinkAfter := flags.Duration("shrink-after", 0, "how long the link carries traffic before -shrink-mtu takes effect")
+	seed := flags.Int64("seed", 1, "seed for every impairment; the same seed reproduces a run")
+
+	return func() (netem.Config, error) {
+		config := netem.Config{
+			Loss:        *loss,
+			Latency:     *latency,
+			Jitter:      *jitter,
+			Reorder:     *reorder,
+			Duplicate:   *duplicate,
+			Corrupt:     *corrupt,
+			MTU:         *mtu,
+			ShrunkMTU:   *shrunkMTU,
+			ShrinkAfter: *shrinkAfter,
+			Seed:        *seed,
+		}
+		if *rate != "" {
+			bits, err := netem.ParseRate(*rate)
+			if err != nil {
+				return config, err
+			}
+			config.Rate = bits
+		}
+		return config, nil
+	}
+}
+
+func exit(err error) {
+	log.ERR.Printf("[error] %s\n", err)
+	os.Exit(1)
+}
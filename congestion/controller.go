@@ -0,0 +1,63 @@
+package congestion
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	NEWRENO = "newreno"
+	CUBIC   = "cubic"
+
+	// Window sizes, in packets
+	INITIAL_WINDOW = 10
+	MIN_WINDOW     = 2
+	MAX_WINDOW     = 4096
+)
+
+// CongestionController decides how many packets the sender may have in
+// flight at once. Implementations are not safe for concurrent use.
+type CongestionController interface {
+	// Name of the algorithm, for logging
+	Name() string
+
+	// Number of packets that may currently be in flight
+	Window() int
+
+	// Called once for every newly acknowledged packet, with the latest
+	// smoothed round trip time (0 if not yet measured)
+	OnAck(now time.Time, rtt time.Duration)
+
+	// Called once per congestion event, not once per lost packet
+	OnLoss(now time.Time)
+
+	// Called when a retransmission timeout finds packets lost; the window
+	// collapses and slow start begins again
+	OnTimeout(now time.Time)
+}
+
+// New builds the named controller, never letting its window grow past maxWindow
+func New(name string, maxWindow int) (CongestionController, error) {
+	if maxWindow < MIN_WINDOW {
+		return nil, fmt.Errorf("window cap %d is below the minimum of %d", maxWindow, MIN_WINDOW)
+	}
+
+	switch name {
+	case NEWRENO:
+		return NewNewReno(maxWindow), nil
+	case CUBIC:
+		return NewCubic(maxWindow), nil
+	default:
+		return nil, fmt.Errorf("unknown congestion controller %q", name)
+	}
+}
+
+func clampWindow(cwnd float64, maxWindow int) float64 {
+	if cwnd < MIN_WINDOW {
+		return MIN_WINDOW
+	}
+	if cwnd > float64(maxWindow) {
+		return float64(maxWindow)
+	}
+	return cwnd
+}
@@ -0,0 +1,93 @@
+package congestion
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var epoch = time.Unix(0, 0)
+
+func TestNewUnknown(t *testing.T) {
+	_, err := New("vegas", MAX_WINDOW)
+	assert.NotNil(t, err)
+}
+
+func TestSlowStart(t *testing.T) {
+	for _, name := range []string{NEWRENO, CUBIC} {
+		cc, err := New(name, MAX_WINDOW)
+		assert.Nil(t, err)
+		assert.Equal(t, INITIAL_WINDOW, cc.Window())
+
+		// One window of acks doubles the window
+		for i := 0; i < INITIAL_WINDOW; i++ {
+			cc.OnAck(epoch, 10*time.Millisecond)
+		}
+		assert.Equal(t, 2*INITIAL_WINDOW, cc.Window(), name)
+	}
+}
+
+func TestWindowCapped(t *testing.T) {
+	for _, name := range []string{NEWRENO, CUBIC} {
+		cc, _ := New(name, 16)
+		for i := 0; i < 100; i++ {
+			cc.OnAck(epoch, 10*time.Millisecond)
+		}
+		assert.Equal(t, 16, cc.Window(), name)
+	}
+}
+
+func TestNewRenoHalvesOnLoss(t *testing.T) {
+	cc := NewNewReno(MAX_WINDOW)
+	for i := 0; i < 30; i++ {
+		cc.OnAck(epoch, 10*time.Millisecond)
+	}
+	cc.OnLoss(epoch)
+	assert.Equal(t, 20, cc.Window())
+
+	// Congestion avoidance: one packet per window of acks
+	for i := 0; i < 20; i++ {
+		cc.OnAck(epoch, 10*time.Millisecond)
+	}
+	assert.Equal(t, 20, cc.Window())
+	cc.OnAck(epoch, 10*time.Millisecond)
+	assert.Equal(t, 21, cc.Window())
+}
+
+func TestCubicRecoversToLastMax(t *testing.T) {
+	cc := NewCubic(MAX_WINDOW)
+	for i := 0; i < 90; i++ {
+		cc.OnAck(epoch, 10*time.Millisecond)
+	}
+	assert.Equal(t, 100, cc.Window())
+
+	cc.OnLoss(epoch)
+	assert.Equal(t, 70, cc.Window())
+
+	// K = cbrt(100 * 0.3 / 0.4) ~ 4.2s to climb back to the old maximum
+	cc.OnAck(epoch, 10*time.Millisecond)
+	assert.True(t, cc.Window() < 100)
+	cc.OnAck(epoch.Add(5*time.Second), 10*time.Millisecond)
+	for i := 0; i < 1000; i++ {
+		cc.OnAck(epoch.Add(5*time.Second), 10*time.Millisecond)
+	}
+	assert.True(t, cc.Window() >= 100)
+}
+
+func TestTimeoutRestartsSlowStart(t *testing.T) {
+	for _, name := range []string{NEWRENO, CUBIC} {
+		cc, _ := New(name, MAX_WINDOW)
+		for i := 0; i < 30; i++ {
+			cc.OnAck(epoch, 10*time.Millisecond)
+		}
+		cc.OnTimeout(epoch)
+		assert.Equal(t, MIN_WINDOW, cc.Window(), name)
+
+		// Slow start up to the reduced threshold, then avoidance
+		for i := 0; i < 18; i++ {
+			cc.OnAck(epoch, 10*time.Millisecond)
+		}
+		assert.Equal(t, 20, cc.Window(), name)
+	}
+}
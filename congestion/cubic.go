@@ -0,0 +1,105 @@
+package congestion
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// Scaling constant and multiplicative decrease factor (RFC 8312)
+	CUBIC_C    = 0.4
+	CUBIC_BETA = 0.7
+)
+
+// Cubic grows the window along a cubic curve centred on the window size at
+// the last loss, so it recovers quickly on long fat links (RFC 8312).
+type Cubic struct {
+	cwnd      float64
+	ssthresh  float64
+	maxWindow int
+
+	// Window just before the last reduction
+	wMax float64
+
+	// Start of the current congestion avoidance epoch, and the time (in
+	// seconds) it takes the curve to climb back to its origin
+	epochStart time.Time
+	k          float64
+	origin     float64
+
+	// Estimate of what a Reno flow would have reached, so CUBIC is never
+	// slower than Reno on short RTT links
+	wEst float64
+}
+
+func NewCubic(maxWindow int) *Cubic {
+	return &Cubic{
+		cwnd:      INITIAL_WINDOW,
+		ssthresh:  math.Inf(1),
+		maxWindow: maxWindow,
+	}
+}
+
+func (c *Cubic) Name() string {
+	return CUBIC
+}
+
+func (c *Cubic) Window() int {
+	return int(c.cwnd)
+}
+
+func (c *Cubic) OnAck(now time.Time, rtt time.Duration) {
+	if c.cwnd < c.ssthresh {
+		c.cwnd = clampWindow(c.cwnd+1, c.maxWindow)
+		return
+	}
+
+	if c.epochStart.IsZero() {
+		c.epochStart = now
+		if c.cwnd < c.wMax {
+			c.k = math.Cbrt((c.wMax - c.cwnd) / CUBIC_C)
+			c.origin = c.wMax
+		} else {
+			c.k = 0
+			c.origin = c.cwnd
+		}
+		c.wEst = c.cwnd
+	}
+
+	t := now.Add(rtt).Sub(c.epochStart).Seconds()
+	target := CUBIC_C*math.Pow(t-c.k, 3) + c.origin
+
+	if target > c.cwnd {
+		c.cwnd += (target - c.cwnd) / c.cwnd
+	} else {
+		c.cwnd += 0.01 / c.cwnd
+	}
+
+	c.wEst += 3 * (1 - CUBIC_BETA) / (1 + CUBIC_BETA) / c.cwnd
+	if c.wEst > c.cwnd {
+		c.cwnd = c.wEst
+	}
+
+	c.cwnd = clampWindow(c.cwnd, c.maxWindow)
+}
+
+func (c *Cubic) OnLoss(now time.Time) {
+	c.epochStart = time.Time{}
+
+	// Fast convergence: give up bandwidth sooner if we're still shrinking
+	if c.cwnd < c.wMax {
+		c.wMax = c.cwnd * (1 + CUBIC_BETA) / 2
+	} else {
+		c.wMax = c.cwnd
+	}
+
+	c.ssthresh = clampWindow(c.cwnd*CUBIC_BETA, c.maxWindow)
+	c.cwnd = c.ssthresh
+}
+
+// The window is reduced as for a loss, but restarts from the loss window in
+// slow start (RFC 8312 4.7)
+func (c *Cubic) OnTimeout(now time.Time) {
+	c.OnLoss(now)
+	c.cwnd = MIN_WINDOW
+}
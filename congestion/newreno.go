@@ -0,0 +1,50 @@
+package congestion
+
+import (
+	"math"
+	"time"
+)
+
+// NewReno grows the window by one packet per ack during slow start, by one
+// packet per window during congestion avoidance, and halves it on loss. A
+// retransmission timeout drops it to the loss window (RFC 5681 3.1).
+type NewReno struct {
+	cwnd      float64
+	ssthresh  float64
+	maxWindow int
+}
+
+func NewNewReno(maxWindow int) *NewReno {
+	return &NewReno{
+		cwnd:      INITIAL_WINDOW,
+		ssthresh:  math.Inf(1),
+		maxWindow: maxWindow,
+	}
+}
+
+func (r *NewReno) Name() string {
+	return NEWRENO
+}
+
+func (r *NewReno) Window() int {
+	return int(r.cwnd)
+}
+
+func (r *NewReno) OnAck(now time.Time, rtt time.Duration) {
+	if r.cwnd < r.ssthresh {
+		r.cwnd += 1
+	} else {
+		r.cwnd += 1 / r.cwnd
+	}
+	r.cwnd = clampWindow(r.cwnd, r.maxWindow)
+}
+
+func (r *NewReno) OnLoss(now time.Time) {
+	r.ssthresh = clampWindow(r.cwnd/2, r.maxWindow)
+	r.cwnd = r.ssthresh
+}
+
+func (r *NewReno) OnTimeout(now time.Time) {
+	r.ssthresh = clampWindow(r.cwnd/2, r.maxWindow)
+	r.cwnd = MIN_WINDOW
+}
@@ -0,0 +1,282 @@
+package faart
+
+import (
+	"context"
+	"crypto/sha256"
+	"hash"
+	"io"
+	"net"
+
+	"github.com/djreed/faart/log"
+	"github.com/djreed/faart/packet"
+	"github.com/djreed/faart/shared"
+)
+
+// The sending end of a transfer. Everything written is compressed and
+// streamed to the receiver; Close flushes the stream and waits for the
+// receiver to acknowledge all of it and confirm it decompressed to exactly
+// what was written. A Conn is not safe for concurrent writes.
+type Conn struct {
+	conn   *net.UDPConn
+	out    *sendHalf
+	sealer *packet.Sealer
+
+	// Compresses the stream into out's packets; nil until the codec has
+	// been picked
+	compressor io.WriteCloser
+	// The codec asked for, and once compressing, the one picked
+	codec packet.Codec
+	level int
+	// Whether to sample the input before picking a codec, and what's been
+	// held back for the sample so far
+	detect bool
+	sample []byte
+
+	// Hashes everything written, for the FIN to carry
+	digest hash.Hash
+}
+
+// Opens a transfer to the receiver at address with the default Config
+func Dial(ctx context.Context, address string) (*Conn, error) {
+	return DialConfig(ctx, address, Config{})
+}
+
+// Opens a transfer to the receiver at address. ctx bounds the handshake
+// only; once Dial returns the transfer lasts until Close.
+func DialConfig(ctx context.Context, address string, config Config) (*Conn, error) {
+	if config.FEC != 0 && !config.FEC.Valid() {
+		return nil, packet.ErrFECScheme
+	}
+	if err := config.checkCompression(); err != nil {
+		return nil, err
+	}
+
+	conn, synAck, sealer, out, err := dial(ctx, address, config, config.options())
+	if err != nil {
+		return nil, err
+	}
+	if !synAck.Codecs().Has(config.codec()) {
+		conn.Close()
+		return nil, ErrCodecUnsupported
+	}
+
+	c := &Conn{
+		conn:   conn,
+		out:    out,
+		sealer: sealer,
+		codec:  config.codec(),
+		level:  config.compressLevel(),
+		detect: !config.ForceCodec && synAck.Codecs().Has(packet.CODEC_NONE),
+		digest: sha256.New(),
+	}
+	out.attach(synAck.Prefix().Session(), packetSize(synAck), func(datagram packet.Datagram) error {
+		return shared.SendDatagram(conn, sealer.Seal(datagram))
+	})
+	out.discoverPMTU(baseDatagramSize(synAck), synAck.DatagramSize(), synAck.Options())
+	if synAck.Options()&packet.OPTION_FEC != 0 {
+		out.fec = newFECEncoder(config.FEC, synAck.Prefix().Session())
+	}
+	if synAck.Options()&packet.OPTION_RESUME != 0 {
+		missing := synAck.Missing()
+		out.packets.only(missing)
+		log.ERR.Printf("[resume] %x receiver already holds %d bytes\n", synAck.Prefix().Session(), held(missing))
+	}
+	out.run()
+
+	go c.queueAcks(synAck.DatagramSize())
+	return c, nil
+}
+
+// Connects to address and settles a session with options, returning the
+// socket, the receiver's SYN-ACK, what seals the session's packets (nil if
+// they go in the clear) and a send half ready to start
+func dial(ctx context.Context, address string, config Config, options packet.Options) (*net.UDPConn, packet.Handshake, *packet.Sealer, *sendHalf, error) {
+	if err := config.checkSealing(); err != nil {
+		return nil, nil, nil, nil, err
+	}
+	if err := config.checkDatagramSize(); err != nil {
+		return nil, nil, nil, nil, err
+	}
+	if err := config.checkReceiveBuffer(); err != nil {
+		return nil, nil, nil, nil, err
+	}
+	out, err := newSendHalf(config, shared.WallClock)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	raddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	conn, err := net.DialUDP("udp4", nil, raddr)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	dontFragment(conn)
+
+	syn, ephemeral, err := config.syn(options)
+	if err != nil {
+		conn.Close()
+		return nil, nil, nil, nil, err
+	}
+	synAck, err := handshake(ctx, conn, syn, out.rtt)
+	if err != nil {
+		conn.Close()
+		return nil, nil, nil, nil, err
+	}
+	if err := config.verifyReceiver(address, syn, synAck); err != nil {
+		conn.Close()
+		return nil, nil, nil, nil, err
+	}
+	sealer, err := config.sealer(syn, synAck, true, ephemeral)
+	if err != nil {
+		conn.Close()
+		return nil, nil, nil, nil, err
+	}
+	return conn, synAck, sealer, out, nil
+}
+
+// Bytes of the stream that come before the last of the missing ranges
+// without being in any of them
+func held(missing []packet.ByteRange) packet.OffsetVal {
+	var total, from packet.OffsetVal
+	for _, r := range missing {
+		total += r.Start - from
+		from = r.End
+	}
+	return total
+}
+
+// Session the receiver agreed to
+func (c *Conn) Session() packet.SessionID {
+	return c.out.session
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// Streams data to the receiver, blocking while the send window is full
+func (c *Conn) Write(data []byte) (int, error) {
+	select {
+	case <-c.out.closed:
+		return 0, c.out.failure()
+	default:
+	}
+
+	if c.compressor == nil && c.detect && len(c.sample) < packet.COMPRESS_SAMPLE_SIZE {
+		// Held back until there's enough to tell whether it's worth
+		// compressing
+		c.sample = append(c.sample, data...)
+		c.digest.Write(data)
+		if len(c.sample) < packet.COMPRESS_SAMPLE_SIZE {
+			return len(data), nil
+		}
+		if err := c.startCompressing(); err != nil {
+			return 0, err
+		}
+		return len(data), nil
+	}
+	if c.compressor == nil {
+		if err := c.startCompressing(); err != nil {
+			return 0, err
+		}
+	}
+
+	written, err := c.compressor.Write(data)
+	c.digest.Write(data[:written])
+	return written, err
+}
+
+// Picks the codec, sampling whatever has been held back if it's to, then
+// compresses what was held back
+func (c *Conn) startCompressing() error {
+	codec := c.codec
+	if c.detect {
+		sample := c.sample
+		if len(sample) > packet.COMPRESS_SAMPLE_SIZE {
+			sample = sample[:packet.COMPRESS_SAMPLE_SIZE]
+		}
+		if !packet.Compressible(sample) {
+			codec = packet.CODEC_NONE
+		}
+	}
+	log.ERR.Printf("[codec] %x %s\n", c.out.session, codec)
+
+	compressor, err := packet.NewCompressor(c.out.packets, codec, c.level)
+	if err != nil {
+		return err
+	}
+	c.compressor = compressor
+	c.codec = codec
+	_, err = compressor.Write(c.sample)
+	c.sample = nil
+	return err
+}
+
+// Flushes the stream, then waits until the receiver has acked every packet
+// and the FIN. Fails with ErrDigestMismatch or ErrReceiverFailed if the
+// receiver reports it didn't end up with everything written, and with
+// ErrFinUnanswered or ErrUnconfirmed if it never says either way.
+func (c *Conn) Close() error {
+	defer c.conn.Close()
+
+	select {
+	case <-c.out.closed:
+		return c.closeSession(c.out.close(nil))
+	default:
+	}
+
+	if c.compressor == nil {
+		if err := c.startCompressing(); err != nil {
+			return c.out.fail(err)
+		}
+	}
+	if err := c.compressor.Close(); err != nil {
+		return c.out.fail(err)
+	}
+	if err := c.out.packets.Flush(); err != nil {
+		return c.out.fail(err)
+	}
+	return c.closeSession(c.out.close(c.digest.Sum(nil)))
+}
+
+// Tells the receiver its verdict was heard, if there was one, so it stops
+// answering the FIN; should this be lost, it stops once the sender goes
+// quiet. Passes err through.
+func (c *Conn) closeSession(err error) error {
+	switch err {
+	case nil, ErrDigestMismatch, ErrReceiverFailed:
+		c.out.write(packet.Datagram(packet.CreateClose(c.out.session)))
+	}
+	return err
+}
+
+// Hands each ack the receiver sends, in datagrams of up to datagramSize, to
+// the send half
+func (c *Conn) queueAcks(datagramSize int) {
+	buffer := packet.NewDatagram(readBufferSize(datagramSize))
+	for {
+		read, _, err := c.conn.ReadFrom(buffer)
+		if read > 0 {
+			raw := append([]byte(nil), buffer[:read]...)
+			if ack, ok := c.sealer.Open(raw); ok {
+				c.out.receiveAck(ack)
+			} else {
+				log.ERR.Printf("[recv unauthenticated] %x\n", c.out.session)
+			}
+		} else if err != nil {
+			select {
+			case <-c.out.closed:
+				return
+			default:
+			}
+		}
+	}
+}
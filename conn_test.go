@@ -0,0 +1,428 @@
+package faart
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/djreed/faart/netem"
+	"github.com/djreed/faart/packet"
+	"github.com/djreed/faart/shared"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDialListenRoundTrip(t *testing.T) {
+	listener, err := Listen("127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+
+	var source bytes.Buffer
+	io.CopyN(&source, &syntheticSource{}, 200000)
+
+	sent := make(chan error, 1)
+	go func() {
+		conn, err := Dial(context.Background(), listener.Addr().String())
+		if err != nil {
+			sent <- err
+			return
+		}
+		if _, err := conn.Write(source.Bytes()); err != nil {
+			sent <- err
+			return
+		}
+		sent <- conn.Close()
+	}()
+
+	transfer, err := listener.Accept()
+	assert.NoError(t, err)
+	received, err := ioutil.ReadAll(transfer)
+	assert.NoError(t, err)
+	assert.NoError(t, <-sent)
+	assert.True(t, bytes.Equal(source.Bytes(), received))
+
+	// The sender's close lets the receiver stop lingering well before
+	// TIME_WAIT is up
+	select {
+	case <-transfer.lingered:
+	case <-time.After(shared.TIME_WAIT / 2):
+		t.Fatal("receiver lingered after the sender closed")
+	}
+}
+
+// Dials listener and sends source, reporting how Close went; tamper, if
+// given, gets a go at the Conn just before
+func sendTo(listener *Listener, config Config, source []byte, tamper func(*Conn)) chan error {
+	sent := make(chan error, 1)
+	go func() {
+		conn, err := DialConfig(context.Background(), listener.Addr().String(), config)
+		if err != nil {
+			sent <- err
+			return
+		}
+		if _, err := conn.Write(source); err != nil {
+			sent <- err
+			return
+		}
+		if tamper != nil {
+			tamper(conn)
+		}
+		sent <- conn.Close()
+	}()
+	return sent
+}
+
+// Retransmits, fast retransmits, parity and acks all at once over real
+// sockets, for go test -race to look over
+func TestLossyTransfer(t *testing.T) {
+	listener, err := Listen("127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	proxy, err := netem.Listen("127.0.0.1:0", listener.Addr().String(), netem.Config{
+		Loss: 0.1, Reorder: 0.1, Duplicate: 0.05, Latency: 2 * time.Millisecond, Seed: 3,
+	})
+	require.NoError(t, err)
+	defer proxy.Close()
+
+	var source bytes.Buffer
+	io.CopyN(&source, &syntheticSource{}, 1000000)
+	config := Config{FEC: packet.FEC_XOR, Codec: packet.CODEC_NONE}
+	sent := make(chan error, 1)
+	go func() {
+		conn, err := DialConfig(context.Background(), proxy.Addr().String(), config)
+		if err != nil {
+			sent <- err
+			return
+		}
+		conn.Write(source.Bytes())
+		sent <- conn.Close()
+	}()
+
+	transfer, err := listener.Accept()
+	require.NoError(t, err)
+	received, err := ioutil.ReadAll(transfer)
+	assert.NoError(t, err)
+	assert.NoError(t, <-sent)
+	assert.True(t, bytes.Equal(source.Bytes(), received))
+}
+
+func TestCodecs(t *testing.T) {
+	listener, err := Listen("127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	var text bytes.Buffer
+	io.CopyN(&text, &syntheticSource{}, 100000)
+	random := make([]byte, 100000)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	for _, test := range []struct {
+		config Config
+		source []byte
+		picked packet.Codec
+	}{
+		{Config{}, text.Bytes(), packet.CODEC_GZIP},
+		{Config{Codec: packet.CODEC_LZW}, text.Bytes(), packet.CODEC_LZW},
+		{Config{Codec: packet.CODEC_FLATE, CompressLevel: 1}, text.Bytes(), packet.CODEC_FLATE},
+		// Already compressed, as far as the sample can tell
+		{Config{Codec: packet.CODEC_ZLIB}, random, packet.CODEC_NONE},
+		{Config{Codec: packet.CODEC_ZLIB, ForceCodec: true}, random, packet.CODEC_ZLIB},
+		// Too short for compressing to shrink it
+		{Config{}, []byte("short"), packet.CODEC_NONE},
+	} {
+		var conn *Conn
+		sent := sendTo(listener, test.config, test.source, func(c *Conn) { conn = c })
+		transfer, err := listener.Accept()
+		require.NoError(t, err)
+		received, err := ioutil.ReadAll(transfer)
+		assert.NoError(t, err)
+		assert.NoError(t, <-sent)
+		assert.True(t, bytes.Equal(test.source, received))
+		assert.Equal(t, test.picked, conn.codec, "%+v", test.config)
+	}
+
+	_, err = DialConfig(context.Background(), listener.Addr().String(), Config{Codec: packet.CODEC_GZIP, CompressLevel: 42})
+	assert.Error(t, err)
+}
+
+func TestDigestMismatch(t *testing.T) {
+	listener, err := Listen("127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	var source bytes.Buffer
+	io.CopyN(&source, &syntheticSource{}, 100000)
+	// As if a packet had gone missing without anyone noticing
+	sent := sendTo(listener, Config{}, source.Bytes(), func(conn *Conn) {
+		conn.digest.Write([]byte("more"))
+	})
+
+	transfer, err := listener.Accept()
+	require.NoError(t, err)
+	_, err = ioutil.ReadAll(transfer)
+	assert.Equal(t, ErrDigestMismatch, err)
+	assert.Equal(t, ErrDigestMismatch, <-sent)
+}
+
+func TestSenderWaitsForSlowReader(t *testing.T) {
+	clock := newVirtualClock()
+	out, err := newSendHalf(Config{}, clock)
+	require.NoError(t, err)
+	out.synchronous = true
+
+	// A receiver whose reader takes three times as long as the sender
+	// would wait on an unanswered FIN, answering it as pending until then
+	checked := clock.start.Add(3 * shared.FIN_TIMEOUT_WAIT)
+	var acks []packet.Ack
+	out.attach(testSession, packet.PACKET_SIZE, func(datagram packet.Datagram) error {
+		// The FIN is never counted in the cumulative ack; its status says
+		// how the stream checked out
+		cumulative := datagram.Headers().Sequence()
+		if !datagram.Headers().Done() {
+			cumulative++
+		}
+		ack := packet.CreateAck(datagram, cumulative, nil)
+		ack.SetWindow(packet.UNLIMITED_WINDOW)
+		if bool(datagram.Headers().Done()) && clock.Now().Before(checked) {
+			ack.SetStatus(packet.ACK_STATUS_PENDING)
+		}
+		acks = append(acks, ack)
+		return nil
+	})
+
+	quietly(func() {
+		require.NoError(t, out.packets.emit([]byte("data")))
+		out.end(nil)
+		for {
+			select {
+			case err := <-out.completed:
+				assert.NoError(t, err)
+				assert.False(t, clock.Now().Before(checked), "finished before the reader had checked the stream")
+				return
+			default:
+			}
+			for len(acks) > 0 {
+				ack := acks[0]
+				acks = acks[1:]
+				out.processAck(ack)
+			}
+			require.True(t, clock.step(), "stalled waiting on the reader")
+		}
+	})
+}
+
+func TestFinUnanswered(t *testing.T) {
+	clock := newVirtualClock()
+	out, err := newSendHalf(Config{}, clock)
+	require.NoError(t, err)
+	out.synchronous = true
+
+	// A receiver that takes the data but never answers the FIN
+	var acks []packet.Ack
+	out.attach(testSession, packet.PACKET_SIZE, func(datagram packet.Datagram) error {
+		if !datagram.Headers().Done() {
+			ack := packet.CreateAck(datagram, datagram.Headers().Sequence()+1, nil)
+			ack.SetWindow(packet.UNLIMITED_WINDOW)
+			acks = append(acks, ack)
+		}
+		return nil
+	})
+
+	quietly(func() {
+		require.NoError(t, out.packets.emit([]byte("data")))
+		out.end(nil)
+		for {
+			select {
+			case err := <-out.completed:
+				assert.Equal(t, ErrFinUnanswered, err)
+				assert.True(t, clock.Now().Sub(clock.start) >= shared.FIN_TIMEOUT_WAIT)
+				return
+			default:
+			}
+			for len(acks) > 0 {
+				ack := acks[0]
+				acks = acks[1:]
+				out.processAck(ack)
+			}
+			require.True(t, clock.step(), "stalled before giving up on the FIN")
+		}
+	})
+}
+
+func TestSenderWaitsForRoom(t *testing.T) {
+	clock := newVirtualClock()
+	out, err := newSendHalf(Config{}, clock)
+	require.NoError(t, err)
+	out.synchronous = true
+
+	// A receiver with room for a handful of packets, whose reader holds
+	// off until the sender has had to probe for room
+	buffer := newStreamBuffer(8 * packet.PACKET_SIZE)
+	in := newRecvHalf(testSession, buffer)
+	in.limit = buffer
+	in.packetSize = packet.PACKET_SIZE
+	var acks []packet.Ack
+	var last packet.Datagram
+	out.attach(testSession, packet.PACKET_SIZE, func(datagram packet.Datagram) error {
+		if needAck, _ := in.acceptDatagram(datagram); needAck {
+			if !in.refused {
+				last = datagram
+			}
+			acks = append(acks, in.ack(datagram))
+		}
+		return nil
+	})
+
+	source := make([]byte, 64*packet.PACKET_SIZE)
+	rand.New(rand.NewSource(2)).Read(source)
+	var written int
+	// Whether the window would let the next packet go without blocking
+	room := func() bool {
+		w := out.window
+		w.lock.Lock()
+		defer w.lock.Unlock()
+		return w.inFlight < w.size() && (w.inFlight == 0 || !w.beyond(packet.SeqID(out.packets.Count())))
+	}
+
+	var received []byte
+	quietly(func() {
+		for {
+			select {
+			case err := <-out.completed:
+				require.NoError(t, err)
+				assert.True(t, bytes.Equal(source, received))
+				assert.Zero(t, out.stats.rtoRetransmits)
+				assert.NotZero(t, out.stats.windowProbes)
+				return
+			default:
+			}
+
+			for written < len(source) && room() {
+				require.NoError(t, out.packets.emit(source[written:written+packet.PACKET_SIZE]))
+				written += packet.PACKET_SIZE
+			}
+			if written == len(source) && !out.readDone {
+				out.end(nil)
+			}
+
+			if out.stats.windowProbes > 0 && buffer.free() < buffer.capacity {
+				read := make([]byte, buffer.capacity)
+				n, _ := buffer.Read(read)
+				received = append(received, read[:n]...)
+				if in.windowOpened() {
+					acks = append(acks, in.ack(last))
+				}
+			}
+			if len(acks) > 0 {
+				for len(acks) > 0 {
+					ack := acks[0]
+					acks = acks[1:]
+					out.processAck(ack)
+				}
+				continue
+			}
+			require.True(t, clock.step(), "stalled with %d of %d bytes read", len(received), len(source))
+		}
+	})
+}
+
+// Loopback carries far more than Ethernet, so both ends offering jumbo
+// datagrams should see the first probe through
+func TestJumboDatagrams(t *testing.T) {
+	config := Config{DatagramSize: 9000}
+	listener, err := ListenConfig("127.0.0.1:0", config)
+	require.NoError(t, err)
+	defer listener.Close()
+
+	var source bytes.Buffer
+	io.CopyN(&source, &syntheticSource{}, 1000000)
+	conns := make(chan *Conn, 1)
+	sent := sendTo(listener, config, source.Bytes(), func(conn *Conn) { conns <- conn })
+
+	transfer, err := listener.Accept()
+	require.NoError(t, err)
+	received, err := ioutil.ReadAll(transfer)
+	assert.NoError(t, err)
+	require.NoError(t, <-sent)
+	assert.True(t, bytes.Equal(source.Bytes(), received))
+
+	conn := <-conns
+	conn.out.stateLock.Lock()
+	defer conn.out.stateLock.Unlock()
+	assert.Equal(t, 9000, conn.out.pmtu.size)
+}
+
+// A receiver capped below the size of a handshake still reads them whole
+func TestSmallDatagrams(t *testing.T) {
+	listener, err := ListenConfig("127.0.0.1:0", Config{DatagramSize: 600})
+	require.NoError(t, err)
+	defer listener.Close()
+
+	var source bytes.Buffer
+	io.CopyN(&source, &syntheticSource{}, 100000)
+	conns := make(chan *Conn, 1)
+	sent := sendTo(listener, Config{}, source.Bytes(), func(conn *Conn) { conns <- conn })
+
+	transfer, err := listener.Accept()
+	require.NoError(t, err)
+	received, err := ioutil.ReadAll(transfer)
+	assert.NoError(t, err)
+	require.NoError(t, <-sent)
+	assert.True(t, bytes.Equal(source.Bytes(), received))
+	assert.Equal(t, payloadSize(600, 0), (<-conns).out.packets.size())
+}
+
+func TestTinyReceiveBuffer(t *testing.T) {
+	// Smaller than any datagram, so it only ever has room for one
+	listener, err := ListenConfig("127.0.0.1:0", Config{ReceiveBuffer: 100})
+	require.NoError(t, err)
+	defer listener.Close()
+
+	var source bytes.Buffer
+	io.CopyN(&source, &syntheticSource{}, 20000)
+	sent := sendTo(listener, Config{}, source.Bytes(), nil)
+
+	transfer, err := listener.Accept()
+	require.NoError(t, err)
+	received, err := ioutil.ReadAll(transfer)
+	assert.NoError(t, err)
+	require.NoError(t, <-sent)
+	assert.True(t, bytes.Equal(source.Bytes(), received))
+
+	_, err = ListenConfig("127.0.0.1:0", Config{ReceiveBuffer: -1})
+	assert.Equal(t, ErrReceiveBuffer, err)
+}
+
+func TestDatagramTooLarge(t *testing.T) {
+	_, err := ListenConfig("127.0.0.1:0", Config{DatagramSize: packet.MAX_DATAGRAM_SIZE + 1})
+	assert.Equal(t, ErrDatagramTooLarge, err)
+}
+
+func TestDialCancelled(t *testing.T) {
+	// Never answers the SYN
+	silent, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	defer silent.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	started := time.Now()
+	_, err = Dial(ctx, silent.LocalAddr().String())
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.True(t, time.Since(started) < time.Second)
+}
+
+func TestListenerClose(t *testing.T) {
+	listener, err := Listen("127.0.0.1:0")
+	assert.NoError(t, err)
+	listener.Close()
+
+	_, err = listener.Accept()
+	assert.Equal(t, ErrClosed, err)
+}
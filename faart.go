@@ -0,0 +1,363 @@
+// Package faart moves a compressed byte stream reliably over UDP.
+//
+// Dial opens a Conn that streams everything written to it to a Listener,
+// which hands each incoming stream out as a Transfer to read from.
+package faart
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/djreed/faart/congestion"
+	"github.com/djreed/faart/packet"
+	"golang.org/x/crypto/ed25519"
+)
+
+var (
+	// The receiver never answered the SYN
+	ErrHandshakeTimeout = errors.New("faart: receiver never answered the handshake")
+	// The receiver settled on a datagram too small to carry any data
+	ErrDatagramSize = errors.New("faart: receiver settled on a datagram too small to carry data")
+	// Config.DatagramSize asks for more than a UDP datagram can carry
+	ErrDatagramTooLarge = errors.New("faart: datagram size is past what UDP can carry")
+	// Config.ReceiveBuffer is negative
+	ErrReceiveBuffer = errors.New("faart: receive buffer size can't be negative")
+	// A transfer went longer than the idle timeout without any traffic
+	ErrIdle = errors.New("faart: transfer went idle before completing")
+	// The Conn, Transfer, Stream or Listener has already been closed
+	ErrClosed = errors.New("faart: use of closed connection")
+	// The receiver doesn't support full-duplex streams
+	ErrStreamUnsupported = errors.New("faart: receiver does not support streams")
+	// The receiver won't seal packets with the requested cipher, or has no key
+	ErrSealUnsupported = errors.New("faart: receiver does not support the requested encryption")
+	// The receiver can't decompress the requested codec
+	ErrCodecUnsupported = errors.New("faart: receiver does not support the requested codec")
+	// The receiver's half of the key exchange wasn't signed by the identity
+	// it carried
+	ErrHandshakeForged = errors.New("faart: receiver's handshake signature does not check out")
+	// What the receiver decompressed doesn't hash to what the sender sent
+	ErrDigestMismatch = errors.New("faart: received data does not match what was sent")
+	// A datagram due next in the received stream doesn't start where the
+	// stream had got to
+	ErrOffsetMismatch = errors.New("faart: received datagram does not follow on from the stream")
+	// The compressed stream carried more after its codec said it was done
+	ErrTrailingData = errors.New("faart: stream carries data past its end")
+	// The receiver gave up on the transfer after it started, so the sender
+	// can't count it as delivered
+	ErrReceiverFailed = errors.New("faart: receiver failed to take the transfer")
+	// The receiver was still checking the stream when it went quiet
+	ErrUnconfirmed = errors.New("faart: receiver never confirmed the transfer")
+	// The receiver never answered the FIN, so may not have everything
+	ErrFinUnanswered = errors.New("faart: receiver never answered the FIN")
+
+	// A stream read or write outlasted its deadline
+	errDeadline error = deadlineError{}
+)
+
+// Satisfies net.Error, so callers can tell a deadline apart from a failure
+type deadlineError struct{}
+
+func (deadlineError) Error() string   { return "faart: i/o timeout" }
+func (deadlineError) Timeout() bool   { return true }
+func (deadlineError) Temporary() bool { return true }
+
+// Tunables for Dial and Listen; the zero value gives the defaults
+type Config struct {
+	// Congestion control algorithm for the sender, congestion.NEWRENO
+	// unless set
+	Congestion string
+	// Cap on the sender's packets in flight, congestion.MAX_WINDOW unless set
+	MaxWindow int
+	// How long past SRTT a packet may go unacked once later packets have
+	// been acked before it is resent; SRTT / 4 unless set
+	Reorder time.Duration
+
+	// How a Conn compresses its stream, packet.CODEC_GZIP unless set, at
+	// CompressLevel, packet.COMPRESS_LEVEL unless set, for the codecs that
+	// take one. Unless ForceCodec is set, input whose start barely shrinks
+	// at flate.BestSpeed is sent as packet.CODEC_NONE instead, since it's
+	// most likely compressed already.
+	Codec         packet.Codec
+	CompressLevel int
+	ForceCodec    bool
+
+	// Forward error correction for a Conn, packet.FEC_XOR or
+	// packet.FEC_REED_SOLOMON; none unless set, or if the receiver doesn't
+	// support it. Streams never use it.
+	FEC packet.FECScheme
+
+	// Pre-shared key of packet.KEY_SIZE bytes, from packet.LoadKey or
+	// packet.PassphraseKey. Set, every packet after the handshake is sealed
+	// and the peer must hold the same key; a Listener turns away anyone
+	// who doesn't ask for sealing.
+	Key []byte
+	// AEAD to seal packets with, packet.CIPHER_AES_GCM unless set. A
+	// Listener accepts either.
+	Cipher packet.Cipher
+
+	// Long-term key, from identity.LoadPrivateKey, that signs this side's
+	// half of an X25519 key exchange. The exchange's secret seals the
+	// session, mixed with Key if that's set too, so a session stays secret
+	// even if the long-term keys later leak. A Listener with an Identity
+	// only accepts senders doing the exchange; a Conn or Stream without
+	// one signs with a throwaway key.
+	Identity ed25519.PrivateKey
+	// Decides whether to trust the peer's identity once its signature
+	// checks out. A Conn or Stream is given the address it dialled and the
+	// receiver's key, and a Listener each sender's address and key; see
+	// identity.KnownHosts and identity.AuthorizedKeys. Set on a Conn or
+	// Stream, it asks for the key exchange.
+	VerifyPeer func(address string, key ed25519.PublicKey) error
+
+	// Names what a Conn sends, from packet.ContentIDOf, so a Listener keeping
+	// checkpoints can resume it where an earlier transfer of the same
+	// content left off. The same ID must always mean the same bytes.
+	ContentID packet.ContentID
+	// Directory a Listener keeps the compressed stream of transfers that
+	// name their content in as it arrives, so one cut short can be resumed
+	// by the next sender of the same content; off unless set
+	Checkpoints string
+
+	// Transfers a Listener may have in progress at once; no limit unless set
+	MaxTransfers int
+	// How long a Listener's transfer may go without traffic before it
+	// fails with ErrIdle; forever unless set
+	IdleTimeout time.Duration
+	// Bytes a transfer or stream holds for its reader before the sender is
+	// told to wait; TRANSFER_BUFFER or STREAM_BUFFER unless set
+	ReceiveBuffer int
+
+	// Largest datagram this side sends or takes, packet.DATAGRAM_SIZE
+	// unless set; a session uses the smaller of both sides'. Sessions start
+	// at packet.BASE_DATAGRAM_SIZE and probe their way up to it, so raising
+	// it on loopback or a jumbo frame network lets them find the room, while
+	// lowering it caps a path known to be narrower.
+	DatagramSize int
+}
+
+func (config Config) receiveBuffer(fallback int) int {
+	if config.ReceiveBuffer == 0 {
+		return fallback
+	}
+	return config.ReceiveBuffer
+}
+
+func (config Config) checkReceiveBuffer() error {
+	if config.ReceiveBuffer < 0 {
+		return ErrReceiveBuffer
+	}
+	return nil
+}
+
+func (config Config) datagramSize() int {
+	if config.DatagramSize <= 0 {
+		return packet.DATAGRAM_SIZE
+	}
+	return config.DatagramSize
+}
+
+// Room to read anything a session of datagramSize sends: its datagrams and
+// acks, and handshakes, which aren't held to it
+func readBufferSize(datagramSize int) int {
+	if datagramSize < packet.MAX_HANDSHAKE_SIZE {
+		return packet.MAX_HANDSHAKE_SIZE
+	}
+	return datagramSize
+}
+
+func (config Config) checkDatagramSize() error {
+	if config.datagramSize() > packet.MAX_DATAGRAM_SIZE {
+		return ErrDatagramTooLarge
+	}
+	return nil
+}
+
+func (config Config) codec() packet.Codec {
+	if config.Codec == 0 {
+		return packet.CODEC_GZIP
+	}
+	return config.Codec
+}
+
+func (config Config) compressLevel() int {
+	if config.CompressLevel == 0 {
+		return packet.COMPRESS_LEVEL
+	}
+	return config.CompressLevel
+}
+
+// Codecs a Conn asks to compress with: its own, and none for input that
+// turns out not to be worth compressing
+func (config Config) codecs() packet.Codecs {
+	if config.ForceCodec {
+		return packet.CodecsOf(config.codec())
+	}
+	return packet.CodecsOf(config.codec(), packet.CODEC_NONE)
+}
+
+// Catches an unknown codec or a level it won't take before any packets are
+// sent
+func (config Config) checkCompression() error {
+	compressor, err := packet.NewCompressor(ioutil.Discard, config.codec(), config.compressLevel())
+	if err != nil {
+		return err
+	}
+	return compressor.Close()
+}
+
+// What a Conn's SYN names its content by: ContentID, narrowed down by how
+// the content is compressed, since resuming relies on the compressed
+// stream coming out the same
+func (config Config) contentID() packet.ContentID {
+	hash := sha256.New()
+	hash.Write(config.ContentID[:])
+	fmt.Fprintf(hash, "%s %d %t", config.codec(), config.compressLevel(), config.ForceCodec)
+
+	var id packet.ContentID
+	copy(id[:], hash.Sum(nil))
+	return id
+}
+
+func (config Config) congestion() string {
+	if config.Congestion == "" {
+		return congestion.NEWRENO
+	}
+	return config.Congestion
+}
+
+// Options a Conn proposes in its SYN
+func (config Config) options() packet.Options {
+	var options packet.Options
+	if config.FEC != 0 {
+		options |= packet.OPTION_FEC
+	}
+	if config.Key != nil || config.exchanges() {
+		options |= config.cipher().Option()
+	}
+	if config.exchanges() {
+		options |= packet.OPTION_KEY_EXCHANGE
+	}
+	if config.ContentID != (packet.ContentID{}) {
+		options |= packet.OPTION_RESUME
+	}
+	return options
+}
+
+// Whether a Conn or Stream asks for the key exchange
+func (config Config) exchanges() bool {
+	return config.Identity != nil || config.VerifyPeer != nil
+}
+
+// Whether a Listener turns away anyone who doesn't seal their packets
+func (config Config) requiresSealing() bool {
+	return config.Key != nil || config.Identity != nil
+}
+
+func (config Config) cipher() packet.Cipher {
+	if config.Cipher == 0 {
+		return packet.CIPHER_AES_GCM
+	}
+	return config.Cipher
+}
+
+// Catches a bad key or cipher before any packets are sent
+func (config Config) checkSealing() error {
+	if config.Key != nil && len(config.Key) != packet.KEY_SIZE {
+		return packet.ErrKeySize
+	}
+	if config.Identity != nil && len(config.Identity) != ed25519.PrivateKeySize {
+		return packet.ErrKeySize
+	}
+	if !config.cipher().Valid() {
+		return packet.ErrCipher
+	}
+	return nil
+}
+
+// The SYN a Conn or Stream proposes options with, along with the private
+// half of its key exchange if it asks for one
+func (config Config) syn(options packet.Options) (packet.Handshake, []byte, error) {
+	id, err := packet.NewSessionID()
+	if err != nil {
+		return nil, nil, err
+	}
+	syn := packet.CreateSyn(id, config.datagramSize(), options)
+	if err := syn.RandomizeNonce(); err != nil {
+		return nil, nil, err
+	}
+	syn.SetCodecs(config.codecs())
+	if options&packet.OPTION_RESUME != 0 {
+		syn.SetContent(config.contentID())
+	}
+	if options&packet.OPTION_KEY_EXCHANGE == 0 {
+		return syn, nil, nil
+	}
+
+	identity := config.Identity
+	if identity == nil {
+		if _, identity, err = ed25519.GenerateKey(rand.Reader); err != nil {
+			return nil, nil, err
+		}
+	}
+	ephemeral, err := syn.Exchange(identity, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return syn, ephemeral, nil
+}
+
+// Checks that a receiver asked for the key exchange took part, signed its
+// half and is someone VerifyPeer trusts
+func (config Config) verifyReceiver(address string, syn, synAck packet.Handshake) error {
+	if syn.Options()&packet.OPTION_KEY_EXCHANGE == 0 {
+		return nil
+	}
+	if synAck.Options()&packet.OPTION_KEY_EXCHANGE == 0 {
+		return ErrSealUnsupported
+	}
+	if !synAck.VerifyExchange(syn) {
+		return ErrHandshakeForged
+	}
+	if config.VerifyPeer != nil {
+		return config.VerifyPeer(address, synAck.Identity())
+	}
+	return nil
+}
+
+// Seals the session the handshake settled, or nil if it goes in the clear.
+// ephemeral is this side's private half of the key exchange, if there was
+// one.
+func (config Config) sealer(syn, synAck packet.Handshake, initiator bool, ephemeral []byte) (*packet.Sealer, error) {
+	secret := config.Key
+	if synAck.Options()&packet.OPTION_KEY_EXCHANGE != 0 {
+		peer := synAck
+		if !initiator {
+			peer = syn
+		}
+		exchanged, err := packet.SharedSecret(ephemeral, peer)
+		if err != nil {
+			return nil, err
+		}
+		secret = append(exchanged, config.Key...)
+	}
+	if secret == nil {
+		return nil, nil
+	}
+
+	cipher := packet.CipherOf(synAck.Options())
+	if cipher == 0 {
+		return nil, ErrSealUnsupported
+	}
+	return packet.NewSealer(cipher, secret, syn, synAck, initiator)
+}
+
+func (config Config) maxWindow() int {
+	if config.MaxWindow == 0 {
+		return congestion.MAX_WINDOW
+	}
+	return config.MaxWindow
+}
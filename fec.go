@@ -0,0 +1,162 @@
+package faart
+
+import (
+	"github.com/djreed/faart/log"
+	"github.com/djreed/faart/packet"
+	"github.com/djreed/faart/shared"
+)
+
+// Weight of each datagram in the receiver's loss estimate
+const LOSS_GAIN = 1.0 / 64
+
+// Follows each block of data datagrams with parity datagrams, sizing every
+// block for the loss rate the receiver last reported
+type fecEncoder struct {
+	scheme  packet.FECScheme
+	session packet.SessionID
+
+	// The block being filled, and how big it's to be
+	block       []packet.Datagram
+	dataCount   int
+	parityCount int
+}
+
+func newFECEncoder(scheme packet.FECScheme, session packet.SessionID) *fecEncoder {
+	return &fecEncoder{scheme: scheme, session: session}
+}
+
+// Adds a newly sent datagram to the current block, returning the block's
+// parity once it's full
+func (e *fecEncoder) add(datagram packet.Datagram, loss float64) []packet.Datagram {
+	if len(e.block) == 0 {
+		e.dataCount, e.parityCount = packet.FECRedundancy(e.scheme, loss)
+	}
+	e.block = append(e.block, datagram)
+	if len(e.block) < e.dataCount {
+		return nil
+	}
+	return e.flush()
+}
+
+// Returns parity for however much of a block there is
+func (e *fecEncoder) flush() []packet.Datagram {
+	if len(e.block) == 0 {
+		return nil
+	}
+	block := e.block
+	e.block = nil
+
+	// Shards only need to be as big as the biggest datagram, which keeps
+	// the parity within whatever size the path has been found to take
+	longest := 0
+	for _, datagram := range block {
+		if length := len(datagram.Payload()); length > longest {
+			longest = length
+		}
+	}
+	shards := make([][]byte, len(block))
+	for i, datagram := range block {
+		shards[i] = packet.Shard(datagram, packet.SHARD_HEADER_SIZE+longest)
+	}
+	parities, err := packet.EncodeParity(e.scheme, shards, e.parityCount)
+	if err != nil {
+		log.ERR.Printf("[fec] %s\n", err)
+		return nil
+	}
+
+	start := block[0].Headers().Sequence()
+	datagrams := make([]packet.Datagram, len(parities))
+	for i, shard := range parities {
+		datagrams[i] = packet.Datagram(packet.CreateParity(e.session, start, e.scheme, len(block), i, len(parities), shard))
+	}
+	return datagrams
+}
+
+// Holds on to recent datagrams and any parity for blocks with holes in
+// them, rebuilding the missing datagrams once enough has arrived
+type fecDecoder struct {
+	// Datagrams received lately, in or out of order; a block's holes are
+	// never further back than FEC_MAX_BLOCK below the cumulative point
+	recent shared.DataMap
+	// Everything below floor has been forgotten
+	floor packet.SeqID
+	// Parity for each block with holes, by first sequence and parity index
+	parities map[packet.SeqID]map[int]packet.Parity
+
+	recovered uint64
+}
+
+func newFECDecoder() *fecDecoder {
+	return &fecDecoder{
+		recent:   make(shared.DataMap),
+		parities: make(map[packet.SeqID]map[int]packet.Parity),
+	}
+}
+
+func (d *fecDecoder) remember(datagram packet.Datagram) {
+	d.recent[datagram.Headers().Sequence()] = datagram
+}
+
+// Lets go of everything too far below cumulative to be part of a block
+// with a hole in it
+func (d *fecDecoder) forget(cumulative packet.SeqID) {
+	for ; d.floor+packet.FEC_MAX_BLOCK < cumulative; d.floor++ {
+		delete(d.recent, d.floor)
+	}
+	for start, parities := range d.parities {
+		for _, parity := range parities {
+			if start+packet.SeqID(parity.DataCount()) <= cumulative {
+				delete(d.parities, start)
+			}
+			break
+		}
+	}
+}
+
+// Takes in a parity datagram, returning whatever datagrams of its block it
+// lets the receiver rebuild
+func (d *fecDecoder) acceptParity(session packet.SessionID, parity packet.Parity) []packet.Datagram {
+	start := parity.Block()
+	if d.parities[start] == nil {
+		d.parities[start] = make(map[int]packet.Parity)
+	}
+	d.parities[start][parity.Index()] = parity
+
+	shards := make([][]byte, parity.DataCount())
+	missing := 0
+	for i := range shards {
+		if datagram, ok := d.recent[start+packet.SeqID(i)]; ok {
+			shards[i] = packet.Shard(datagram, len(parity.Shard()))
+		} else {
+			missing++
+		}
+	}
+	if missing == 0 {
+		delete(d.parities, start)
+		return nil
+	}
+
+	parityShards := make(map[int][]byte)
+	for index, p := range d.parities[start] {
+		if p.Scheme() == parity.Scheme() && p.DataCount() == parity.DataCount() && len(p.Shard()) == len(parity.Shard()) {
+			parityShards[index] = p.Shard()
+		}
+	}
+	if complete, err := packet.ReconstructShards(parity.Scheme(), shards, parityShards); err != nil || !complete {
+		return nil
+	}
+	delete(d.parities, start)
+
+	var rebuilt []packet.Datagram
+	for i, shard := range shards {
+		seq := start + packet.SeqID(i)
+		if _, ok := d.recent[seq]; ok {
+			continue
+		}
+		if datagram, ok := packet.Unshard(session, seq, shard); ok {
+			rebuilt = append(rebuilt, datagram)
+		}
+	}
+	d.recovered += uint64(len(rebuilt))
+	return rebuilt
+}
@@ -0,0 +1,61 @@
+package faart
+
+import (
+	"testing"
+
+	"github.com/djreed/faart/packet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransferRebuildsFromParity(t *testing.T) {
+	for _, scheme := range []packet.FECScheme{packet.FEC_XOR, packet.FEC_REED_SOLOMON} {
+		tr, result := newTestTransfer(0, 0)
+		tr.fec = newFECDecoder()
+		datagrams, stream := syntheticDatagrams(0, 0, 6)
+
+		encoder := newFECEncoder(scheme, testSession)
+		var parities []packet.Datagram
+		for _, datagram := range datagrams {
+			parities = append(parities, encoder.add(datagram, 0)...)
+		}
+		parities = append(parities, encoder.flush()...)
+		require.NotEmpty(t, parities)
+
+		// The third datagram never arrives
+		for i, datagram := range datagrams {
+			if i != 2 {
+				tr.acceptDatagram(datagram)
+			}
+		}
+		assert.Equal(t, packet.SeqID(2), tr.cumulative)
+
+		rebuilt := tr.acceptParity(packet.Parity(parities[0]))
+		require.Len(t, rebuilt, 1)
+		assert.Equal(t, datagrams[2], rebuilt[0])
+		tr.acceptDatagram(rebuilt[0])
+		assert.Equal(t, packet.SeqID(6), tr.cumulative)
+
+		tr.compressed.finish()
+		assert.Equal(t, stream, <-result, scheme.String())
+	}
+}
+
+func TestRecvLossEstimate(t *testing.T) {
+	tr, _ := newTestTransfer(0, 0)
+	datagrams, _ := syntheticDatagrams(0, 0, 400)
+
+	// Every fifth datagram goes missing
+	for i, datagram := range datagrams {
+		if i%5 != 4 {
+			tr.acceptDatagram(datagram)
+		}
+	}
+	assert.InDelta(t, 0.2, tr.loss, 0.05)
+	assert.InDelta(t, 0.2, tr.ack(datagrams[0]).Loss(), 0.05)
+
+	// Retransmissions fill the holes without moving the estimate
+	loss := tr.loss
+	tr.acceptDatagram(datagrams[4])
+	assert.Equal(t, loss, tr.loss)
+}
@@ -0,0 +1,71 @@
+package faart
+
+import (
+	"github.com/djreed/faart/log"
+	"github.com/djreed/faart/packet"
+)
+
+// Datagrams a receiver holds pieces of at once. The sender only splits
+// datagrams cut before the path narrowed, so there are seldom more than a
+// window's worth, and the oldest is given up on to make room.
+const FRAGMENT_GROUPS = 64
+
+// Puts back together the datagrams a sender split into fragments. Only
+// the goroutine delivering a session's packets touches it.
+type reassembly struct {
+	groups map[uint64]*fragmentGroup
+	// Groups in the order their first piece arrived
+	order []uint64
+}
+
+type fragmentGroup struct {
+	pieces  [][]byte
+	missing int
+}
+
+func newReassembly() *reassembly {
+	return &reassembly{groups: make(map[uint64]*fragmentGroup)}
+}
+
+// Passes raw through unless it's a fragment, in which case it's held until
+// the rest of its datagram arrives and the whole datagram is returned; false
+// until then
+func (r *reassembly) add(raw packet.Datagram) (packet.Datagram, bool) {
+	fragment := packet.Fragment(raw)
+	if fragment.Prefix().Kind() != packet.KIND_FRAGMENT {
+		return raw, true
+	}
+
+	group, ok := r.groups[fragment.Group()]
+	if !ok {
+		if len(r.order) >= FRAGMENT_GROUPS {
+			log.ERR.Printf("[fragments dropped] %x group %d\n", fragment.Prefix().Session(), r.order[0])
+			delete(r.groups, r.order[0])
+			r.order = r.order[1:]
+		}
+		group = &fragmentGroup{pieces: make([][]byte, fragment.Count()), missing: fragment.Count()}
+		r.groups[fragment.Group()] = group
+		r.order = append(r.order, fragment.Group())
+	}
+	if len(group.pieces) != fragment.Count() || group.pieces[fragment.Index()] != nil {
+		return nil, false
+	}
+	group.pieces[fragment.Index()] = append([]byte(nil), fragment.Piece()...)
+	group.missing--
+	if group.missing > 0 {
+		return nil, false
+	}
+
+	delete(r.groups, fragment.Group())
+	for i, id := range r.order {
+		if id == fragment.Group() {
+			r.order = append(r.order[:i], r.order[i+1:]...)
+			break
+		}
+	}
+	var whole packet.Datagram
+	for _, piece := range group.pieces {
+		whole = append(whole, piece...)
+	}
+	return whole, true
+}
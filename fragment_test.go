@@ -0,0 +1,41 @@
+package faart
+
+import (
+	"testing"
+
+	"github.com/djreed/faart/packet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReassembly(t *testing.T) {
+	datagrams, _ := syntheticDatagrams(0, 0, 2)
+	r := newReassembly()
+
+	// Anything else goes straight through
+	whole, ok := r.add(datagrams[0])
+	assert.True(t, ok)
+	assert.Equal(t, datagrams[0], whole)
+
+	// Pieces out of order, with one of them twice
+	fragments := packet.SplitDatagram(testSession, 1, datagrams[1], 400)
+	assert.True(t, len(fragments) > 2)
+	for i := len(fragments) - 1; i > 0; i-- {
+		_, ok = r.add(packet.Datagram(fragments[i]))
+		assert.False(t, ok)
+	}
+	_, ok = r.add(packet.Datagram(fragments[1]))
+	assert.False(t, ok)
+	whole, ok = r.add(packet.Datagram(fragments[0]))
+	assert.True(t, ok)
+	assert.Equal(t, datagrams[1], whole)
+	assert.Empty(t, r.groups)
+
+	// Pieces of datagrams that never complete are given up on, oldest first
+	for group := uint64(2); group < 2+FRAGMENT_GROUPS+1; group++ {
+		fragments = packet.SplitDatagram(testSession, group, datagrams[1], 400)
+		r.add(packet.Datagram(fragments[0]))
+	}
+	assert.Len(t, r.groups, FRAGMENT_GROUPS)
+	assert.NotContains(t, r.groups, uint64(2))
+	assert.Contains(t, r.groups, uint64(3))
+}
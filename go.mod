@@ -2,4 +2,7 @@ module github.com/djreed/faart
 
 go 1.12
 
-require github.com/stretchr/testify v1.4.0
+require (
+	github.com/stretchr/testify v1.4.0
+	golang.org/x/crypto v0.0.0-20220525230936-793ad666bf5e
+)
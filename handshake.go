@@ -0,0 +1,112 @@
+package faart
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/djreed/faart/log"
+	"github.com/djreed/faart/packet"
+	"github.com/djreed/faart/shared"
+)
+
+// Proposes a new session to the receiver, resending the SYN with backoff
+// until a matching SYN-ACK comes back or ctx is done
+func handshake(ctx context.Context, conn *net.UDPConn, syn packet.Handshake, rtt *shared.RTTEstimator) (packet.Handshake, error) {
+	id := syn.Prefix().Session()
+
+	// Cut short whichever read is in progress once ctx is done
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			conn.SetReadDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+	defer func() {
+		close(stop)
+		<-stopped
+		conn.SetReadDeadline(time.Time{})
+	}()
+
+	timeout := shared.HANDSHAKE_TIMEOUT
+	for attempt := 0; attempt < shared.HANDSHAKE_RETRIES; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		sentAt := time.Now()
+		if _, err := conn.Write(syn); err != nil {
+			return nil, err
+		}
+		log.ERR.Printf("[send syn] session %x\n", id)
+
+		deadline := sentAt.Add(timeout)
+		ctxDeadline, bounded := ctx.Deadline()
+		bounded = bounded && ctxDeadline.Before(deadline)
+		if bounded {
+			deadline = ctxDeadline
+		}
+		synAck, err := awaitSynAck(conn, id, deadline)
+		if err != nil {
+			return nil, err
+		}
+		if synAck == nil && bounded {
+			return nil, context.DeadlineExceeded
+		}
+		if synAck != nil {
+			// Karn's rule: only an unambiguous exchange gives an RTT sample
+			if attempt == 0 {
+				rtt.Sample(time.Since(sentAt))
+			}
+			if packetSize(synAck) <= 0 {
+				return nil, ErrDatagramSize
+			}
+			log.ERR.Printf("[session] %x established, datagram size %d, options %x\n", id, synAck.DatagramSize(), synAck.Options())
+			return synAck, nil
+		}
+
+		timeout *= 2
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return nil, ErrHandshakeTimeout
+}
+
+// Room left for data in the largest of the settled session's datagrams
+func packetSize(synAck packet.Handshake) int {
+	return payloadSize(synAck.DatagramSize(), synAck.Options())
+}
+
+// The datagram size the settled session starts out at, before path MTU
+// discovery finds out whether bigger ones get through
+func baseDatagramSize(synAck packet.Handshake) int {
+	if synAck.DatagramSize() < packet.BASE_DATAGRAM_SIZE {
+		return synAck.DatagramSize()
+	}
+	return packet.BASE_DATAGRAM_SIZE
+}
+
+// Reads until the SYN-ACK for session arrives, or returns nil at the deadline
+func awaitSynAck(conn *net.UDPConn, session packet.SessionID, deadline time.Time) (packet.Handshake, error) {
+	conn.SetReadDeadline(deadline)
+	for {
+		buffer := make(packet.Handshake, packet.MAX_HANDSHAKE_SIZE)
+		read, err := conn.Read(buffer)
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		synAck := packet.Handshake(buffer[:read])
+		prefix := synAck.Prefix()
+		if prefix.WellFormed() && prefix.Kind() == packet.KIND_SYN_ACK && prefix.Session() == session {
+			return synAck, nil
+		}
+	}
+}
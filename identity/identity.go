@@ -0,0 +1,249 @@
+// Package identity keeps the long-term ed25519 keys faart peers prove who
+// they are with: key files, a sender's known hosts and a receiver's
+// authorized keys.
+package identity
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+const (
+	// Leads every public key line, as in a .pub file or authorized keys
+	KEY_TYPE = "faart-ed25519"
+	// PEM block a private key file holds, with the key's seed inside
+	PRIVATE_KEY_TYPE = "FAART ED25519 PRIVATE KEY"
+	// Suffix of the public half's file next to a private key
+	PUBLIC_SUFFIX = ".pub"
+
+	// Directory under the home directory keys and known hosts live in
+	// unless told otherwise, and their names there
+	DEFAULT_DIR         = ".faart"
+	DEFAULT_IDENTITY    = "id_ed25519"
+	DEFAULT_KNOWN_HOSTS = "known_hosts"
+)
+
+var (
+	// A host presented a different key than the one pinned for it
+	ErrHostKeyChanged = errors.New("host key differs from the one in known hosts; if it was replaced on purpose, remove the old line")
+	// A sender's key isn't among the authorized keys
+	ErrUnauthorized = errors.New("key is not authorized")
+	// A private key file holds something else
+	ErrPrivateKey = errors.New("not a faart private key")
+)
+
+// Makes a new identity
+func Generate() (ed25519.PrivateKey, error) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	return private, err
+}
+
+// Writes private to path, readable only by its owner, and its public half
+// to path.pub. Neither may already exist.
+func WriteKeyPair(path string, private ed25519.PrivateKey, comment string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	block := pem.EncodeToMemory(&pem.Block{Type: PRIVATE_KEY_TYPE, Bytes: private.Seed()})
+	if err := writeNew(path, block, 0600); err != nil {
+		return err
+	}
+	public := FormatPublicKey(private.Public().(ed25519.PublicKey), comment) + "\n"
+	return writeNew(path+PUBLIC_SUFFIX, []byte(public), 0644)
+}
+
+func writeNew(path string, contents []byte, mode os.FileMode) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(contents); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func LoadPrivateKey(path string) (ed25519.PrivateKey, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(contents)
+	if block == nil || block.Type != PRIVATE_KEY_TYPE || len(block.Bytes) != ed25519.SeedSize {
+		return nil, ErrPrivateKey
+	}
+	return ed25519.NewKeyFromSeed(block.Bytes), nil
+}
+
+// A public key as a single line: the key type, the key in base64 and an
+// optional comment
+func FormatPublicKey(public ed25519.PublicKey, comment string) string {
+	line := KEY_TYPE + " " + base64.StdEncoding.EncodeToString(public)
+	if comment != "" {
+		line += " " + comment
+	}
+	return line
+}
+
+// Reads a line FormatPublicKey wrote, returning the key and its comment
+func ParsePublicKey(line string) (ed25519.PublicKey, string, error) {
+	fields := strings.SplitN(strings.TrimSpace(line), " ", 3)
+	if len(fields) < 2 || fields[0] != KEY_TYPE {
+		return nil, "", fmt.Errorf("not a %s key: %q", KEY_TYPE, line)
+	}
+	key, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, "", fmt.Errorf("malformed %s key: %q", KEY_TYPE, line)
+	}
+
+	comment := ""
+	if len(fields) == 3 {
+		comment = fields[2]
+	}
+	return ed25519.PublicKey(key), comment, nil
+}
+
+// Short form of a key for logs and prompts
+func Fingerprint(public ed25519.PublicKey) string {
+	sum := sha256.Sum256(public)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// Calls line for every line of path that isn't blank or a # comment; a
+// missing file has no lines
+func eachLine(path string, line func(number int, text string) error) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for number := 1; scanner.Scan(); number++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		if err := line(number, text); err != nil {
+			return fmt.Errorf("%s:%d: %s", path, number, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// Receivers a sender has talked to before, each pinned to the key it
+// presented the first time (trust on first use). One line per host: the
+// address as it was dialled, then the key as FormatPublicKey writes it.
+type KnownHosts struct {
+	path string
+	lock sync.Mutex
+}
+
+func NewKnownHosts(path string) *KnownHosts {
+	return &KnownHosts{path: path}
+}
+
+// Accepts key for host if it's the one pinned, or pins it if host is new;
+// fails with ErrHostKeyChanged if host is pinned to a different key
+func (k *KnownHosts) Verify(host string, key ed25519.PublicKey) error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	var pinned ed25519.PublicKey
+	err := eachLine(k.path, func(_ int, text string) error {
+		fields := strings.SplitN(text, " ", 2)
+		if len(fields) < 2 || fields[0] != host {
+			return nil
+		}
+		public, _, err := ParsePublicKey(fields[1])
+		if err != nil {
+			return err
+		}
+		pinned = public
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if pinned != nil {
+		if !bytes.Equal(pinned, key) {
+			return ErrHostKeyChanged
+		}
+		return nil
+	}
+	return k.pin(host, key)
+}
+
+func (k *KnownHosts) pin(host string, key ed25519.PublicKey) error {
+	if err := os.MkdirAll(filepath.Dir(k.path), 0700); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(k.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(file, "%s %s\n", host, FormatPublicKey(key, "")); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Senders a receiver will take transfers from, one public key per line
+type AuthorizedKeys struct {
+	keys map[string]bool
+}
+
+func LoadAuthorizedKeys(path string) (*AuthorizedKeys, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+
+	authorized := &AuthorizedKeys{keys: make(map[string]bool)}
+	err := eachLine(path, func(_ int, text string) error {
+		key, _, err := ParsePublicKey(text)
+		if err != nil {
+			return err
+		}
+		authorized.keys[string(key)] = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return authorized, nil
+}
+
+// Accepts key if it's listed, wherever it's coming from
+func (a *AuthorizedKeys) Verify(_ string, key ed25519.PublicKey) error {
+	if !a.keys[string(key)] {
+		return ErrUnauthorized
+	}
+	return nil
+}
+
+// Where a file of the given name lives by default: ~/.faart/name
+func DefaultPath(name string) (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, DEFAULT_DIR, name), nil
+}
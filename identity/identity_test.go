@@ -0,0 +1,92 @@
+package identity
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ed25519"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "faart-identity")
+	require.NoError(t, err)
+	return dir
+}
+
+func TestKeyPairRoundTrip(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	private, err := Generate()
+	require.NoError(t, err)
+	path := filepath.Join(dir, "keys", DEFAULT_IDENTITY)
+	require.NoError(t, WriteKeyPair(path, private, "me@here"))
+
+	loaded, err := LoadPrivateKey(path)
+	require.NoError(t, err)
+	assert.Equal(t, private, loaded)
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	line, err := ioutil.ReadFile(path + PUBLIC_SUFFIX)
+	require.NoError(t, err)
+	public, comment, err := ParsePublicKey(string(line))
+	require.NoError(t, err)
+	assert.Equal(t, private.Public(), public)
+	assert.Equal(t, "me@here", comment)
+
+	// Never overwrites an identity
+	assert.Error(t, WriteKeyPair(path, private, ""))
+	_, err = LoadPrivateKey(path + PUBLIC_SUFFIX)
+	assert.Equal(t, ErrPrivateKey, err)
+}
+
+func TestParsePublicKeyRejects(t *testing.T) {
+	for _, line := range []string{"", "ssh-ed25519 AAAA", KEY_TYPE + " not-base64!", KEY_TYPE + " AAAA"} {
+		_, _, err := ParsePublicKey(line)
+		assert.Error(t, err, line)
+	}
+}
+
+func TestKnownHostsTrustOnFirstUse(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	first, _, _ := ed25519.GenerateKey(nil)
+	second, _, _ := ed25519.GenerateKey(nil)
+	known := NewKnownHosts(filepath.Join(dir, DEFAULT_KNOWN_HOSTS))
+
+	assert.NoError(t, known.Verify("recv.example:3700", first))
+	assert.NoError(t, known.Verify("recv.example:3700", first))
+	assert.Equal(t, ErrHostKeyChanged, known.Verify("recv.example:3700", second))
+
+	// Pins are per host, and survive a fresh KnownHosts
+	assert.NoError(t, known.Verify("other.example:3700", second))
+	reloaded := NewKnownHosts(filepath.Join(dir, DEFAULT_KNOWN_HOSTS))
+	assert.Equal(t, ErrHostKeyChanged, reloaded.Verify("other.example:3700", first))
+}
+
+func TestAuthorizedKeys(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	allowed, _, _ := ed25519.GenerateKey(nil)
+	stranger, _, _ := ed25519.GenerateKey(nil)
+	path := filepath.Join(dir, "authorized_keys")
+	contents := "# deploy hosts\n\n" + FormatPublicKey(allowed, "builder") + "\n"
+	require.NoError(t, ioutil.WriteFile(path, []byte(contents), 0600))
+
+	authorized, err := LoadAuthorizedKeys(path)
+	require.NoError(t, err)
+	assert.NoError(t, authorized.Verify("10.0.0.1:5000", allowed))
+	assert.Equal(t, ErrUnauthorized, authorized.Verify("10.0.0.1:5000", stranger))
+
+	_, err = LoadAuthorizedKeys(filepath.Join(dir, "missing"))
+	assert.Error(t, err)
+}
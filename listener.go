@@ -0,0 +1,375 @@
+package faart
+
+import (
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/djreed/faart/congestion"
+	"github.com/djreed/faart/log"
+	"github.com/djreed/faart/packet"
+	"github.com/djreed/faart/shared"
+)
+
+// SYNs that may be waiting on Accept before new sessions are turned away
+const ACCEPT_BACKLOG = 16
+
+// Why a SYN was turned away, for the log
+var (
+	errNoKeyExchange = errors.New("no key exchange")
+	errSynForged     = errors.New("signature does not check out")
+)
+
+// A session the listener routes packets to
+type session interface {
+	// Takes a packet for the session without blocking the listener
+	deliver(packet.AddressedDatagram)
+	// Tears the session down, failing it with err
+	abort(err error)
+}
+
+// Receives any number of concurrent transfers and streams on a single UDP
+// socket, demultiplexing datagrams by session
+type Listener struct {
+	conn   *net.UDPConn
+	config Config
+
+	dataChan shared.AddressedDataChannel
+	ackChan  shared.AddressedAckChannel
+
+	// Sessions in progress; only the dispatch loop touches this, and each
+	// session's own state is owned by its own goroutines
+	sessions map[packet.SessionID]session
+	// The SYN-ACK each session was settled with, for answering repeats of
+	// its SYN; a sealed session's keys depend on its nonce
+	synAcks map[packet.SessionID]packet.Handshake
+	// The session writing each checkpoint, so no two write the same one
+	resuming map[packet.ContentID]packet.SessionID
+	accepted chan *Transfer
+	streams  chan *Stream
+	finished chan packet.SessionID
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Listens for transfers on address with the default Config
+func Listen(address string) (*Listener, error) {
+	return ListenConfig(address, Config{})
+}
+
+// Listens for transfers on address, such as ":3700" or ":0" for any port
+func ListenConfig(address string, config Config) (*Listener, error) {
+	// Streams send too, so the sending options have to make sense
+	if _, err := congestion.New(config.congestion(), config.maxWindow()); err != nil {
+		return nil, err
+	}
+	if err := config.checkSealing(); err != nil {
+		return nil, err
+	}
+	if err := config.checkDatagramSize(); err != nil {
+		return nil, err
+	}
+	if err := config.checkReceiveBuffer(); err != nil {
+		return nil, err
+	}
+
+	localAddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenUDP("udp4", localAddr)
+	if err != nil {
+		return nil, err
+	}
+	dontFragment(conn)
+
+	l := &Listener{
+		conn:     conn,
+		config:   config,
+		dataChan: shared.NewAddressedDataChan(),
+		ackChan:  shared.NewAddressedAckChan(),
+		sessions: make(map[packet.SessionID]session),
+		synAcks:  make(map[packet.SessionID]packet.Handshake),
+		resuming: make(map[packet.ContentID]packet.SessionID),
+		accepted: make(chan *Transfer, ACCEPT_BACKLOG),
+		streams:  make(chan *Stream, ACCEPT_BACKLOG),
+		finished: make(chan packet.SessionID),
+		closed:   make(chan struct{}),
+	}
+
+	go l.receiveDatagrams()
+	go l.sendAcks()
+	go l.serve()
+	return l, nil
+}
+
+// Waits for the next sender to establish a session
+func (l *Listener) Accept() (*Transfer, error) {
+	select {
+	case t := <-l.accepted:
+		return t, nil
+	case <-l.closed:
+		return nil, ErrClosed
+	}
+}
+
+// Waits for the next peer to establish a stream
+func (l *Listener) AcceptStream() (*Stream, error) {
+	select {
+	case s := <-l.streams:
+		return s, nil
+	case <-l.closed:
+		return nil, ErrClosed
+	}
+}
+
+// Stops listening; transfers and streams still in progress fail with
+// ErrClosed
+func (l *Listener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		l.conn.Close()
+	})
+	return nil
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// Dispatches datagrams to their transfers until the listener is closed
+func (l *Listener) serve() {
+	for {
+		select {
+		case addressedDatagram := <-l.dataChan:
+			l.dispatch(addressedDatagram)
+
+		case id := <-l.finished:
+			delete(l.sessions, id)
+			delete(l.synAcks, id)
+			for content, session := range l.resuming {
+				if session == id {
+					delete(l.resuming, content)
+				}
+			}
+
+		case <-l.closed:
+			for _, s := range l.sessions {
+				s.abort(ErrClosed)
+			}
+			return
+		}
+	}
+}
+
+// Tells the dispatch loop a session is over
+func (l *Listener) forget(id packet.SessionID) {
+	select {
+	case l.finished <- id:
+	case <-l.closed:
+	}
+}
+
+// Hands a datagram to the session it belongs to, or starts a new session
+// for a SYN
+func (l *Listener) dispatch(addressedDatagram packet.AddressedDatagram) {
+	prefix := packet.Prefix(addressedDatagram.Datagram)
+	if !prefix.WellFormed() {
+		log.ERR.Printf("[recv malformed packet]\n")
+		return
+	}
+
+	switch prefix.Kind() {
+	case packet.KIND_SYN:
+		l.acceptSyn(addressedDatagram.Addr, packet.Handshake(addressedDatagram.Datagram))
+
+	case packet.KIND_DATA, packet.KIND_ACK, packet.KIND_PARITY, packet.KIND_CLOSE, packet.KIND_PROBE, packet.KIND_PROBE_ACK, packet.KIND_FRAGMENT:
+		s, ok := l.sessions[prefix.Session()]
+		if !ok {
+			log.ERR.Printf("[recv unknown session] %x\n", prefix.Session())
+			return
+		}
+		s.deliver(addressedDatagram)
+	}
+}
+
+// Agrees to a new session while there's room for it, and answers repeats of
+// a SYN in case the SYN-ACK was lost
+func (l *Listener) acceptSyn(addr *net.UDPAddr, syn packet.Handshake) {
+	id := syn.Prefix().Session()
+	if synAck, ok := l.synAcks[id]; ok {
+		shared.SendHandshake(l.conn, addr, synAck)
+		return
+	}
+
+	supported := packet.SUPPORTED_OPTIONS &^ (packet.OPTION_CIPHERS | packet.OPTION_KEY_EXCHANGE | packet.OPTION_RESUME)
+	if syn.Options()&packet.OPTION_STREAM != 0 {
+		// Only transfers carry parity
+		supported &^= packet.OPTION_FEC
+	} else if _, inUse := l.resuming[syn.Content()]; l.config.Checkpoints != "" && !inUse {
+		// or are resumed; a second sender of the same content while the
+		// first is still going just starts from scratch
+		supported |= packet.OPTION_RESUME
+	}
+	if l.config.requiresSealing() {
+		// With a key or identity, nothing goes in the clear
+		cipher := packet.CipherOf(syn.Options())
+		if cipher == 0 {
+			log.ERR.Printf("[recv syn] %x rejected, not sealed\n", id)
+			return
+		}
+		supported |= cipher.Option()
+	}
+	if l.config.Identity != nil {
+		if err := l.verifySender(addr, syn); err != nil {
+			log.ERR.Printf("[recv syn] %x rejected: %s\n", id, err)
+			return
+		}
+		supported |= packet.OPTION_KEY_EXCHANGE
+	}
+	synAck := packet.CreateSynAck(syn, l.config.datagramSize(), supported)
+	isStream := synAck.Options()&packet.OPTION_STREAM != 0
+
+	if l.config.MaxTransfers > 0 && len(l.sessions) >= l.config.MaxTransfers {
+		log.ERR.Printf("[recv syn] %x rejected, %d sessions in progress\n", id, len(l.sessions))
+		return
+	}
+	if (isStream && len(l.streams) >= ACCEPT_BACKLOG) || (!isStream && len(l.accepted) >= ACCEPT_BACKLOG) {
+		log.ERR.Printf("[recv syn] %x rejected, %d sessions waiting to be accepted\n", id, ACCEPT_BACKLOG)
+		return
+	}
+
+	var checkpoint *checkpoint
+	if synAck.Options()&packet.OPTION_RESUME != 0 {
+		var err error
+		if checkpoint, err = openCheckpoint(l.config.Checkpoints, syn.Content()); err != nil {
+			log.ERR.Printf("[recv syn] %x rejected: %s\n", id, err)
+			return
+		}
+		synAck = synAck.WithMissing(checkpoint.missing())
+	}
+	if err := synAck.RandomizeNonce(); err != nil {
+		log.ERR.Printf("[recv syn] %x rejected: %s\n", id, err)
+		checkpoint.close()
+		return
+	}
+	var ephemeral []byte
+	if synAck.Options()&packet.OPTION_KEY_EXCHANGE != 0 {
+		var err error
+		if ephemeral, err = synAck.Exchange(l.config.Identity, syn); err != nil {
+			log.ERR.Printf("[recv syn] %x rejected: %s\n", id, err)
+			checkpoint.close()
+			return
+		}
+	}
+	sealer, err := l.config.sealer(syn, synAck, false, ephemeral)
+	if err != nil {
+		log.ERR.Printf("[recv syn] %x rejected: %s\n", id, err)
+		checkpoint.close()
+		return
+	}
+
+	if isStream {
+		s, err := l.newStream(id, addr, synAck, sealer)
+		if err != nil {
+			log.ERR.Printf("[recv syn] %x rejected: %s\n", id, err)
+			return
+		}
+		l.sessions[id] = s
+		l.streams <- s
+	} else {
+		// The window is counted in datagrams of the size the session starts
+		// at, until path MTU discovery finds bigger ones get through
+		packetSize := payloadSize(baseDatagramSize(synAck), synAck.Options())
+		var t *Transfer
+		if checkpoint != nil {
+			t = newCheckpointedTransfer(id, addr, checkpoint, packetSize)
+			l.resuming[syn.Content()] = id
+		} else {
+			t = newTransfer(id, addr, l.config.receiveBuffer(TRANSFER_BUFFER), packetSize)
+		}
+		if synAck.Options()&packet.OPTION_FEC != 0 {
+			t.fec = newFECDecoder()
+		}
+		t.sealer = sealer
+		t.sealed = sealer != nil
+		t.codecs = synAck.Codecs()
+		l.sessions[id] = t
+		l.accepted <- t
+		t.serveFrom(l)
+		go t.run(l.config.IdleTimeout)
+	}
+	l.synAcks[id] = synAck
+	log.ERR.Printf("[session] %x established with %s, datagram size %d, options %x\n", id, addr, synAck.DatagramSize(), synAck.Options())
+	shared.SendHandshake(l.conn, addr, synAck)
+}
+
+// Checks that a sender did its half of the key exchange, signed it and is
+// someone VerifyPeer trusts
+func (l *Listener) verifySender(addr *net.UDPAddr, syn packet.Handshake) error {
+	if syn.Options()&packet.OPTION_KEY_EXCHANGE == 0 {
+		return errNoKeyExchange
+	}
+	if !syn.VerifyExchange(nil) {
+		return errSynForged
+	}
+	if l.config.VerifyPeer != nil {
+		return l.config.VerifyPeer(addr.String(), syn.Identity())
+	}
+	return nil
+}
+
+// The listener's end of a stream to addr, sharing the listener's socket
+func (l *Listener) newStream(id packet.SessionID, addr *net.UDPAddr, synAck packet.Handshake, sealer *packet.Sealer) (*Stream, error) {
+	out, err := newSendHalf(l.config, shared.WallClock)
+	if err != nil {
+		return nil, err
+	}
+
+	write := func(raw []byte) error {
+		_, err := l.conn.WriteToUDP(raw, addr)
+		return err
+	}
+	release := func() {
+		l.forget(id)
+	}
+	return newStream(synAck, l.config.receiveBuffer(STREAM_BUFFER), out, sealer, l.conn.LocalAddr(), addr, write, release), nil
+}
+
+func (l *Listener) receiveDatagrams() {
+	// Read into one buffer with room for the largest datagram any session
+	// can settle on, and copied out at the size each turns out to be
+	buffer := packet.NewDatagram(readBufferSize(l.config.datagramSize()))
+	for {
+		read, retAddr, err := l.conn.ReadFromUDP(buffer)
+		if read > 0 && err == nil {
+			datagram := append(packet.Datagram(nil), buffer[:read]...)
+			addressedDatagram := packet.AddressedDatagram{Addr: retAddr, Datagram: datagram}
+			select {
+			case l.dataChan <- addressedDatagram:
+			case <-l.closed:
+				return
+			}
+		} else if err != nil {
+			select {
+			case <-l.closed:
+				return
+			default:
+			}
+		}
+	}
+}
+
+func (l *Listener) sendAcks() {
+	for {
+		select {
+		case ack := <-l.ackChan:
+			shared.SendAck(l.conn, ack.Addr, ack.Ack)
+			continue
+		case <-l.closed:
+			return
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package netem
+
+import (
+	"container/heap"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// RNG streams, one per impairment, so that turning one up or down never
+// changes what the others do
+const (
+	LOSS_STREAM = iota
+	JITTER_STREAM
+	REORDER_STREAM
+	DUPLICATE_STREAM
+	CORRUPT_STREAM
+	STREAMS
+)
+
+// One copy of a datagram coming out the far end of a link
+type Delivery struct {
+	At   time.Time
+	Data []byte
+}
+
+// What one direction of a link does to each datagram, leaving the queueing
+// and the clock to its owner: the same seed and arrivals always give the
+// same deliveries
+type Model struct {
+	config Config
+	rngs   [STREAMS]*rand.Rand
+
+	// When the link finishes putting the last accepted datagram on the wire
+	free  time.Time
+	stats Stats
+
+	// When the first datagram arrived, which ShrinkAfter counts from
+	started time.Time
+}
+
+// A model whose RNGs are seeded from config.Seed and direction, so that each
+// direction gets its own reproducible impairments
+func NewModel(config Config, direction int64) *Model {
+	m := &Model{config: config}
+	for stream := range m.rngs {
+		m.rngs[stream] = rand.New(rand.NewSource(config.Seed*1000003 + direction*STREAMS + int64(stream)))
+	}
+	return m
+}
+
+// Works out what happens to a datagram arriving at now: when each copy of
+// it (if any) comes out the far end, and what it looks like by then. Every
+// RNG is drawn from once per datagram whatever happens, keeping each
+// impairment's sequence independent of the others.
+func (m *Model) Plan(data []byte, now time.Time) []Delivery {
+	lost := m.rngs[LOSS_STREAM].Float64() < m.config.Loss
+	jitter := m.rngs[JITTER_STREAM].Float64()
+	reordered := m.rngs[REORDER_STREAM].Float64() < m.config.Reorder
+	duplicated := m.rngs[DUPLICATE_STREAM].Float64() < m.config.Duplicate
+	corrupted := m.rngs[CORRUPT_STREAM].Float64() < m.config.Corrupt
+	corruptAt := m.rngs[CORRUPT_STREAM].Intn(1 << 16)
+	corruptBy := byte(1 + m.rngs[CORRUPT_STREAM].Intn(255))
+
+	if lost {
+		m.stats.Dropped++
+		return nil
+	}
+	if m.started.IsZero() {
+		m.started = now
+	}
+	if mtu := m.mtu(now); mtu > 0 && len(data) > mtu {
+		m.stats.Oversized++
+		return nil
+	}
+
+	copies := 1
+	if duplicated {
+		copies = 2
+		m.stats.Duplicated++
+	}
+	if corrupted && len(data) > 0 {
+		data = append([]byte(nil), data...)
+		data[corruptAt%len(data)] ^= corruptBy
+		m.stats.Corrupted++
+	}
+
+	delay := m.config.Latency
+	if m.config.Jitter > 0 {
+		delay += time.Duration((2*jitter - 1) * float64(m.config.Jitter))
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	if reordered && delay > 0 {
+		delay = 0
+		m.stats.Reordered++
+	}
+
+	var deliveries []Delivery
+	for i := 0; i < copies; i++ {
+		departs := now
+		if m.config.Rate > 0 {
+			if m.free.After(departs) {
+				departs = m.free
+			}
+			departs = departs.Add(time.Duration(float64(len(data)*8) / m.config.Rate * float64(time.Second)))
+			m.free = departs
+		}
+		deliveries = append(deliveries, Delivery{At: departs.Add(delay), Data: data})
+	}
+	return deliveries
+}
+
+// The largest datagram the link carries at now, or 0 for no limit
+func (m *Model) mtu(now time.Time) int {
+	if m.config.ShrunkMTU > 0 && m.config.ShrinkAfter > 0 && now.Sub(m.started) >= m.config.ShrinkAfter {
+		return m.config.ShrunkMTU
+	}
+	return m.config.MTU
+}
+
+// Counts a planned delivery that made it out of the link
+func (m *Model) Forwarded() {
+	m.stats.Forwarded++
+}
+
+// Counts a planned delivery dropped because the queue was full
+func (m *Model) Overflowed() {
+	m.stats.Overflowed++
+}
+
+func (m *Model) Stats() Stats {
+	return m.stats
+}
+
+// A datagram on its way out of a link
+type queued struct {
+	Delivery
+	send func([]byte)
+	// Tiebreak, so datagrams due at once leave in the order they arrived
+	order uint64
+}
+
+// One direction of impaired traffic, delivered in real time
+type link struct {
+	model *Model
+
+	lock    sync.Mutex
+	pending deliveryHeap
+	arrived uint64
+
+	// Signalled whenever a delivery may have become due sooner
+	wake   chan struct{}
+	closed chan struct{}
+}
+
+func newLink(config Config, direction int64) *link {
+	return &link{
+		model:  NewModel(config, direction),
+		wake:   make(chan struct{}, 1),
+		closed: make(chan struct{}),
+	}
+}
+
+// Takes in a datagram, to come out of the link through send
+func (l *link) push(data []byte, send func([]byte)) {
+	l.lock.Lock()
+	for _, d := range l.model.Plan(data, time.Now()) {
+		if len(l.pending) >= QUEUE_LIMIT {
+			l.model.Overflowed()
+			continue
+		}
+		heap.Push(&l.pending, queued{Delivery: d, send: send, order: l.arrived})
+		l.arrived++
+	}
+	l.lock.Unlock()
+
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Sends each datagram once it's due, until the link is closed
+func (l *link) run() {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		l.lock.Lock()
+		var wait time.Duration = time.Hour
+		for len(l.pending) > 0 {
+			next := l.pending[0]
+			if wait = time.Until(next.At); wait > 0 {
+				break
+			}
+			heap.Pop(&l.pending)
+			l.model.Forwarded()
+			l.lock.Unlock()
+			next.send(next.Data)
+			l.lock.Lock()
+		}
+		if len(l.pending) == 0 {
+			wait = time.Hour
+		}
+		l.lock.Unlock()
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+
+		select {
+		case <-timer.C:
+		case <-l.wake:
+		case <-l.closed:
+			return
+		}
+	}
+}
+
+func (l *link) Stats() Stats {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.model.Stats()
+}
+
+// Orders deliveries by when they're due
+type deliveryHeap []queued
+
+func (h deliveryHeap) Len() int { return len(h) }
+func (h deliveryHeap) Less(i, j int) bool {
+	if h[i].At.Equal(h[j].At) {
+		return h[i].order < h[j].order
+	}
+	return h[i].At.Before(h[j].At)
+}
+func (h deliveryHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *deliveryHeap) Push(x interface{}) {
+	*h = append(*h, x.(queued))
+}
+
+func (h *deliveryHeap) Pop() interface{} {
+	old := *h
+	last := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return last
+}
@@ -0,0 +1,91 @@
+// Package netem impairs UDP traffic in userspace: loss, latency, jitter,
+// reordering, duplication, corruption and bandwidth limits, each driven by
+// its own seeded RNG so that a run can be reproduced exactly.
+package netem
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Datagrams a link will hold before it starts dropping new ones
+const QUEUE_LIMIT = 1000
+
+// How each direction of traffic is impaired; the zero value passes
+// everything straight through
+type Config struct {
+	// Chance each datagram is dropped, from 0 to 1
+	Loss float64
+	// Delay added to every datagram, give or take up to Jitter
+	Latency time.Duration
+	Jitter  time.Duration
+	// Chance a datagram skips the latency and overtakes those ahead of it
+	Reorder float64
+	// Chance a datagram is delivered twice
+	Duplicate float64
+	// Chance one byte of a datagram is flipped
+	Corrupt float64
+	// Link speed in bits per second, or 0 for unlimited
+	Rate float64
+	// Largest datagram the link carries, or 0 for no limit; anything longer
+	// is dropped without a word, as a path that blackholes it would
+	MTU int
+	// Once the link has carried traffic for ShrinkAfter, its MTU drops to
+	// ShrunkMTU, as when a route change puts a narrower hop in the way;
+	// never, unless both are set
+	ShrunkMTU   int
+	ShrinkAfter time.Duration
+
+	// Seeds every RNG; the same seed and traffic give the same impairments
+	Seed int64
+}
+
+// What a link has done to the traffic through it
+type Stats struct {
+	Forwarded  uint64
+	Dropped    uint64
+	Duplicated uint64
+	Corrupted  uint64
+	Reordered  uint64
+	// Dropped because QUEUE_LIMIT datagrams were already waiting
+	Overflowed uint64
+	// Dropped for being longer than the MTU
+	Oversized uint64
+}
+
+func (s Stats) String() string {
+	return fmt.Sprintf("%d forwarded, %d dropped, %d duplicated, %d corrupted, %d reordered, %d overflowed, %d oversized",
+		s.Forwarded, s.Dropped, s.Duplicated, s.Corrupted, s.Reordered, s.Overflowed, s.Oversized)
+}
+
+var rateUnits = []struct {
+	suffix string
+	scale  float64
+}{
+	{"gbit", 1e9},
+	{"mbit", 1e6},
+	{"kbit", 1e3},
+	{"bit", 1},
+}
+
+// Parses a link speed the way tc does, such as "100kbit" or "0.1mbit", into
+// bits per second
+func ParseRate(original string) (float64, error) {
+	rate := strings.ToLower(strings.TrimSpace(original))
+	scale := 1.0
+	for _, unit := range rateUnits {
+		if strings.HasSuffix(rate, unit.suffix) {
+			rate = strings.TrimSuffix(rate, unit.suffix)
+			scale = unit.scale
+			break
+		}
+	}
+
+	value, err := strconv.ParseFloat(rate, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid rate %q", original)
+	}
+	return value * scale, nil
+}
@@ -0,0 +1,139 @@
+package netem
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRate(t *testing.T) {
+	for rate, expected := range map[string]float64{
+		"0.1mbit": 1e5,
+		"100kbit": 1e5,
+		"1Gbit":   1e9,
+		"64bit":   64,
+		"8000":    8000,
+	} {
+		bits, err := ParseRate(rate)
+		require.NoError(t, err, rate)
+		assert.InDelta(t, expected, bits, 1e-6, rate)
+	}
+
+	for _, rate := range []string{"", "fast", "-1mbit", "mbit"} {
+		_, err := ParseRate(rate)
+		assert.Error(t, err, rate)
+	}
+}
+
+// What a link does to count datagrams arriving a millisecond apart
+func plans(config Config, count int) [][]Delivery {
+	m := NewModel(config, UPSTREAM)
+	start := time.Unix(0, 0)
+	var all [][]Delivery
+	for i := 0; i < count; i++ {
+		all = append(all, m.Plan([]byte("Hello World"), start.Add(time.Duration(i)*time.Millisecond)))
+	}
+	return all
+}
+
+func TestLinkReproducible(t *testing.T) {
+	config := Config{Loss: 0.2, Latency: 50 * time.Millisecond, Jitter: 10 * time.Millisecond, Reorder: 0.1, Duplicate: 0.1, Corrupt: 0.1, Seed: 42}
+	assert.Equal(t, plans(config, 500), plans(config, 500))
+
+	reseeded := config
+	reseeded.Seed = 43
+	assert.NotEqual(t, plans(config, 500), plans(reseeded, 500))
+}
+
+func TestLinkImpairmentsIndependent(t *testing.T) {
+	// Dropping more shouldn't change which of the surviving datagrams are
+	// corrupted
+	corrupted := func(config Config) map[int]bool {
+		marked := make(map[int]bool)
+		for i, deliveries := range plans(config, 500) {
+			for _, d := range deliveries {
+				if string(d.Data) != "Hello World" {
+					marked[i] = true
+				}
+			}
+		}
+		return marked
+	}
+
+	clean := corrupted(Config{Corrupt: 0.1, Seed: 7})
+	lossy := corrupted(Config{Corrupt: 0.1, Loss: 0.5, Seed: 7})
+	assert.NotEmpty(t, lossy)
+	for i := range lossy {
+		assert.True(t, clean[i], "datagram %d", i)
+	}
+}
+
+func TestLinkRate(t *testing.T) {
+	// 11 bytes at 880 bits/s takes 100ms to put on the wire, so datagrams
+	// arriving together queue behind one another
+	m := NewModel(Config{Rate: 880, Latency: time.Second}, UPSTREAM)
+	start := time.Unix(0, 0)
+	for i := 1; i <= 3; i++ {
+		deliveries := m.Plan([]byte("Hello World"), start)
+		require.Len(t, deliveries, 1)
+		assert.Equal(t, start.Add(time.Second+time.Duration(i)*100*time.Millisecond), deliveries[0].At)
+	}
+}
+
+func TestLinkMTU(t *testing.T) {
+	m := NewModel(Config{MTU: 11}, UPSTREAM)
+	start := time.Unix(0, 0)
+	assert.Len(t, m.Plan([]byte("Hello World"), start), 1)
+	assert.Empty(t, m.Plan([]byte("Hello World!"), start))
+	assert.Equal(t, uint64(1), m.Stats().Oversized)
+}
+
+func TestLinkMTUShrinks(t *testing.T) {
+	m := NewModel(Config{ShrunkMTU: 11, ShrinkAfter: time.Second}, UPSTREAM)
+	start := time.Unix(0, 0)
+	assert.Len(t, m.Plan([]byte("Hello World!"), start), 1)
+	assert.Len(t, m.Plan([]byte("Hello World!"), start.Add(time.Second-1)), 1)
+	assert.Empty(t, m.Plan([]byte("Hello World!"), start.Add(time.Second)))
+	assert.Len(t, m.Plan([]byte("Hello World"), start.Add(time.Minute)), 1)
+	assert.Equal(t, uint64(1), m.Stats().Oversized)
+}
+
+func TestProxyRelays(t *testing.T) {
+	upstream, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer upstream.Close()
+
+	proxy, err := Listen("127.0.0.1:0", upstream.LocalAddr().String(), Config{Latency: 20 * time.Millisecond})
+	require.NoError(t, err)
+	defer proxy.Close()
+
+	client, err := net.DialUDP("udp4", nil, proxy.Addr().(*net.UDPAddr))
+	require.NoError(t, err)
+	defer client.Close()
+
+	sent := time.Now()
+	_, err = client.Write([]byte("ping"))
+	require.NoError(t, err)
+
+	buffer := make([]byte, 16)
+	upstream.SetReadDeadline(time.Now().Add(time.Second))
+	read, from, err := upstream.ReadFromUDP(buffer)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(buffer[:read]))
+	assert.True(t, time.Since(sent) >= 20*time.Millisecond)
+
+	_, err = upstream.WriteToUDP([]byte("pong"), from)
+	require.NoError(t, err)
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	read, err = client.Read(buffer)
+	require.NoError(t, err)
+	assert.Equal(t, "pong", string(buffer[:read]))
+
+	up, down := proxy.Stats()
+	assert.Equal(t, uint64(1), up.Forwarded)
+	assert.Equal(t, uint64(1), down.Forwarded)
+}
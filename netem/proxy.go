@@ -0,0 +1,159 @@
+package netem
+
+import (
+	"net"
+	"sync"
+
+	"github.com/djreed/faart/log"
+)
+
+const (
+	UPSTREAM   = 0
+	DOWNSTREAM = 1
+
+	// Largest datagram the proxy will carry
+	MAX_DATAGRAM = 65535
+)
+
+// Relays UDP datagrams between any number of clients and a single upstream
+// address, impairing them on the way through. Each client gets its own
+// socket to the upstream, so the upstream can tell them apart.
+type Proxy struct {
+	conn     *net.UDPConn
+	upstream *net.UDPAddr
+
+	// One link each way, shared by every client, like a single bottleneck
+	toUpstream   *link
+	toDownstream *link
+
+	lock    sync.Mutex
+	clients map[string]*net.UDPConn
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Listens on address and relays to upstream, impairing both directions
+// according to config
+func Listen(address string, upstream string, config Config) (*Proxy, error) {
+	upstreamAddr, err := net.ResolveUDPAddr("udp", upstream)
+	if err != nil {
+		return nil, err
+	}
+
+	localAddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenUDP("udp4", localAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Proxy{
+		conn:         conn,
+		upstream:     upstreamAddr,
+		toUpstream:   newLink(config, UPSTREAM),
+		toDownstream: newLink(config, DOWNSTREAM),
+		clients:      make(map[string]*net.UDPConn),
+		closed:       make(chan struct{}),
+	}
+
+	go p.toUpstream.run()
+	go p.toDownstream.run()
+	go p.relayUpstream()
+	return p, nil
+}
+
+func (p *Proxy) Addr() net.Addr {
+	return p.conn.LocalAddr()
+}
+
+// What has happened to traffic heading to the upstream, and back from it
+func (p *Proxy) Stats() (Stats, Stats) {
+	return p.toUpstream.Stats(), p.toDownstream.Stats()
+}
+
+func (p *Proxy) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.closed)
+		close(p.toUpstream.closed)
+		close(p.toDownstream.closed)
+		p.conn.Close()
+
+		p.lock.Lock()
+		for _, upstream := range p.clients {
+			upstream.Close()
+		}
+		p.lock.Unlock()
+	})
+	return nil
+}
+
+// Reads from clients, sending each datagram through the upstream link on
+// that client's own socket
+func (p *Proxy) relayUpstream() {
+	for {
+		buffer := make([]byte, MAX_DATAGRAM)
+		read, client, err := p.conn.ReadFromUDP(buffer)
+		if err != nil {
+			select {
+			case <-p.closed:
+				return
+			default:
+				continue
+			}
+		}
+
+		upstream, err := p.clientConn(client)
+		if err != nil {
+			log.ERR.Printf("[netem] %s: %s\n", client, err)
+			continue
+		}
+		p.toUpstream.push(buffer[:read], func(data []byte) {
+			upstream.Write(data)
+		})
+	}
+}
+
+// The socket relaying client's traffic, opened the first time it's heard from
+func (p *Proxy) clientConn(client *net.UDPAddr) (*net.UDPConn, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if upstream, ok := p.clients[client.String()]; ok {
+		return upstream, nil
+	}
+
+	upstream, err := net.DialUDP("udp4", nil, p.upstream)
+	if err != nil {
+		return nil, err
+	}
+	p.clients[client.String()] = upstream
+	log.ERR.Printf("[netem] relaying %s through %s\n", client, upstream.LocalAddr())
+
+	go p.relayDownstream(client, upstream)
+	return upstream, nil
+}
+
+// Reads the upstream's replies to client, sending them back through the
+// downstream link
+func (p *Proxy) relayDownstream(client *net.UDPAddr, upstream *net.UDPConn) {
+	for {
+		buffer := make([]byte, MAX_DATAGRAM)
+		read, err := upstream.Read(buffer)
+		if err != nil {
+			select {
+			case <-p.closed:
+				return
+			default:
+				continue
+			}
+		}
+
+		p.toDownstream.push(buffer[:read], func(data []byte) {
+			p.conn.WriteToUDP(data, client)
+		})
+	}
+}
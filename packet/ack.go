@@ -1,10 +1,69 @@
 package packet
 
-import "net"
+import (
+	"math"
+	"net"
+	"sort"
+)
+
+const (
+	// Sequence ID and offset of the datagram that triggered this ack,
+	// following the version, kind and session prefix
+	ACK_SEQUENCE_POINTER = PREFIX_SIZE
+	ACK_OFFSET_POINTER   = ACK_SEQUENCE_POINTER + SEQUENCE_SIZE
+
+	// Every sequence below this has been received
+	CUMULATIVE_POINTER = ACK_OFFSET_POINTER + OFFSET_SIZE
+	CUMULATIVE_SIZE    = SEQUENCE_SIZE
+
+	// Fraction of datagrams the receiver has lately found missing, in 256ths
+	LOSS_POINTER = CUMULATIVE_POINTER + CUMULATIVE_SIZE
+	LOSS_SIZE    = 1
+
+	// How the transfer went, on acks for the FIN
+	STATUS_POINTER = LOSS_POINTER + LOSS_SIZE
+	STATUS_SIZE    = 1
+
+	// How many datagrams past the cumulative point the receiver has room
+	// for; the sender sends nothing at or past that edge but a probe
+	WINDOW_POINTER = STATUS_POINTER + STATUS_SIZE
+	WINDOW_SIZE    = 4
+
+	// Number of SACK blocks that follow
+	SACK_COUNT_POINTER = WINDOW_POINTER + WINDOW_SIZE
+	SACK_COUNT_SIZE    = 1
+
+	// Ranges received above the cumulative point (RFC 2018), each a
+	// left edge and the sequence just past the right edge
+	SACK_POINTER    = SACK_COUNT_POINTER + SACK_COUNT_SIZE
+	SACK_BLOCK_SIZE = 2 * SEQUENCE_SIZE
+	MAX_SACK_BLOCKS = 8
+)
 
 var (
 	// Maximal UDP Ack Size
-	ACK_SIZE = SEQUENCE_SIZE + OFFSET_SIZE
+	ACK_SIZE = SACK_POINTER + MAX_SACK_BLOCKS*SACK_BLOCK_SIZE
+)
+
+// Advertised by a receiver that puts no limit on the sender
+const UNLIMITED_WINDOW = math.MaxUint32
+
+type AckStatus byte
+
+const (
+	// Nothing has gone wrong; on the FIN's ack, the transfer is complete
+	ACK_STATUS_OK AckStatus = 0
+	// The FIN arrived, but the receiver is still checking the stream; the
+	// FIN isn't acked yet
+	ACK_STATUS_PENDING AckStatus = 1
+	// The stream decompressed to something other than what the FIN's
+	// digest says was sent
+	ACK_STATUS_MISMATCH AckStatus = 2
+	// The receiver gave up on the transfer for some other reason
+	ACK_STATUS_FAILED AckStatus = 3
+	// The datagram fell past the receiver's window and was dropped unread;
+	// the ack only answers it with the window, as for a probe
+	ACK_STATUS_NO_ROOM AckStatus = 4
 )
 
 type AddressedAck struct {
@@ -14,27 +73,142 @@ type AddressedAck struct {
 
 type Ack []byte
 
+// A run of received sequences, [Start, End)
+type SackBlock struct {
+	Start SeqID
+	End   SeqID
+}
+
+func (block SackBlock) Contains(seq SeqID) bool {
+	return block.Start <= seq && seq < block.End
+}
+
 func NewAck() Ack {
 	return make([]byte, ACK_SIZE)
 }
 
-func CreateAck(datagram Datagram) Ack {
+// Acks the datagram, along with everything below cumulative and every
+// sequence in received (the set of sequences held above cumulative)
+func CreateAck(datagram Datagram, cumulative SeqID, received map[SeqID]bool) Ack {
 	ack := NewAck()
+	ack.Prefix().SetVersion(WIRE_VERSION)
+	ack.Prefix().SetKind(KIND_ACK)
+	ack.Prefix().SetSession(datagram.Headers().Session())
 	ack.SetSequence(datagram.Headers().Sequence())
 	ack.SetOffset(datagram.Headers().Offset())
+	ack.SetCumulative(cumulative)
+	ack.SetSackBlocks(SackBlocks(datagram.Headers().Sequence(), cumulative, received))
 	return ack
 }
 
+// Collapses the received sequences above cumulative into at most
+// MAX_SACK_BLOCKS ranges. As in RFC 2018 the block holding the most recently
+// received sequence comes first; the rest follow lowest first, since those
+// are the holes the sender most needs to hear about.
+func SackBlocks(latest SeqID, cumulative SeqID, received map[SeqID]bool) []SackBlock {
+	sequences := make([]SeqID, 0, len(received))
+	for seq, ok := range received {
+		if ok && seq >= cumulative {
+			sequences = append(sequences, seq)
+		}
+	}
+	sort.Slice(sequences, func(i, j int) bool { return sequences[i] < sequences[j] })
+
+	var blocks []SackBlock
+	for _, seq := range sequences {
+		if len(blocks) > 0 && blocks[len(blocks)-1].End == seq {
+			blocks[len(blocks)-1].End++
+		} else {
+			blocks = append(blocks, SackBlock{Start: seq, End: seq + 1})
+		}
+	}
+
+	for i, block := range blocks {
+		if block.Contains(latest) {
+			copy(blocks[1:i+1], blocks[0:i])
+			blocks[0] = block
+			break
+		}
+	}
+
+	if len(blocks) > MAX_SACK_BLOCKS {
+		blocks = blocks[:MAX_SACK_BLOCKS]
+	}
+	return blocks
+}
+
+func (ack Ack) Prefix() Prefix {
+	return Prefix(ack)
+}
+
 func (ack Ack) Sequence() SeqID {
-	return SeqID(bytesToUint32(ack[SEQUENCE_POINTER : SEQUENCE_POINTER+SEQUENCE_SIZE]))
+	return SeqID(bytesToUint64(ack[ACK_SEQUENCE_POINTER : ACK_SEQUENCE_POINTER+SEQUENCE_SIZE]))
 }
 func (ack Ack) SetSequence(seq SeqID) {
-	copy(ack[SEQUENCE_POINTER:SEQUENCE_POINTER+SEQUENCE_SIZE], uint32ToBytes(uint32(seq)))
+	copy(ack[ACK_SEQUENCE_POINTER:ACK_SEQUENCE_POINTER+SEQUENCE_SIZE], uint64ToBytes(uint64(seq)))
 }
 
 func (ack Ack) Offset() OffsetVal {
-	return OffsetVal(bytesToUint32(ack[OFFSET_POINTER : OFFSET_POINTER+OFFSET_SIZE]))
+	return OffsetVal(bytesToUint64(ack[ACK_OFFSET_POINTER : ACK_OFFSET_POINTER+OFFSET_SIZE]))
 }
 func (ack Ack) SetOffset(offset OffsetVal) {
-	copy(ack[OFFSET_POINTER:OFFSET_POINTER+OFFSET_SIZE], uint32ToBytes(uint32(offset)))
+	copy(ack[ACK_OFFSET_POINTER:ACK_OFFSET_POINTER+OFFSET_SIZE], uint64ToBytes(uint64(offset)))
+}
+
+// Every sequence below the cumulative ack point has been received
+func (ack Ack) Cumulative() SeqID {
+	return SeqID(bytesToUint64(ack[CUMULATIVE_POINTER : CUMULATIVE_POINTER+CUMULATIVE_SIZE]))
+}
+func (ack Ack) SetCumulative(seq SeqID) {
+	copy(ack[CUMULATIVE_POINTER:CUMULATIVE_POINTER+CUMULATIVE_SIZE], uint64ToBytes(uint64(seq)))
+}
+
+// Fraction of datagrams the receiver has lately found missing, from 0 to 1
+func (ack Ack) Loss() float64 {
+	return float64(ack[LOSS_POINTER]) / 256
+}
+func (ack Ack) SetLoss(loss float64) {
+	ack[LOSS_POINTER] = byte(clamp(int(loss*256), 0, 255))
+}
+
+func (ack Ack) Status() AckStatus {
+	return AckStatus(ack[STATUS_POINTER])
+}
+func (ack Ack) SetStatus(status AckStatus) {
+	ack[STATUS_POINTER] = byte(status)
+}
+
+func (ack Ack) Window() uint32 {
+	return bytesToUint32(ack[WINDOW_POINTER : WINDOW_POINTER+WINDOW_SIZE])
+}
+func (ack Ack) SetWindow(window uint32) {
+	copy(ack[WINDOW_POINTER:WINDOW_POINTER+WINDOW_SIZE], uint32ToBytes(window))
+}
+
+// Ranges received above the cumulative ack point
+func (ack Ack) SackBlocks() []SackBlock {
+	count := int(ack[SACK_COUNT_POINTER])
+	if count > MAX_SACK_BLOCKS {
+		count = MAX_SACK_BLOCKS
+	}
+
+	blocks := make([]SackBlock, count)
+	for i := range blocks {
+		pointer := SACK_POINTER + i*SACK_BLOCK_SIZE
+		blocks[i].Start = SeqID(bytesToUint64(ack[pointer : pointer+SEQUENCE_SIZE]))
+		blocks[i].End = SeqID(bytesToUint64(ack[pointer+SEQUENCE_SIZE : pointer+SACK_BLOCK_SIZE]))
+	}
+	return blocks
+}
+func (ack Ack) SetSackBlocks(blocks []SackBlock) {
+	if len(blocks) > MAX_SACK_BLOCKS {
+		blocks = blocks[:MAX_SACK_BLOCKS]
+	}
+
+	ack[SACK_COUNT_POINTER] = byte(len(blocks))
+	for i, block := range blocks {
+		pointer := SACK_POINTER + i*SACK_BLOCK_SIZE
+		copy(ack[pointer:pointer+SEQUENCE_SIZE], uint64ToBytes(uint64(block.Start)))
+		copy(ack[pointer+SEQUENCE_SIZE:pointer+SACK_BLOCK_SIZE], uint64ToBytes(uint64(block.End)))
+	}
 }
@@ -0,0 +1,71 @@
+package packet
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func receivedSet(seqs ...SeqID) map[SeqID]bool {
+	received := make(map[SeqID]bool)
+	for _, seq := range seqs {
+		received[seq] = true
+	}
+	return received
+}
+
+func TestSackBlocksCoalesce(t *testing.T) {
+	blocks := SackBlocks(5, 2, receivedSet(4, 5, 6, 9, 11, 12))
+	assert.Equal(t, []SackBlock{{4, 7}, {9, 10}, {11, 13}}, blocks)
+}
+
+func TestSackBlocksLatestFirst(t *testing.T) {
+	blocks := SackBlocks(12, 2, receivedSet(4, 5, 6, 9, 11, 12))
+	assert.Equal(t, []SackBlock{{11, 13}, {4, 7}, {9, 10}}, blocks)
+}
+
+func TestSackBlocksLimit(t *testing.T) {
+	received := make(map[SeqID]bool)
+	for seq := SeqID(0); seq < 2*MAX_SACK_BLOCKS; seq++ {
+		received[2*seq+1] = true
+	}
+	blocks := SackBlocks(31, 0, received)
+	assert.Len(t, blocks, MAX_SACK_BLOCKS)
+	assert.Equal(t, SackBlock{31, 32}, blocks[0])
+	assert.Equal(t, SackBlock{1, 2}, blocks[1])
+}
+
+func TestSackBlockContains(t *testing.T) {
+	block := SackBlock{4, 7}
+	assert.False(t, block.Contains(3))
+	assert.True(t, block.Contains(4))
+	assert.True(t, block.Contains(6))
+	assert.False(t, block.Contains(7))
+}
+
+func TestAckRoundTrip(t *testing.T) {
+	datagram := CreateDatagram(testSession, 9, 9*PACKET_SIZE, []byte("data"), 0)
+	ack := CreateAck(datagram, 3, receivedSet(5, 6, 9))
+
+	assert.Equal(t, KIND_ACK, ack.Prefix().Kind())
+	assert.Equal(t, testSession, ack.Prefix().Session())
+	assert.True(t, ack.Prefix().WellFormed())
+	assert.Equal(t, SeqID(9), ack.Sequence())
+	assert.Equal(t, OffsetVal(9*PACKET_SIZE), ack.Offset())
+	assert.Equal(t, SeqID(3), ack.Cumulative())
+	assert.Equal(t, []SackBlock{{9, 10}, {5, 7}}, ack.SackBlocks())
+
+	// The window sits between the status and the blocks without disturbing either
+	ack.SetWindow(UNLIMITED_WINDOW)
+	ack.SetStatus(ACK_STATUS_NO_ROOM)
+	assert.Equal(t, uint32(UNLIMITED_WINDOW), ack.Window())
+	assert.Equal(t, ACK_STATUS_NO_ROOM, ack.Status())
+	assert.Equal(t, []SackBlock{{9, 10}, {5, 7}}, ack.SackBlocks())
+}
+
+func TestAckNoBlocks(t *testing.T) {
+	datagram := CreateDatagram(testSession, 0, 0, []byte("data"), 0)
+	ack := CreateAck(datagram, 1, receivedSet())
+	assert.Equal(t, SeqID(1), ack.Cumulative())
+	assert.Empty(t, ack.SackBlocks())
+}
@@ -4,26 +4,233 @@ import (
 	"bytes"
 	"compress/flate"
 	"compress/gzip"
+	"compress/lzw"
+	"compress/zlib"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"strings"
 )
 
 const (
 	COMPRESS_LEVEL = flate.BestCompression
+
+	// Input sampled to decide whether it's worth compressing, and how small
+	// the sample has to get at flate.BestSpeed for the answer to be yes
+	COMPRESS_SAMPLE_SIZE  = 64 << 10
+	COMPRESS_SAMPLE_RATIO = 0.95
+
+	// LZW's variant, as compress(1) and GIF use it
+	LZW_ORDER     = lzw.MSB
+	LZW_LIT_WIDTH = 8
+)
+
+// How a transfer's stream is compressed. The handshake settles which
+// codecs the sender may use; the stream's first byte says which it did.
+type Codec byte
+
+const (
+	CODEC_NONE  Codec = 1
+	CODEC_GZIP  Codec = 2
+	CODEC_ZLIB  Codec = 3
+	CODEC_FLATE Codec = 4
+	CODEC_LZW   Codec = 5
+)
+
+// A set of codecs, as the handshake carries them
+type Codecs byte
+
+// Every codec a receiver can decompress
+const SUPPORTED_CODECS = Codecs(1<<CODEC_NONE | 1<<CODEC_GZIP | 1<<CODEC_ZLIB | 1<<CODEC_FLATE | 1<<CODEC_LZW)
+
+var (
+	ErrCodec = errors.New("unknown codec")
+	// The stream's first byte names a codec the handshake didn't settle on
+	ErrCodecRefused = errors.New("stream uses a codec the handshake didn't allow")
+
+	// In the order ParseCodec lists them
+	codecOrder = []Codec{CODEC_NONE, CODEC_GZIP, CODEC_ZLIB, CODEC_FLATE, CODEC_LZW}
 )
 
+func CodecsOf(list ...Codec) Codecs {
+	var set Codecs
+	for _, c := range list {
+		set |= 1 << c
+	}
+	return set
+}
+
+func (set Codecs) Has(c Codec) bool {
+	return c < 8 && set&(1<<c) != 0
+}
+
+// The compressor and decompressor a codec stands for; level is ignored by
+// codecs without one
+type codec struct {
+	name       string
+	compress   func(w io.Writer, level int) (io.WriteCloser, error)
+	decompress func(r io.Reader) (io.ReadCloser, error)
+}
+
+var codecs = map[Codec]codec{
+	CODEC_NONE: {
+		name: "none",
+		compress: func(w io.Writer, level int) (io.WriteCloser, error) {
+			return nopWriteCloser{w}, nil
+		},
+		decompress: func(r io.Reader) (io.ReadCloser, error) {
+			return ioutil.NopCloser(r), nil
+		},
+	},
+	CODEC_GZIP: {
+		name: "gzip",
+		compress: func(w io.Writer, level int) (io.WriteCloser, error) {
+			return gzip.NewWriterLevel(w, level)
+		},
+		decompress: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	},
+	CODEC_ZLIB: {
+		name: "zlib",
+		compress: func(w io.Writer, level int) (io.WriteCloser, error) {
+			return zlib.NewWriterLevel(w, level)
+		},
+		decompress: zlib.NewReader,
+	},
+	CODEC_FLATE: {
+		name: "flate",
+		compress: func(w io.Writer, level int) (io.WriteCloser, error) {
+			return flate.NewWriter(w, level)
+		},
+		decompress: func(r io.Reader) (io.ReadCloser, error) {
+			return flate.NewReader(r), nil
+		},
+	},
+	CODEC_LZW: {
+		name: "lzw",
+		compress: func(w io.Writer, level int) (io.WriteCloser, error) {
+			return lzw.NewWriter(w, LZW_ORDER, LZW_LIT_WIDTH), nil
+		},
+		decompress: func(r io.Reader) (io.ReadCloser, error) {
+			return lzw.NewReader(r, LZW_ORDER, LZW_LIT_WIDTH), nil
+		},
+	},
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+func (c Codec) Valid() bool {
+	_, ok := codecs[c]
+	return ok
+}
+
+func (c Codec) String() string {
+	if registered, ok := codecs[c]; ok {
+		return registered.name
+	}
+	return fmt.Sprintf("codec(%d)", byte(c))
+}
+
+// Parses a codec's name, as String gives it
+func ParseCodec(name string) (Codec, error) {
+	for _, c := range codecOrder {
+		if codecs[c].name == name {
+			return c, nil
+		}
+	}
+	names := make([]string, len(codecOrder))
+	for i, c := range codecOrder {
+		names[i] = c.String()
+	}
+	return 0, fmt.Errorf("unknown codec %q; pick one of %s", name, strings.Join(names, ", "))
+}
+
 func Compress(baseData []byte) ([]byte, error) {
 	var b bytes.Buffer
-	w := gzip.NewWriter(&b)
-	w.Write(baseData)
-	w.Close()
+	w, err := NewCompressor(&b, CODEC_GZIP, COMPRESS_LEVEL)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(baseData); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
 	return b.Bytes(), nil
 }
 
+// Fails on anything but a whole, intact stream, rather than handing back
+// whatever came before the damage
 func Decompress(compressed []byte) ([]byte, error) {
-	var b = bytes.NewBuffer(compressed)
-	r, err := gzip.NewReader(b)
+	r, err := NewDecompressor(bytes.NewReader(compressed), SUPPORTED_CODECS)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
 	var targetBuffer bytes.Buffer
-	io.Copy(&targetBuffer, r)
-	r.Close()
-	return targetBuffer.Bytes(), err
+	if _, err := io.Copy(&targetBuffer, r); err != nil {
+		return nil, err
+	}
+	return targetBuffer.Bytes(), nil
+}
+
+// Compresses everything written to it into w, for data too large to hold,
+// starting with a byte naming the codec
+func NewCompressor(w io.Writer, c Codec, level int) (io.WriteCloser, error) {
+	registered, ok := codecs[c]
+	if !ok {
+		return nil, ErrCodec
+	}
+	if _, err := w.Write([]byte{byte(c)}); err != nil {
+		return nil, err
+	}
+	return registered.compress(w, level)
+}
+
+// Decompresses compressed as it is read, for data too large to hold, with
+// whichever of allowed its first byte names
+func NewDecompressor(compressed io.Reader, allowed Codecs) (io.ReadCloser, error) {
+	tag := make([]byte, 1)
+	if _, err := io.ReadFull(compressed, tag); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	c := Codec(tag[0])
+	if !c.Valid() {
+		return nil, ErrCodec
+	}
+	if !allowed.Has(c) {
+		return nil, ErrCodecRefused
+	}
+	return codecs[c].decompress(compressed)
+}
+
+// Whether sample shrinks enough at flate.BestSpeed to be worth compressing;
+// data that's already compressed or encrypted doesn't
+func Compressible(sample []byte) bool {
+	if len(sample) == 0 {
+		return true
+	}
+	var counted countingWriter
+	w, _ := flate.NewWriter(&counted, flate.BestSpeed)
+	w.Write(sample)
+	w.Close()
+	return float64(counted) < float64(len(sample))*COMPRESS_SAMPLE_RATIO
+}
+
+type countingWriter int
+
+func (c *countingWriter) Write(data []byte) (int, error) {
+	*c += countingWriter(len(data))
+	return len(data), nil
 }
@@ -1,9 +1,13 @@
 package packet
 
 import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 var sample = []byte("Hello World")
@@ -27,6 +31,63 @@ func TestCompressionInvertible(t *testing.T) {
 	assert.Equal(t, sample, decompressed)
 }
 
+func TestDecompressRefusesDamage(t *testing.T) {
+	compressed, _ := Compress(bytes.Repeat(sample, 100))
+
+	_, err := Decompress(compressed[:len(compressed)-6])
+	assert.Error(t, err)
+
+	flipped := append([]byte(nil), compressed...)
+	flipped[len(flipped)/2] ^= 0xff
+	_, err = Decompress(flipped)
+	assert.Error(t, err)
+}
+
+func TestEveryCodecRoundTrips(t *testing.T) {
+	text := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog "), 1000)
+	for _, codec := range codecOrder {
+		var compressed bytes.Buffer
+		w, err := NewCompressor(&compressed, codec, COMPRESS_LEVEL)
+		require.NoError(t, err, codec.String())
+		w.Write(text)
+		require.NoError(t, w.Close(), codec.String())
+		if codec != CODEC_NONE {
+			assert.True(t, compressed.Len() < len(text)/10, codec.String())
+		}
+
+		r, err := NewDecompressor(bytes.NewReader(compressed.Bytes()), CodecsOf(codec))
+		require.NoError(t, err, codec.String())
+		decompressed, err := ioutil.ReadAll(r)
+		require.NoError(t, err, codec.String())
+		assert.Equal(t, text, decompressed, codec.String())
+
+		parsed, err := ParseCodec(codec.String())
+		require.NoError(t, err)
+		assert.Equal(t, codec, parsed)
+	}
+
+	_, err := ParseCodec("zip")
+	assert.Error(t, err)
+	_, err = NewCompressor(ioutil.Discard, CODEC_GZIP, 42)
+	assert.Error(t, err)
+}
+
+func TestDecompressorRefusesCodecs(t *testing.T) {
+	compressed, _ := Compress(sample)
+	_, err := NewDecompressor(bytes.NewReader(compressed), CodecsOf(CODEC_NONE, CODEC_ZLIB))
+	assert.Equal(t, ErrCodecRefused, err)
+	_, err = NewDecompressor(bytes.NewReader([]byte{0xff}), SUPPORTED_CODECS)
+	assert.Equal(t, ErrCodec, err)
+}
+
+func TestCompressible(t *testing.T) {
+	random := make([]byte, COMPRESS_SAMPLE_SIZE)
+	rand.New(rand.NewSource(1)).Read(random)
+	assert.False(t, Compressible(random))
+	assert.True(t, Compressible(bytes.Repeat(sample, 1000)))
+	assert.True(t, Compressible(nil))
+}
+
 func TestIdent(t *testing.T) {
 
 }
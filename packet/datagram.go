@@ -2,10 +2,9 @@ package packet
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
-	"math"
 	"net"
-	"unsafe"
 )
 
 type AddressedDatagram struct {
@@ -14,16 +13,24 @@ type AddressedDatagram struct {
 }
 
 const (
-	// Maximal UDP datagram size size
+	// Largest datagram a side offers in the handshake unless configured
+	// otherwise; path MTU discovery works up to it from BASE_DATAGRAM_SIZE
 	DATAGRAM_SIZE = 1472 // MTU - IP - UDP = 1500 - 20 - 8 = 1472 bytes
 
-	// Sequence ID
-	SEQUENCE_POINTER = 0
-	SEQUENCE_SIZE    = 4
+	// What every path is taken to carry, and what sessions start out
+	// sending (RFC 8899's BASE_PLPMTU)
+	BASE_DATAGRAM_SIZE = 1200
+
+	// The most a UDP datagram can carry over IPv4
+	MAX_DATAGRAM_SIZE = 65507
+
+	// Sequence ID, following the version, kind and session prefix
+	SEQUENCE_POINTER = PREFIX_SIZE
+	SEQUENCE_SIZE    = 8
 
 	// File Offset
 	OFFSET_POINTER = SEQUENCE_POINTER + SEQUENCE_SIZE
-	OFFSET_SIZE    = 4
+	OFFSET_SIZE    = 8
 
 	// Checksum of the Packet's data
 	CHECKSUM_POINTER = OFFSET_POINTER + OFFSET_SIZE
@@ -39,12 +46,18 @@ const (
 
 	// Packet count of the total file
 	COUNT_POINTER = DONE_FLAG_POINTER + DONE_FLAG_SIZE
-	COUNT_SIZE    = 4
+	COUNT_SIZE    = 8
 
 	// HEADER_SIZE = LENGTH_POINTER + LENGTH_SIZE
 	HEADER_SIZE = COUNT_POINTER + COUNT_SIZE
 
+	// Room for data in an unsealed DATAGRAM_SIZE datagram. Sessions work
+	// theirs out from the datagram size they settle on and the path takes.
 	PACKET_SIZE = DATAGRAM_SIZE - HEADER_SIZE
+
+	// A transfer's FIN carries the SHA-256 of the whole stream before
+	// compression, for the receiver to check what it decompressed against
+	DIGEST_SIZE = sha256.Size
 )
 
 //////////////////////////////////////////////
@@ -54,20 +67,28 @@ const (
 // datagram data is just a byte slice
 type Datagram []byte
 
-type SeqID uint32
-type OffsetVal uint32
+type SeqID uint64
+type OffsetVal uint64
 type ByteData []byte
-type PacketLen uint32
+type PacketLen uint32 // A single packet never comes close to 4GiB
 type DoneFlag bool
-type PacketCount uint32
+type PacketCount uint64
 
-func NewDatagram() Datagram {
-	return make([]byte, DATAGRAM_SIZE)
+// Buffer large enough to read a datagram of up to size bytes into
+func NewDatagram(size int) Datagram {
+	return make([]byte, size)
 }
 
-func CreateDatagram(sequence SeqID, offset OffsetVal, packet ByteData, packetCount PacketCount) Datagram {
-	dg := NewDatagram()
+// Datagrams are only as long as their contents; the unused tail of a short
+// packet is never put on the wire. How much goes in each is up to the
+// caller, since it depends on the session.
+func CreateDatagram(session SessionID, sequence SeqID, offset OffsetVal, packet ByteData, packetCount PacketCount) Datagram {
+	packetSize := PacketLen(len(packet))
+	dg := make(Datagram, HEADER_SIZE+int(packetSize))
 
+	dg.Headers().SetVersion(WIRE_VERSION)
+	dg.Headers().SetKind(KIND_DATA)
+	dg.Headers().SetSession(session)
 	dg.Headers().SetSequence(sequence)
 	dg.Headers().SetOffset(offset)
 
@@ -76,7 +97,6 @@ func CreateDatagram(sequence SeqID, offset OffsetVal, packet ByteData, packetCou
 	dataChecksum := CalculateChecksum(dg.Packet())
 	dg.Headers().SetChecksum(dataChecksum)
 
-	packetSize := PacketLen(math.Min(float64(len(packet)), PACKET_SIZE))
 	dg.Headers().SetLength(packetSize)
 	dg.Headers().SetDone(false)
 	dg.Headers().SetCount(packetCount)
@@ -92,12 +112,64 @@ func (dg Datagram) Packet() Packet {
 	return Packet(dg[HEADER_SIZE:])
 }
 
+// Packet contents, without any piggybacked ack
+func (dg Datagram) Payload() Packet {
+	length := int(dg.Headers().Length())
+	if length > len(dg.Packet()) {
+		length = len(dg.Packet())
+	}
+	return dg.Packet()[:length]
+}
+
+// What a FIN says the whole uncompressed stream hashes to; nil if it
+// doesn't say, as on a Stream
+func (dg Datagram) Digest() []byte {
+	if !bool(dg.Headers().Done()) || len(dg.Payload()) != DIGEST_SIZE {
+		return nil
+	}
+	return append([]byte(nil), dg.Payload()...)
+}
+
+// Whether the datagram arrived intact
 func (dg Datagram) Validate() bool {
+	if !dg.Consistent() {
+		return false
+	}
 	headerChecksum := dg.Headers().Checksum()
-	dataChecksum := CalculateChecksum(dg.Packet())
+	dataChecksum := CalculateChecksum(dg.Payload())
 	return bytes.Equal(headerChecksum, dataChecksum)
 }
 
+// Whether the length fits, and anything past the contents is an ack. A
+// sealed datagram needs no more than this, since the AEAD tag stands in
+// for the checksum.
+func (dg Datagram) Consistent() bool {
+	if int(dg.Headers().Length()) > len(dg.Packet()) {
+		return false
+	}
+	return len(dg.Payload()) == len(dg.Packet()) || dg.Piggyback() != nil
+}
+
+// On a stream, an ack for the other direction may follow the packet contents
+func (dg Datagram) Piggyback() Ack {
+	trailer := dg[HEADER_SIZE+len(dg.Payload()):]
+	if len(trailer) == 0 {
+		return nil
+	}
+	prefix := Prefix(trailer)
+	if !prefix.WellFormed() || prefix.Kind() != KIND_ACK || prefix.Session() != dg.Headers().Session() {
+		return nil
+	}
+	return Ack(trailer)
+}
+
+// A copy of the datagram carrying ack after its contents; the original is
+// left untouched so it can be retransmitted with a fresher ack
+func (dg Datagram) Attach(ack Ack) Datagram {
+	end := HEADER_SIZE + len(dg.Payload())
+	return append(dg[:end:end], ack...)
+}
+
 //////////////////////
 /* Datagram Headers */
 //////////////////////
@@ -107,7 +179,19 @@ func bytesToUint32(b []byte) uint32 {
 }
 
 func uint32ToBytes(n uint32) []byte {
-	return (*[4]byte)(unsafe.Pointer(&n))[:]
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, n)
+	return b
+}
+
+func bytesToUint64(b []byte) uint64 {
+	return binary.LittleEndian.Uint64(b)
+}
+
+func uint64ToBytes(n uint64) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, n)
+	return b
 }
 
 func bytesToBool(b []byte) bool {
@@ -124,22 +208,48 @@ func boolToBytes(b bool) []byte {
 
 type Header []byte
 
+// Wire format version the packet was built with
+func (h Header) Version() byte {
+	return Prefix(h).Version()
+}
+
+func (h Header) SetVersion(version byte) {
+	Prefix(h).SetVersion(version)
+}
+
+func (h Header) Kind() Kind {
+	return Prefix(h).Kind()
+}
+
+func (h Header) SetKind(kind Kind) {
+	Prefix(h).SetKind(kind)
+}
+
+// Session the packet belongs to
+func (h Header) Session() SessionID {
+	return Prefix(h).Session()
+}
+
+func (h Header) SetSession(session SessionID) {
+	Prefix(h).SetSession(session)
+}
+
 // Sequence ID of the current packet
 func (h Header) Sequence() SeqID {
-	return SeqID(bytesToUint32(h[SEQUENCE_POINTER : SEQUENCE_POINTER+SEQUENCE_SIZE]))
+	return SeqID(bytesToUint64(h[SEQUENCE_POINTER : SEQUENCE_POINTER+SEQUENCE_SIZE]))
 }
 
 func (h Header) SetSequence(seq SeqID) {
-	copy(h[SEQUENCE_POINTER:SEQUENCE_POINTER+SEQUENCE_SIZE], uint32ToBytes(uint32(seq)))
+	copy(h[SEQUENCE_POINTER:SEQUENCE_POINTER+SEQUENCE_SIZE], uint64ToBytes(uint64(seq)))
 }
 
 // Sequence ID of the current packet
 func (h Header) Offset() OffsetVal {
-	return OffsetVal(bytesToUint32(h[OFFSET_POINTER : OFFSET_POINTER+OFFSET_SIZE]))
+	return OffsetVal(bytesToUint64(h[OFFSET_POINTER : OFFSET_POINTER+OFFSET_SIZE]))
 }
 
 func (h Header) SetOffset(offset OffsetVal) {
-	copy(h[OFFSET_POINTER:OFFSET_POINTER+OFFSET_SIZE], uint32ToBytes(uint32(offset)))
+	copy(h[OFFSET_POINTER:OFFSET_POINTER+OFFSET_SIZE], uint64ToBytes(uint64(offset)))
 }
 
 // Checksum hash of Data (MD5)
@@ -168,10 +278,10 @@ func (h Header) SetDone(done DoneFlag) {
 
 // Length of packet contents
 func (h Header) Count() PacketCount {
-	return PacketCount(bytesToUint32(h[COUNT_POINTER : COUNT_POINTER+COUNT_SIZE]))
+	return PacketCount(bytesToUint64(h[COUNT_POINTER : COUNT_POINTER+COUNT_SIZE]))
 }
 func (h Header) SetCount(count PacketCount) {
-	copy(h[COUNT_POINTER:COUNT_POINTER+COUNT_SIZE], uint32ToBytes(uint32(count)))
+	copy(h[COUNT_POINTER:COUNT_POINTER+COUNT_SIZE], uint64ToBytes(uint64(count)))
 }
 
 /////////////////////
@@ -0,0 +1,76 @@
+package packet
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testSession = SessionID(0xFAA27)
+
+func TestDatagramRoundTrip(t *testing.T) {
+	datagram := CreateDatagram(testSession, 7, 7*PACKET_SIZE, []byte("Hello World"), 12)
+	assert.Equal(t, byte(WIRE_VERSION), datagram.Headers().Version())
+	assert.Equal(t, KIND_DATA, datagram.Headers().Kind())
+	assert.Equal(t, testSession, datagram.Headers().Session())
+	assert.Equal(t, SeqID(7), datagram.Headers().Sequence())
+	assert.Equal(t, OffsetVal(7*PACKET_SIZE), datagram.Headers().Offset())
+	assert.Equal(t, PacketLen(len("Hello World")), datagram.Headers().Length())
+	assert.Equal(t, PacketCount(12), datagram.Headers().Count())
+	assert.Equal(t, DoneFlag(false), datagram.Headers().Done())
+	assert.True(t, datagram.Validate())
+	assert.True(t, Prefix(datagram).WellFormed())
+
+	// Only the payload goes on the wire
+	assert.Len(t, datagram, HEADER_SIZE+len("Hello World"))
+}
+
+func TestDatagramPast32Bits(t *testing.T) {
+	// A 500GB stream, well past where 32 bit offsets and sequences wrap
+	offset := OffsetVal(500 << 30)
+	seq := SeqID(offset / PACKET_SIZE)
+	datagram := CreateDatagram(testSession, seq, offset, []byte("data"), PacketCount(seq+1))
+
+	assert.Equal(t, seq, datagram.Headers().Sequence())
+	assert.Equal(t, offset, datagram.Headers().Offset())
+	assert.Equal(t, PacketCount(seq+1), datagram.Headers().Count())
+}
+
+func TestDatagramCorrupt(t *testing.T) {
+	datagram := CreateDatagram(testSession, 0, 0, []byte("Hello World"), 0)
+	datagram.Packet()[0] ^= 0xFF
+	assert.False(t, datagram.Validate())
+}
+
+func TestDatagramTruncated(t *testing.T) {
+	datagram := CreateDatagram(testSession, 0, 0, []byte("Hello World"), 0)
+	assert.False(t, datagram[:len(datagram)-1].Validate())
+	assert.False(t, Prefix(datagram[:HEADER_SIZE-1]).WellFormed())
+}
+
+func TestDatagramPiggyback(t *testing.T) {
+	datagram := CreateDatagram(testSession, 3, 0, []byte("Hello World"), 0)
+	assert.Nil(t, datagram.Piggyback())
+
+	reverse := CreateDatagram(testSession, 9, 0, []byte("reply"), 0)
+	ack := CreateAck(reverse, 9, receivedSet())
+	carrying := datagram.Attach(ack)
+	assert.Len(t, datagram, HEADER_SIZE+len("Hello World"))
+	assert.True(t, carrying.Validate())
+	assert.Equal(t, Packet("Hello World"), carrying.Payload())
+	assert.Equal(t, SeqID(9), carrying.Piggyback().Sequence())
+
+	// Trailing bytes that aren't an ack for the same session are corruption
+	ack.Prefix().SetSession(testSession + 1)
+	assert.False(t, datagram.Attach(ack).Validate())
+}
+
+func TestAckPast32Bits(t *testing.T) {
+	seq := SeqID(1<<32 + 5)
+	datagram := CreateDatagram(testSession, seq, OffsetVal(seq)*PACKET_SIZE, []byte("data"), 0)
+	ack := CreateAck(datagram, 1<<32-1, receivedSet(1<<32, 1<<32+1, seq))
+
+	assert.Equal(t, seq, ack.Sequence())
+	assert.Equal(t, SeqID(1<<32-1), ack.Cumulative())
+	assert.Equal(t, []SackBlock{{seq, seq + 1}, {1 << 32, 1<<32 + 2}}, ack.SackBlocks())
+}
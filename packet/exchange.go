@@ -0,0 +1,89 @@
+package packet
+
+import (
+	"crypto/rand"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/ed25519"
+)
+
+const (
+	// With OPTION_KEY_EXCHANGE, the SYN and SYN-ACK go on to carry a fresh
+	// X25519 key for the session, the long-term ed25519 identity of the
+	// side that sent it, and that identity's signature over the handshake
+	EXCHANGE_EPHEMERAL_POINTER = HANDSHAKE_SIZE
+	EXCHANGE_EPHEMERAL_SIZE    = curve25519.PointSize
+
+	EXCHANGE_IDENTITY_POINTER = EXCHANGE_EPHEMERAL_POINTER + EXCHANGE_EPHEMERAL_SIZE
+	EXCHANGE_IDENTITY_SIZE    = ed25519.PublicKeySize
+
+	EXCHANGE_SIGNATURE_POINTER = EXCHANGE_IDENTITY_POINTER + EXCHANGE_IDENTITY_SIZE
+	EXCHANGE_SIGNATURE_SIZE    = ed25519.SignatureSize
+
+	EXCHANGE_HANDSHAKE_SIZE = EXCHANGE_SIGNATURE_POINTER + EXCHANGE_SIGNATURE_SIZE
+
+	// Large enough to read any handshake into
+	MAX_HANDSHAKE_SIZE = EXCHANGE_HANDSHAKE_SIZE + RESUME_SYN_ACK_MAX_SIZE
+)
+
+// Keep a SYN's signature from passing for a SYN-ACK's, or the reverse
+var (
+	SYN_SIGNATURE_CONTEXT     = []byte("faart syn")
+	SYN_ACK_SIGNATURE_CONTEXT = []byte("faart syn-ack")
+)
+
+func (h Handshake) Ephemeral() []byte {
+	return h[EXCHANGE_EPHEMERAL_POINTER : EXCHANGE_EPHEMERAL_POINTER+EXCHANGE_EPHEMERAL_SIZE]
+}
+
+func (h Handshake) Identity() ed25519.PublicKey {
+	return ed25519.PublicKey(h[EXCHANGE_IDENTITY_POINTER : EXCHANGE_IDENTITY_POINTER+EXCHANGE_IDENTITY_SIZE])
+}
+
+func (h Handshake) Signature() []byte {
+	return h[EXCHANGE_SIGNATURE_POINTER : EXCHANGE_SIGNATURE_POINTER+EXCHANGE_SIGNATURE_SIZE]
+}
+
+// Fills in a fresh X25519 key and identity, then signs everything in the
+// handshake but the signature itself, so fill in the rest first. A
+// SYN-ACK's signature covers the whole SYN it answers as well, so neither
+// side's half of the exchange can be swapped out. Returns the private half
+// of the X25519 key, for SharedSecret. Pass a nil syn when signing a SYN.
+func (h Handshake) Exchange(identity ed25519.PrivateKey, syn Handshake) ([]byte, error) {
+	private := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(private); err != nil {
+		return nil, err
+	}
+	public, err := curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+
+	copy(h.Ephemeral(), public)
+	copy(h.Identity(), identity.Public().(ed25519.PublicKey))
+	copy(h.Signature(), ed25519.Sign(identity, h.signed(syn)))
+	return private, nil
+}
+
+// Whether the handshake was signed by the identity it carries
+func (h Handshake) VerifyExchange(syn Handshake) bool {
+	return ed25519.Verify(h.Identity(), h.signed(syn), h.Signature())
+}
+
+func (h Handshake) signed(syn Handshake) []byte {
+	var message []byte
+	if syn == nil {
+		message = append(message, SYN_SIGNATURE_CONTEXT...)
+	} else {
+		message = append(message, SYN_ACK_SIGNATURE_CONTEXT...)
+		message = append(message, syn...)
+	}
+	message = append(message, h[:EXCHANGE_SIGNATURE_POINTER]...)
+	return append(message, h[EXCHANGE_HANDSHAKE_SIZE:]...)
+}
+
+// The Diffie-Hellman secret between private, from Exchange, and the
+// ephemeral key the peer's handshake carried
+func SharedSecret(private []byte, peer Handshake) ([]byte, error) {
+	return curve25519.X25519(private, peer.Ephemeral())
+}
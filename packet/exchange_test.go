@@ -0,0 +1,56 @@
+package packet
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestExchangeAgrees(t *testing.T) {
+	_, senderIdentity, _ := ed25519.GenerateKey(nil)
+	_, receiverIdentity, _ := ed25519.GenerateKey(nil)
+
+	syn := CreateSyn(testSession, DATAGRAM_SIZE, OPTION_KEY_EXCHANGE|OPTION_AES_GCM)
+	assert.Len(t, syn, EXCHANGE_HANDSHAKE_SIZE)
+	senderPrivate, err := syn.Exchange(senderIdentity, nil)
+	require.NoError(t, err)
+	assert.True(t, syn.Prefix().WellFormed())
+	assert.False(t, syn[:HANDSHAKE_SIZE].Prefix().WellFormed())
+	assert.True(t, syn.VerifyExchange(nil))
+
+	synAck := CreateSynAck(syn, DATAGRAM_SIZE, SUPPORTED_OPTIONS)
+	receiverPrivate, err := synAck.Exchange(receiverIdentity, syn)
+	require.NoError(t, err)
+	assert.True(t, synAck.VerifyExchange(syn))
+	assert.Equal(t, receiverIdentity.Public(), synAck.Identity())
+
+	senderSecret, err := SharedSecret(senderPrivate, synAck)
+	require.NoError(t, err)
+	receiverSecret, err := SharedSecret(receiverPrivate, syn)
+	require.NoError(t, err)
+	assert.Equal(t, senderSecret, receiverSecret)
+}
+
+func TestExchangeCatchesSwaps(t *testing.T) {
+	_, identity, _ := ed25519.GenerateKey(nil)
+	syn := CreateSyn(testSession, DATAGRAM_SIZE, OPTION_KEY_EXCHANGE)
+	_, err := syn.Exchange(identity, nil)
+	require.NoError(t, err)
+	synAck := CreateSynAck(syn, DATAGRAM_SIZE, SUPPORTED_OPTIONS)
+	_, err = synAck.Exchange(identity, syn)
+	require.NoError(t, err)
+
+	// A SYN-ACK signed over a different SYN
+	other := CreateSyn(testSession, DATAGRAM_SIZE, OPTION_KEY_EXCHANGE)
+	_, err = other.Exchange(identity, nil)
+	require.NoError(t, err)
+	assert.False(t, synAck.VerifyExchange(other))
+
+	// Or a swapped ephemeral key
+	synAck.Ephemeral()[0] ^= 1
+	assert.False(t, synAck.VerifyExchange(syn))
+	syn.Ephemeral()[0] ^= 1
+	assert.False(t, syn.VerifyExchange(nil))
+}
@@ -0,0 +1,303 @@
+package packet
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// How a block's parity datagrams are computed
+type FECScheme byte
+
+const (
+	// A single parity datagram, the XOR of the block; recovers one loss
+	FEC_XOR FECScheme = 1
+	// Any number of Cauchy Reed-Solomon parity datagrams; recovers as many
+	// losses as there are parity datagrams
+	FEC_REED_SOLOMON FECScheme = 2
+)
+
+const (
+	// First sequence of the block the parity covers, following the version,
+	// kind and session prefix
+	PARITY_BLOCK_POINTER = PREFIX_SIZE
+	PARITY_BLOCK_SIZE    = SEQUENCE_SIZE
+
+	// Data datagrams in the block
+	PARITY_DATA_COUNT_POINTER = PARITY_BLOCK_POINTER + PARITY_BLOCK_SIZE
+	PARITY_DATA_COUNT_SIZE    = 1
+
+	// Which of the block's parity datagrams this is, and how many there are
+	PARITY_INDEX_POINTER = PARITY_DATA_COUNT_POINTER + PARITY_DATA_COUNT_SIZE
+	PARITY_INDEX_SIZE    = 1
+	PARITY_COUNT_POINTER = PARITY_INDEX_POINTER + PARITY_INDEX_SIZE
+	PARITY_COUNT_SIZE    = 1
+
+	PARITY_SCHEME_POINTER = PARITY_COUNT_POINTER + PARITY_COUNT_SIZE
+	PARITY_SCHEME_SIZE    = 1
+
+	// Checksum of the parity shard
+	PARITY_CHECKSUM_POINTER = PARITY_SCHEME_POINTER + PARITY_SCHEME_SIZE
+
+	PARITY_HEADER_SIZE = PARITY_CHECKSUM_POINTER + CHECKSUM_SIZE
+
+	// Each data datagram is protected as its offset and length followed by
+	// its contents, so all three can be rebuilt
+	SHARD_HEADER_SIZE = OFFSET_SIZE + LENGTH_SIZE
+
+	// Bounds on a block's data and parity datagrams
+	FEC_MIN_BLOCK  = 4
+	FEC_MAX_BLOCK  = 32
+	FEC_MAX_PARITY = 16
+
+	// Data datagrams in a Reed-Solomon block
+	FEC_RS_BLOCK = 16
+	// Parity sent per expected loss, beyond the one always sent
+	FEC_MARGIN = 2
+)
+
+var ErrFECScheme = errors.New("unknown FEC scheme")
+
+func (scheme FECScheme) Valid() bool {
+	return scheme == FEC_XOR || scheme == FEC_REED_SOLOMON
+}
+
+func (scheme FECScheme) String() string {
+	switch scheme {
+	case FEC_XOR:
+		return "xor"
+	case FEC_REED_SOLOMON:
+		return "rs"
+	default:
+		return fmt.Sprintf("fec(%d)", byte(scheme))
+	}
+}
+
+// Parses "xor" or "rs", as String gives them
+func ParseFECScheme(name string) (FECScheme, error) {
+	switch name {
+	case "xor":
+		return FEC_XOR, nil
+	case "rs":
+		return FEC_REED_SOLOMON, nil
+	default:
+		return 0, fmt.Errorf("unknown FEC scheme %q", name)
+	}
+}
+
+// Sizes the next block for the loss rate the receiver last reported:
+// XOR blocks shrink as loss grows so that a second loss in one block stays
+// unlikely, while Reed-Solomon blocks keep their size and add parity
+func FECRedundancy(scheme FECScheme, loss float64) (int, int) {
+	if scheme == FEC_XOR {
+		dataCount := FEC_MAX_BLOCK
+		if loss > 0 {
+			dataCount = int(0.1/loss) - 1
+		}
+		return clamp(dataCount, FEC_MIN_BLOCK, FEC_MAX_BLOCK), 1
+	}
+
+	parityCount := 1 + int(math.Ceil(FEC_MARGIN*loss*FEC_RS_BLOCK))
+	return FEC_RS_BLOCK, clamp(parityCount, 1, FEC_MAX_PARITY)
+}
+
+func clamp(n, low, high int) int {
+	if n < low {
+		return low
+	}
+	if n > high {
+		return high
+	}
+	return n
+}
+
+// What parity protects of a data datagram, padded out to size
+func Shard(datagram Datagram, size int) []byte {
+	shard := make([]byte, size)
+	copy(shard, uint64ToBytes(uint64(datagram.Headers().Offset())))
+	copy(shard[OFFSET_SIZE:], uint32ToBytes(uint32(datagram.Headers().Length())))
+	copy(shard[SHARD_HEADER_SIZE:], datagram.Payload())
+	return shard
+}
+
+// Rebuilds the data datagram seq from its shard, or returns false if the
+// shard doesn't describe one
+func Unshard(session SessionID, seq SeqID, shard []byte) (Datagram, bool) {
+	if len(shard) < SHARD_HEADER_SIZE {
+		return nil, false
+	}
+	offset := OffsetVal(bytesToUint64(shard[:OFFSET_SIZE]))
+	length := int(bytesToUint32(shard[OFFSET_SIZE:SHARD_HEADER_SIZE]))
+	if length > len(shard)-SHARD_HEADER_SIZE {
+		return nil, false
+	}
+	return CreateDatagram(session, seq, offset, shard[SHARD_HEADER_SIZE:SHARD_HEADER_SIZE+length], 0), true
+}
+
+// Coefficient of data shard j in parity shard i
+func parityCoefficient(scheme FECScheme, i, j int) byte {
+	if scheme == FEC_XOR {
+		return 1
+	}
+	// A Cauchy matrix, any square piece of which is invertible
+	return galoisInv(byte(FEC_MAX_BLOCK+i) ^ byte(j))
+}
+
+func checkScheme(scheme FECScheme, dataCount, parityCount int) error {
+	switch {
+	case !scheme.Valid():
+		return ErrFECScheme
+	case scheme == FEC_XOR && parityCount != 1:
+		return errors.New("XOR FEC has a single parity datagram")
+	case dataCount < 1 || dataCount > FEC_MAX_BLOCK || parityCount < 1 || parityCount > FEC_MAX_PARITY:
+		return fmt.Errorf("FEC block of %d+%d out of range", dataCount, parityCount)
+	}
+	return nil
+}
+
+// Computes parityCount parity shards over shards, which must all be the
+// same length
+func EncodeParity(scheme FECScheme, shards [][]byte, parityCount int) ([][]byte, error) {
+	if err := checkScheme(scheme, len(shards), parityCount); err != nil {
+		return nil, err
+	}
+
+	parities := make([][]byte, parityCount)
+	for i := range parities {
+		parities[i] = make([]byte, len(shards[0]))
+		for j, shard := range shards {
+			galoisMulAdd(parities[i], parityCoefficient(scheme, i, j), shard)
+		}
+	}
+	return parities, nil
+}
+
+// Fills in the nil entries of shards from the rest and parities, indexed by
+// which parity they are. Returns false if too few survived to do so.
+func ReconstructShards(scheme FECScheme, shards [][]byte, parities map[int][]byte) (bool, error) {
+	if !scheme.Valid() {
+		return false, ErrFECScheme
+	}
+
+	var missing []int
+	size := 0
+	for j, shard := range shards {
+		if shard == nil {
+			missing = append(missing, j)
+		} else {
+			size = len(shard)
+		}
+	}
+	if len(missing) == 0 {
+		return true, nil
+	}
+	if len(missing) > len(parities) {
+		return false, nil
+	}
+
+	var rows []int
+	for i := 0; i < FEC_MAX_PARITY && len(rows) < len(missing); i++ {
+		if parity, ok := parities[i]; ok {
+			rows = append(rows, i)
+			size = len(parity)
+		}
+	}
+
+	// Each parity, less the shards that did arrive, is a known combination
+	// of the missing ones
+	matrix := make([][]byte, len(rows))
+	remainders := make([][]byte, len(rows))
+	for r, i := range rows {
+		remainders[r] = append([]byte(nil), parities[i]...)
+		matrix[r] = make([]byte, len(missing))
+		for j, shard := range shards {
+			if shard != nil {
+				if len(shard) != size {
+					return false, errors.New("FEC shards differ in length")
+				}
+				galoisMulAdd(remainders[r], parityCoefficient(scheme, i, j), shard)
+			}
+		}
+		for m, j := range missing {
+			matrix[r][m] = parityCoefficient(scheme, i, j)
+		}
+	}
+
+	inverse, ok := galoisInvert(matrix)
+	if !ok {
+		return false, nil
+	}
+	for m, j := range missing {
+		shards[j] = make([]byte, size)
+		for r := range rows {
+			galoisMulAdd(shards[j], inverse[m][r], remainders[r])
+		}
+	}
+	return true, nil
+}
+
+// One of a block's parity datagrams
+type Parity []byte
+
+func CreateParity(session SessionID, block SeqID, scheme FECScheme, dataCount, index, parityCount int, shard []byte) Parity {
+	parity := make(Parity, PARITY_HEADER_SIZE+len(shard))
+	parity.Prefix().SetVersion(WIRE_VERSION)
+	parity.Prefix().SetKind(KIND_PARITY)
+	parity.Prefix().SetSession(session)
+	copy(parity[PARITY_BLOCK_POINTER:PARITY_BLOCK_POINTER+PARITY_BLOCK_SIZE], uint64ToBytes(uint64(block)))
+	parity[PARITY_DATA_COUNT_POINTER] = byte(dataCount)
+	parity[PARITY_INDEX_POINTER] = byte(index)
+	parity[PARITY_COUNT_POINTER] = byte(parityCount)
+	parity[PARITY_SCHEME_POINTER] = byte(scheme)
+	copy(parity[PARITY_HEADER_SIZE:], shard)
+	copy(parity[PARITY_CHECKSUM_POINTER:PARITY_HEADER_SIZE], parity.checksum())
+	return parity
+}
+
+// Covers the block description as well as the shard, since a corrupt
+// description would rebuild the wrong datagrams
+func (p Parity) checksum() []byte {
+	covered := append([]byte(nil), p[PARITY_BLOCK_POINTER:PARITY_CHECKSUM_POINTER]...)
+	return CalculateChecksum(append(covered, p.Shard()...))
+}
+
+func (p Parity) Prefix() Prefix {
+	return Prefix(p)
+}
+
+// First sequence of the block
+func (p Parity) Block() SeqID {
+	return SeqID(bytesToUint64(p[PARITY_BLOCK_POINTER : PARITY_BLOCK_POINTER+PARITY_BLOCK_SIZE]))
+}
+
+func (p Parity) DataCount() int {
+	return int(p[PARITY_DATA_COUNT_POINTER])
+}
+
+func (p Parity) Index() int {
+	return int(p[PARITY_INDEX_POINTER])
+}
+
+func (p Parity) ParityCount() int {
+	return int(p[PARITY_COUNT_POINTER])
+}
+
+func (p Parity) Scheme() FECScheme {
+	return FECScheme(p[PARITY_SCHEME_POINTER])
+}
+
+func (p Parity) Shard() []byte {
+	return p[PARITY_HEADER_SIZE:]
+}
+
+// Whether the block description and shard arrived intact and make sense
+func (p Parity) Validate() bool {
+	return p.Consistent() && bytes.Equal(p[PARITY_CHECKSUM_POINTER:PARITY_HEADER_SIZE], p.checksum())
+}
+
+// Whether the block description makes sense, which is all a sealed parity
+// datagram needs checking for
+func (p Parity) Consistent() bool {
+	return checkScheme(p.Scheme(), p.DataCount(), p.ParityCount()) == nil && p.Index() < p.ParityCount()
+}
@@ -0,0 +1,130 @@
+package packet
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// A block of count datagrams, the last one short, along with their shards
+func testBlock(count int) ([]Datagram, [][]byte) {
+	source := rand.New(rand.NewSource(int64(count)))
+	datagrams := make([]Datagram, count)
+	shards := make([][]byte, count)
+	for i := range datagrams {
+		payload := make([]byte, PACKET_SIZE)
+		if i == count-1 {
+			payload = payload[:PACKET_SIZE/3]
+		}
+		source.Read(payload)
+		datagrams[i] = CreateDatagram(testSession, SeqID(100+i), OffsetVal((100+i)*PACKET_SIZE), payload, 0)
+		shards[i] = Shard(datagrams[i], SHARD_HEADER_SIZE+PACKET_SIZE)
+	}
+	return datagrams, shards
+}
+
+func TestXORRecoversOneLoss(t *testing.T) {
+	datagrams, shards := testBlock(8)
+	parities, err := EncodeParity(FEC_XOR, shards, 1)
+	require.NoError(t, err)
+
+	for lost := range shards {
+		survivors := append([][]byte(nil), shards...)
+		survivors[lost] = nil
+		ok, err := ReconstructShards(FEC_XOR, survivors, map[int][]byte{0: parities[0]})
+		require.NoError(t, err)
+		require.True(t, ok)
+
+		rebuilt, ok := Unshard(testSession, SeqID(100+lost), survivors[lost])
+		require.True(t, ok)
+		assert.Equal(t, datagrams[lost], rebuilt)
+	}
+
+	// Two losses are beyond a single XOR
+	survivors := append([][]byte(nil), shards...)
+	survivors[1], survivors[5] = nil, nil
+	ok, err := ReconstructShards(FEC_XOR, survivors, map[int][]byte{0: parities[0]})
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestReedSolomonRecoversAsManyAsParity(t *testing.T) {
+	datagrams, shards := testBlock(FEC_RS_BLOCK)
+	parities, err := EncodeParity(FEC_REED_SOLOMON, shards, 4)
+	require.NoError(t, err)
+
+	// Lose 4 data datagrams, and have only some of the parity left over to
+	// make up for them besides
+	survivors := append([][]byte(nil), shards...)
+	for _, lost := range []int{0, 3, 9, FEC_RS_BLOCK - 1} {
+		survivors[lost] = nil
+	}
+	ok, err := ReconstructShards(FEC_REED_SOLOMON, survivors, map[int][]byte{0: parities[0], 1: parities[1], 2: parities[2], 3: parities[3]})
+	require.NoError(t, err)
+	require.True(t, ok)
+	for i, shard := range survivors {
+		rebuilt, ok := Unshard(testSession, SeqID(100+i), shard)
+		require.True(t, ok)
+		assert.Equal(t, datagrams[i], rebuilt)
+	}
+
+	survivors = append([][]byte(nil), shards...)
+	survivors[2], survivors[7] = nil, nil
+	ok, err = ReconstructShards(FEC_REED_SOLOMON, survivors, map[int][]byte{1: parities[1], 3: parities[3]})
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, shards[2], survivors[2])
+	assert.Equal(t, shards[7], survivors[7])
+
+	survivors[2], survivors[7], survivors[8] = nil, nil, nil
+	ok, _ = ReconstructShards(FEC_REED_SOLOMON, survivors, map[int][]byte{1: parities[1], 3: parities[3]})
+	assert.False(t, ok)
+}
+
+func TestParityRoundTrip(t *testing.T) {
+	_, shards := testBlock(5)
+	parities, err := EncodeParity(FEC_REED_SOLOMON, shards, 2)
+	require.NoError(t, err)
+
+	parity := CreateParity(testSession, 100, FEC_REED_SOLOMON, 5, 1, 2, parities[1])
+	assert.True(t, parity.Prefix().WellFormed())
+	assert.Equal(t, KIND_PARITY, parity.Prefix().Kind())
+	assert.Equal(t, SeqID(100), parity.Block())
+	assert.Equal(t, 5, parity.DataCount())
+	assert.Equal(t, 1, parity.Index())
+	assert.Equal(t, 2, parity.ParityCount())
+	assert.Equal(t, FEC_REED_SOLOMON, parity.Scheme())
+	assert.Equal(t, parities[1], []byte(parity.Shard()))
+	assert.True(t, parity.Validate())
+	assert.True(t, len(parity) <= DATAGRAM_SIZE)
+
+	// The block description is covered as well as the shard
+	parity[PARITY_BLOCK_POINTER]++
+	assert.False(t, parity.Validate())
+}
+
+func TestFECRedundancyAdapts(t *testing.T) {
+	dataCount, parityCount := FECRedundancy(FEC_XOR, 0)
+	assert.Equal(t, FEC_MAX_BLOCK, dataCount)
+	assert.Equal(t, 1, parityCount)
+	dataCount, _ = FECRedundancy(FEC_XOR, 0.02)
+	assert.Equal(t, 4, dataCount)
+
+	_, low := FECRedundancy(FEC_REED_SOLOMON, 0)
+	_, high := FECRedundancy(FEC_REED_SOLOMON, 0.1)
+	_, extreme := FECRedundancy(FEC_REED_SOLOMON, 1)
+	assert.Equal(t, 1, low)
+	assert.Equal(t, 5, high)
+	assert.Equal(t, FEC_MAX_PARITY, extreme)
+}
+
+func TestAckCarriesLoss(t *testing.T) {
+	ack := CreateAck(CreateDatagram(testSession, 1, 0, []byte("data"), 0), 0, nil)
+	assert.Equal(t, 0.0, ack.Loss())
+	ack.SetLoss(0.25)
+	assert.InDelta(t, 0.25, ack.Loss(), 1.0/256)
+	ack.SetLoss(3)
+	assert.InDelta(t, 1, ack.Loss(), 1.0/256)
+}
@@ -0,0 +1,74 @@
+package packet
+
+const (
+	// Which datagram a fragment is part of, following the prefix; the
+	// sender numbers them afresh for each datagram it splits
+	FRAGMENT_GROUP_POINTER = PREFIX_SIZE
+	FRAGMENT_GROUP_SIZE    = 8
+
+	// Which piece of it this is, and how many pieces there are
+	FRAGMENT_INDEX_POINTER = FRAGMENT_GROUP_POINTER + FRAGMENT_GROUP_SIZE
+	FRAGMENT_INDEX_SIZE    = 1
+
+	FRAGMENT_COUNT_POINTER = FRAGMENT_INDEX_POINTER + FRAGMENT_INDEX_SIZE
+	FRAGMENT_COUNT_SIZE    = 1
+
+	FRAGMENT_HEADER_SIZE = FRAGMENT_COUNT_POINTER + FRAGMENT_COUNT_SIZE
+
+	// Most pieces a datagram can be split into
+	MAX_FRAGMENTS = 255
+)
+
+// A piece of a datagram cut before the path narrowed, too big for it now.
+// Each piece is sealed on its own, and the receiver puts the whole datagram
+// back together before it takes it in.
+type Fragment []byte
+
+// Splits datagram into fragments of at most size bytes, all in group. The
+// datagram must fit in MAX_FRAGMENTS of them.
+func SplitDatagram(session SessionID, group uint64, datagram []byte, size int) []Fragment {
+	room := size - FRAGMENT_HEADER_SIZE
+	count := (len(datagram) + room - 1) / room
+
+	fragments := make([]Fragment, 0, count)
+	for index := 0; index < count; index++ {
+		piece := datagram[index*room:]
+		if len(piece) > room {
+			piece = piece[:room]
+		}
+		fragment := Fragment(make([]byte, FRAGMENT_HEADER_SIZE+len(piece)))
+		fragment.Prefix().SetVersion(WIRE_VERSION)
+		fragment.Prefix().SetKind(KIND_FRAGMENT)
+		fragment.Prefix().SetSession(session)
+		fragment.SetGroup(group)
+		fragment[FRAGMENT_INDEX_POINTER] = byte(index)
+		fragment[FRAGMENT_COUNT_POINTER] = byte(count)
+		copy(fragment[FRAGMENT_HEADER_SIZE:], piece)
+		fragments = append(fragments, fragment)
+	}
+	return fragments
+}
+
+func (f Fragment) Prefix() Prefix {
+	return Prefix(f)
+}
+
+func (f Fragment) Group() uint64 {
+	return bytesToUint64(f[FRAGMENT_GROUP_POINTER : FRAGMENT_GROUP_POINTER+FRAGMENT_GROUP_SIZE])
+}
+func (f Fragment) SetGroup(group uint64) {
+	copy(f[FRAGMENT_GROUP_POINTER:FRAGMENT_GROUP_POINTER+FRAGMENT_GROUP_SIZE], uint64ToBytes(group))
+}
+
+func (f Fragment) Index() int {
+	return int(f[FRAGMENT_INDEX_POINTER])
+}
+
+func (f Fragment) Count() int {
+	return int(f[FRAGMENT_COUNT_POINTER])
+}
+
+// This fragment's piece of the datagram
+func (f Fragment) Piece() []byte {
+	return f[FRAGMENT_HEADER_SIZE:]
+}
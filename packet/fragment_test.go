@@ -0,0 +1,31 @@
+package packet
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitDatagram(t *testing.T) {
+	datagram := bytes.Repeat([]byte("0123456789"), 250)
+	fragments := SplitDatagram(testSession, 4, datagram, 1200)
+	assert.Len(t, fragments, 3)
+
+	var joined []byte
+	for i, fragment := range fragments {
+		assert.True(t, len(fragment) <= 1200)
+		assert.True(t, fragment.Prefix().WellFormed())
+		assert.Equal(t, KIND_FRAGMENT, fragment.Prefix().Kind())
+		assert.Equal(t, testSession, fragment.Prefix().Session())
+		assert.Equal(t, uint64(4), fragment.Group())
+		assert.Equal(t, i, fragment.Index())
+		assert.Equal(t, 3, fragment.Count())
+		joined = append(joined, fragment.Piece()...)
+	}
+	assert.Equal(t, datagram, joined)
+
+	assert.False(t, fragments[0][:FRAGMENT_HEADER_SIZE-1].Prefix().WellFormed())
+	fragments[0][FRAGMENT_INDEX_POINTER] = 3
+	assert.False(t, fragments[0].Prefix().WellFormed())
+}
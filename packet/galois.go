@@ -0,0 +1,95 @@
+package packet
+
+// Arithmetic in GF(2^8), the field Reed-Solomon parity is computed over.
+// Addition is XOR; multiplication goes through log and exp tables.
+
+// x^8 + x^4 + x^3 + x^2 + 1
+const GALOIS_POLYNOMIAL = 0x11d
+
+var (
+	galoisExp [510]byte
+	galoisLog [256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		galoisExp[i] = byte(x)
+		galoisExp[i+255] = byte(x)
+		galoisLog[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= GALOIS_POLYNOMIAL
+		}
+	}
+}
+
+func galoisMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return galoisExp[int(galoisLog[a])+int(galoisLog[b])]
+}
+
+// Callers never pass 0
+func galoisInv(a byte) byte {
+	return galoisExp[255-int(galoisLog[a])]
+}
+
+// dst ^= c * src, byte by byte
+func galoisMulAdd(dst []byte, c byte, src []byte) {
+	if c == 0 {
+		return
+	}
+	if c == 1 {
+		for i := range src {
+			dst[i] ^= src[i]
+		}
+		return
+	}
+	logC := int(galoisLog[c])
+	for i, b := range src {
+		if b != 0 {
+			dst[i] ^= galoisExp[logC+int(galoisLog[b])]
+		}
+	}
+}
+
+// Inverts a square matrix by Gauss-Jordan elimination, returning false if
+// it's singular. The matrix is destroyed.
+func galoisInvert(matrix [][]byte) ([][]byte, bool) {
+	size := len(matrix)
+	inverse := make([][]byte, size)
+	for i := range inverse {
+		inverse[i] = make([]byte, size)
+		inverse[i][i] = 1
+	}
+
+	for col := 0; col < size; col++ {
+		pivot := col
+		for pivot < size && matrix[pivot][col] == 0 {
+			pivot++
+		}
+		if pivot == size {
+			return nil, false
+		}
+		matrix[col], matrix[pivot] = matrix[pivot], matrix[col]
+		inverse[col], inverse[pivot] = inverse[pivot], inverse[col]
+
+		scale := galoisInv(matrix[col][col])
+		for j := 0; j < size; j++ {
+			matrix[col][j] = galoisMul(matrix[col][j], scale)
+			inverse[col][j] = galoisMul(inverse[col][j], scale)
+		}
+
+		for row := 0; row < size; row++ {
+			if row == col || matrix[row][col] == 0 {
+				continue
+			}
+			factor := matrix[row][col]
+			galoisMulAdd(matrix[row], factor, matrix[col])
+			galoisMulAdd(inverse[row], factor, inverse[col])
+		}
+	}
+	return inverse, true
+}
@@ -0,0 +1,137 @@
+package packet
+
+import "crypto/rand"
+
+const (
+	// Largest datagram the sender proposes, or the receiver agrees to
+	HANDSHAKE_DATAGRAM_SIZE_POINTER = PREFIX_SIZE
+	HANDSHAKE_DATAGRAM_SIZE_SIZE    = 4
+
+	// Optional features the sender asks for, or the receiver agrees to
+	HANDSHAKE_OPTIONS_POINTER = HANDSHAKE_DATAGRAM_SIZE_POINTER + HANDSHAKE_DATAGRAM_SIZE_SIZE
+	HANDSHAKE_OPTIONS_SIZE    = 4
+
+	// Fresh randomness from each side, so a sealed session's keys are its
+	// own even when the session ID comes round again
+	HANDSHAKE_NONCE_POINTER = HANDSHAKE_OPTIONS_POINTER + HANDSHAKE_OPTIONS_SIZE
+	HANDSHAKE_NONCE_SIZE    = 16
+
+	// Codecs the sender may compress the stream with, or the receiver
+	// agrees it may
+	HANDSHAKE_CODECS_POINTER = HANDSHAKE_NONCE_POINTER + HANDSHAKE_NONCE_SIZE
+	HANDSHAKE_CODECS_SIZE    = 1
+
+	HANDSHAKE_SIZE = HANDSHAKE_CODECS_POINTER + HANDSHAKE_CODECS_SIZE
+)
+
+// Bitfield of optional protocol features. The receiver answers a SYN with
+// the subset of the sender's options it supports.
+type Options uint32
+
+const (
+	// Full-duplex stream: both sides send datagrams, with acks riding along
+	OPTION_STREAM Options = 1 << 0
+	// Parity datagrams follow blocks of data, so the receiver can rebuild
+	// losses without waiting for a retransmit
+	OPTION_FEC Options = 1 << 1
+	// Every packet after the handshake is sealed with the named AEAD, keyed
+	// from a secret both sides already share
+	OPTION_AES_GCM           Options = 1 << 2
+	OPTION_CHACHA20_POLY1305 Options = 1 << 3
+
+	// The sealing keys come from an ephemeral X25519 exchange signed by
+	// each side's ed25519 identity, rather than from the pre-shared key alone
+	OPTION_KEY_EXCHANGE Options = 1 << 4
+
+	// The SYN names its content, and the SYN-ACK answers with the ranges of
+	// it the receiver doesn't already hold from an earlier transfer
+	OPTION_RESUME Options = 1 << 5
+
+	OPTION_CIPHERS    = OPTION_AES_GCM | OPTION_CHACHA20_POLY1305
+	SUPPORTED_OPTIONS = OPTION_STREAM | OPTION_FEC | OPTION_CIPHERS | OPTION_KEY_EXCHANGE | OPTION_RESUME
+)
+
+// SYN and SYN-ACK; the sender proposes, the receiver settles
+type Handshake []byte
+
+func NewHandshake() Handshake {
+	return make([]byte, HANDSHAKE_SIZE)
+}
+
+func CreateSyn(session SessionID, datagramSize int, options Options) Handshake {
+	return createHandshake(KIND_SYN, session, datagramSize, options)
+}
+
+// Answers a SYN, settling on the smaller datagram size and the options and
+// codecs both sides support
+func CreateSynAck(syn Handshake, maxDatagramSize int, supported Options) Handshake {
+	datagramSize := syn.DatagramSize()
+	if datagramSize > maxDatagramSize {
+		datagramSize = maxDatagramSize
+	}
+	synAck := createHandshake(KIND_SYN_ACK, syn.Prefix().Session(), datagramSize, syn.Options()&supported)
+	synAck.SetCodecs(syn.Codecs() & SUPPORTED_CODECS)
+	if synAck.Options()&OPTION_RESUME != 0 {
+		synAck.SetContent(syn.Content())
+	}
+	return synAck
+}
+
+func createHandshake(kind Kind, session SessionID, datagramSize int, options Options) Handshake {
+	size := HANDSHAKE_SIZE
+	if options&OPTION_KEY_EXCHANGE != 0 {
+		size = EXCHANGE_HANDSHAKE_SIZE
+	}
+	if options&OPTION_RESUME != 0 && kind == KIND_SYN {
+		size += RESUME_SYN_SIZE
+	} else if options&OPTION_RESUME != 0 {
+		// Missing nothing, until WithMissing says otherwise
+		size += RESUME_SYN_ACK_SIZE
+	}
+
+	handshake := make(Handshake, size)
+	handshake.Prefix().SetVersion(WIRE_VERSION)
+	handshake.Prefix().SetKind(kind)
+	handshake.Prefix().SetSession(session)
+	handshake.SetDatagramSize(datagramSize)
+	handshake.SetOptions(options)
+	return handshake
+}
+
+func (h Handshake) Prefix() Prefix {
+	return Prefix(h)
+}
+
+func (h Handshake) DatagramSize() int {
+	return int(bytesToUint32(h[HANDSHAKE_DATAGRAM_SIZE_POINTER : HANDSHAKE_DATAGRAM_SIZE_POINTER+HANDSHAKE_DATAGRAM_SIZE_SIZE]))
+}
+func (h Handshake) SetDatagramSize(size int) {
+	copy(h[HANDSHAKE_DATAGRAM_SIZE_POINTER:HANDSHAKE_DATAGRAM_SIZE_POINTER+HANDSHAKE_DATAGRAM_SIZE_SIZE], uint32ToBytes(uint32(size)))
+}
+
+func (h Handshake) Options() Options {
+	return Options(bytesToUint32(h[HANDSHAKE_OPTIONS_POINTER : HANDSHAKE_OPTIONS_POINTER+HANDSHAKE_OPTIONS_SIZE]))
+}
+func (h Handshake) SetOptions(options Options) {
+	copy(h[HANDSHAKE_OPTIONS_POINTER:HANDSHAKE_OPTIONS_POINTER+HANDSHAKE_OPTIONS_SIZE], uint32ToBytes(uint32(options)))
+}
+
+func (h Handshake) Nonce() []byte {
+	return h[HANDSHAKE_NONCE_POINTER : HANDSHAKE_NONCE_POINTER+HANDSHAKE_NONCE_SIZE]
+}
+func (h Handshake) SetNonce(nonce []byte) {
+	copy(h[HANDSHAKE_NONCE_POINTER:HANDSHAKE_NONCE_POINTER+HANDSHAKE_NONCE_SIZE], nonce)
+}
+
+func (h Handshake) Codecs() Codecs {
+	return Codecs(h[HANDSHAKE_CODECS_POINTER])
+}
+func (h Handshake) SetCodecs(codecs Codecs) {
+	h[HANDSHAKE_CODECS_POINTER] = byte(codecs)
+}
+
+// Fills in a random nonce
+func (h Handshake) RandomizeNonce() error {
+	_, err := rand.Read(h.Nonce())
+	return err
+}
@@ -0,0 +1,38 @@
+package packet
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionIDsRandom(t *testing.T) {
+	first, err := NewSessionID()
+	assert.Nil(t, err)
+	second, _ := NewSessionID()
+	assert.NotEqual(t, first, second)
+}
+
+func TestSynAckNegotiates(t *testing.T) {
+	syn := CreateSyn(testSession, 9000, Options(0x5))
+	assert.Equal(t, KIND_SYN, syn.Prefix().Kind())
+	assert.True(t, syn.Prefix().WellFormed())
+
+	synAck := CreateSynAck(syn, DATAGRAM_SIZE, Options(0x6))
+	assert.Equal(t, KIND_SYN_ACK, synAck.Prefix().Kind())
+	assert.Equal(t, testSession, synAck.Prefix().Session())
+	assert.Equal(t, DATAGRAM_SIZE, synAck.DatagramSize())
+	assert.Equal(t, Options(0x4), synAck.Options())
+}
+
+func TestSynAckKeepsSmallerProposal(t *testing.T) {
+	syn := CreateSyn(testSession, 1200, 0)
+	synAck := CreateSynAck(syn, DATAGRAM_SIZE, SUPPORTED_OPTIONS)
+	assert.Equal(t, 1200, synAck.DatagramSize())
+}
+
+func TestWrongVersionMalformed(t *testing.T) {
+	syn := CreateSyn(testSession, DATAGRAM_SIZE, 0)
+	syn.Prefix().SetVersion(WIRE_VERSION - 1)
+	assert.False(t, syn.Prefix().WellFormed())
+}
@@ -0,0 +1,65 @@
+package packet
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	// Pre-shared keys, and the session keys derived from them, are 256 bits
+	KEY_SIZE = 32
+
+	// Argon2id cost of turning a passphrase into a key (RFC 9106's second
+	// recommended option)
+	PASSPHRASE_TIME    = 3
+	PASSPHRASE_MEMORY  = 64 * 1024
+	PASSPHRASE_THREADS = 4
+)
+
+// Both ends have to derive the same key from a passphrase with nothing
+// else to go on, so the salt is fixed; the session nonces keep every
+// session's keys distinct
+var PASSPHRASE_SALT = []byte("faart pre-shared passphrase")
+
+var ErrKeyFile = errors.New("key file must hold 32 bytes, raw or hex encoded")
+
+// Reads a pre-shared key from path, as 32 raw bytes or 64 hex digits
+func LoadKey(path string) ([]byte, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(contents) == KEY_SIZE {
+		return contents, nil
+	}
+
+	key, err := hex.DecodeString(string(bytes.TrimSpace(contents)))
+	if err != nil || len(key) != KEY_SIZE {
+		return nil, ErrKeyFile
+	}
+	return key, nil
+}
+
+// Stretches a passphrase into a pre-shared key
+func PassphraseKey(passphrase string) []byte {
+	return argon2.IDKey([]byte(passphrase), PASSPHRASE_SALT, PASSPHRASE_TIME, PASSPHRASE_MEMORY, PASSPHRASE_THREADS, KEY_SIZE)
+}
+
+// The pre-shared key from a key file or passphrase, whichever is given, as
+// commands take them; nil if neither is
+func KeyFrom(path, passphrase string) ([]byte, error) {
+	switch {
+	case path != "" && passphrase != "":
+		return nil, errors.New("pass a key file or a passphrase, not both")
+	case path != "":
+		return LoadKey(path)
+	case passphrase != "":
+		return PassphraseKey(passphrase), nil
+	default:
+		return nil, nil
+	}
+}
@@ -0,0 +1,115 @@
+package packet
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+)
+
+const (
+	// Wire format version; 2 widened sequences, offsets and counts to 64
+	// bits, 3 added the kind and session prefix and the handshake, 4 added
+	// parity datagrams and the loss rate to acks, 5 added the handshake
+	// nonces and sealed packets, 6 added the key exchange, 7 added resuming
+	// and the stream length to the FIN, 8 added the stream digest to the FIN
+	// and the status to acks, 9 added codecs to the handshake, 10 added the
+	// receive window to acks, 11 added the close, 12 added path MTU probes,
+	// 13 added fragments
+	WIRE_VERSION = 13
+
+	// Every packet, whatever its kind, starts with the same prefix
+	VERSION_POINTER = 0
+	VERSION_SIZE    = 1
+
+	KIND_POINTER = VERSION_POINTER + VERSION_SIZE
+	KIND_SIZE    = 1
+
+	SESSION_POINTER = KIND_POINTER + KIND_SIZE
+	SESSION_SIZE    = 8
+
+	PREFIX_SIZE = SESSION_POINTER + SESSION_SIZE
+)
+
+// What a packet is, so both directions can share one socket
+type Kind byte
+
+const (
+	KIND_SYN       Kind = 1
+	KIND_SYN_ACK   Kind = 2
+	KIND_DATA      Kind = 3
+	KIND_ACK       Kind = 4
+	KIND_PARITY    Kind = 5
+	KIND_CLOSE     Kind = 6
+	KIND_PROBE     Kind = 7
+	KIND_PROBE_ACK Kind = 8
+	KIND_FRAGMENT  Kind = 9
+)
+
+// Randomly chosen by the sender for each transfer, and carried by every packet
+type SessionID uint64
+
+func NewSessionID() (SessionID, error) {
+	var id [SESSION_SIZE]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return 0, err
+	}
+	return SessionID(binary.LittleEndian.Uint64(id[:])), nil
+}
+
+type Prefix []byte
+
+// The sender's last word on a session, once it has heard the receiver's
+// verdict, so the receiver can stop answering the FIN. Just the prefix.
+func CreateClose(session SessionID) Prefix {
+	prefix := Prefix(make([]byte, PREFIX_SIZE))
+	prefix.SetVersion(WIRE_VERSION)
+	prefix.SetKind(KIND_CLOSE)
+	prefix.SetSession(session)
+	return prefix
+}
+
+// Whether the packet speaks this wire version and is long enough for its kind
+func (p Prefix) WellFormed() bool {
+	if len(p) < PREFIX_SIZE || p.Version() != WIRE_VERSION {
+		return false
+	}
+
+	switch p.Kind() {
+	case KIND_SYN, KIND_SYN_ACK:
+		return Handshake(p).fits()
+	case KIND_DATA:
+		return len(p) >= HEADER_SIZE
+	case KIND_ACK:
+		return len(p) >= ACK_SIZE
+	case KIND_PARITY:
+		return len(p) >= PARITY_HEADER_SIZE+SHARD_HEADER_SIZE
+	case KIND_CLOSE:
+		return true
+	case KIND_PROBE, KIND_PROBE_ACK:
+		return len(p) >= PROBE_SIZE
+	case KIND_FRAGMENT:
+		return len(p) >= FRAGMENT_HEADER_SIZE && Fragment(p).Index() < Fragment(p).Count()
+	default:
+		return false
+	}
+}
+
+func (p Prefix) Version() byte {
+	return p[VERSION_POINTER]
+}
+func (p Prefix) SetVersion(version byte) {
+	p[VERSION_POINTER] = version
+}
+
+func (p Prefix) Kind() Kind {
+	return Kind(p[KIND_POINTER])
+}
+func (p Prefix) SetKind(kind Kind) {
+	p[KIND_POINTER] = byte(kind)
+}
+
+func (p Prefix) Session() SessionID {
+	return SessionID(bytesToUint64(p[SESSION_POINTER : SESSION_POINTER+SESSION_SIZE]))
+}
+func (p Prefix) SetSession(session SessionID) {
+	copy(p[SESSION_POINTER:SESSION_POINTER+SESSION_SIZE], uint64ToBytes(uint64(session)))
+}
@@ -0,0 +1,48 @@
+package packet
+
+const (
+	// Which probe this is, following the prefix; the rest of a probe is
+	// padding out to the size being tried
+	PROBE_ID_POINTER = PREFIX_SIZE
+	PROBE_ID_SIZE    = 8
+
+	// A probe ack is just this much, whatever the size of the probe
+	PROBE_SIZE = PROBE_ID_POINTER + PROBE_ID_SIZE
+)
+
+// A datagram carrying nothing of the stream, sent only to learn whether the
+// path takes datagrams of its size (RFC 8899). The receiver answers each
+// one with a probe ack carrying the same ID.
+type Probe []byte
+
+// A probe padded out to size bytes
+func CreateProbe(session SessionID, id uint64, size int) Probe {
+	if size < PROBE_SIZE {
+		size = PROBE_SIZE
+	}
+	probe := Probe(make([]byte, size))
+	probe.Prefix().SetVersion(WIRE_VERSION)
+	probe.Prefix().SetKind(KIND_PROBE)
+	probe.Prefix().SetSession(session)
+	probe.SetID(id)
+	return probe
+}
+
+// Says probe got through
+func CreateProbeAck(probe Probe) Probe {
+	ack := Probe(make([]byte, PROBE_SIZE))
+	copy(ack, probe[:PROBE_SIZE])
+	ack.Prefix().SetKind(KIND_PROBE_ACK)
+	return ack
+}
+
+func (p Probe) Prefix() Prefix {
+	return Prefix(p)
+}
+
+func (p Probe) ID() uint64 {
+	return bytesToUint64(p[PROBE_ID_POINTER : PROBE_ID_POINTER+PROBE_ID_SIZE])
+}
+func (p Probe) SetID(id uint64) {
+	copy(p[PROBE_ID_POINTER:PROBE_ID_POINTER+PROBE_ID_SIZE], uint64ToBytes(id))
+}
@@ -0,0 +1,24 @@
+package packet
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProbeRoundTrip(t *testing.T) {
+	probe := CreateProbe(testSession, 9, 1400)
+	assert.Len(t, probe, 1400)
+	assert.Equal(t, KIND_PROBE, probe.Prefix().Kind())
+	assert.Equal(t, uint64(9), probe.ID())
+	assert.True(t, probe.Prefix().WellFormed())
+
+	// However big the probe, its ack is small
+	ack := CreateProbeAck(probe)
+	assert.Len(t, ack, PROBE_SIZE)
+	assert.Equal(t, KIND_PROBE_ACK, ack.Prefix().Kind())
+	assert.Equal(t, testSession, ack.Prefix().Session())
+	assert.Equal(t, uint64(9), ack.ID())
+	assert.True(t, ack.Prefix().WellFormed())
+	assert.False(t, ack[:PROBE_SIZE-1].Prefix().WellFormed())
+}
@@ -0,0 +1,143 @@
+package packet
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"math"
+	"runtime"
+)
+
+const (
+	// With OPTION_RESUME, the SYN goes on to name the content being sent,
+	// after any key exchange. The SYN-ACK echoes it, followed by the byte
+	// ranges of the compressed stream the receiver is still missing.
+	RESUME_CONTENT_SIZE = sha256.Size
+
+	RESUME_RANGE_COUNT_SIZE = 2
+	RESUME_RANGE_SIZE       = 16
+
+	// Holes past this many are folded into the last range, which the
+	// sender fills in whole
+	RESUME_MAX_RANGES = 32
+
+	RESUME_SYN_SIZE         = RESUME_CONTENT_SIZE
+	RESUME_SYN_ACK_SIZE     = RESUME_CONTENT_SIZE + RESUME_RANGE_COUNT_SIZE
+	RESUME_SYN_ACK_MAX_SIZE = RESUME_SYN_ACK_SIZE + RESUME_MAX_RANGES*RESUME_RANGE_SIZE
+)
+
+// Ends the last range a receiver is missing, which runs to the end of
+// the stream however long it turns out to be
+const STREAM_END = OffsetVal(math.MaxUint64)
+
+// Names the bytes a sender streams, so a receiver can tell a transfer it
+// has part of when it comes round again
+type ContentID [RESUME_CONTENT_SIZE]byte
+
+// Bytes [Start, End) of a compressed stream
+type ByteRange struct {
+	Start OffsetVal
+	End   OffsetVal
+}
+
+func (r ByteRange) Contains(offset OffsetVal) bool {
+	return r.Start <= offset && offset < r.End
+}
+
+// The ID of whatever r yields. The compressed stream is only the same if
+// the compressor is, so the Go release that built the sender counts too.
+func ContentIDOf(r io.Reader) (ContentID, error) {
+	hash := sha256.New()
+	hash.Write([]byte("faart content " + runtime.Version() + "\x00"))
+	if _, err := io.Copy(hash, r); err != nil {
+		return ContentID{}, err
+	}
+
+	var id ContentID
+	copy(id[:], hash.Sum(nil))
+	return id, nil
+}
+
+// Where the resume fields start: after the key exchange, if there is one
+func (h Handshake) resumePointer() int {
+	if h.Options()&OPTION_KEY_EXCHANGE != 0 {
+		return EXCHANGE_HANDSHAKE_SIZE
+	}
+	return HANDSHAKE_SIZE
+}
+
+func (h Handshake) Content() ContentID {
+	var id ContentID
+	copy(id[:], h[h.resumePointer():])
+	return id
+}
+func (h Handshake) SetContent(id ContentID) {
+	copy(h[h.resumePointer():], id[:])
+}
+
+func (h Handshake) rangeCountPointer() int {
+	return h.resumePointer() + RESUME_CONTENT_SIZE
+}
+
+// Ranges a SYN-ACK says the receiver is missing, in order
+func (h Handshake) Missing() []ByteRange {
+	pointer := h.rangeCountPointer()
+	count := int(binary.LittleEndian.Uint16(h[pointer : pointer+RESUME_RANGE_COUNT_SIZE]))
+	pointer += RESUME_RANGE_COUNT_SIZE
+
+	ranges := make([]ByteRange, count)
+	for i := range ranges {
+		ranges[i].Start = OffsetVal(bytesToUint64(h[pointer : pointer+OFFSET_SIZE]))
+		ranges[i].End = OffsetVal(bytesToUint64(h[pointer+OFFSET_SIZE : pointer+RESUME_RANGE_SIZE]))
+		pointer += RESUME_RANGE_SIZE
+	}
+	return ranges
+}
+
+// A copy of the SYN-ACK listing ranges as missing. Anything past
+// RESUME_MAX_RANGES is folded into the last range listed.
+func (h Handshake) WithMissing(ranges []ByteRange) Handshake {
+	if len(ranges) > RESUME_MAX_RANGES {
+		folded := append([]ByteRange(nil), ranges[:RESUME_MAX_RANGES]...)
+		folded[RESUME_MAX_RANGES-1].End = ranges[len(ranges)-1].End
+		ranges = folded
+	}
+
+	pointer := h.rangeCountPointer()
+	withRanges := make(Handshake, pointer+RESUME_RANGE_COUNT_SIZE+len(ranges)*RESUME_RANGE_SIZE)
+	copy(withRanges, h)
+	binary.LittleEndian.PutUint16(withRanges[pointer:], uint16(len(ranges)))
+	pointer += RESUME_RANGE_COUNT_SIZE
+
+	for _, r := range ranges {
+		copy(withRanges[pointer:], uint64ToBytes(uint64(r.Start)))
+		copy(withRanges[pointer+OFFSET_SIZE:], uint64ToBytes(uint64(r.End)))
+		pointer += RESUME_RANGE_SIZE
+	}
+	return withRanges
+}
+
+// Whether a handshake is long enough for everything its options say
+// follows the fixed fields
+func (h Handshake) fits() bool {
+	if len(h) < HANDSHAKE_SIZE {
+		return false
+	}
+	size := h.resumePointer()
+	if len(h) < size {
+		return false
+	}
+	if h.Options()&OPTION_RESUME == 0 {
+		return true
+	}
+
+	if h.Prefix().Kind() == KIND_SYN {
+		return len(h) >= size+RESUME_SYN_SIZE
+	}
+	size = h.rangeCountPointer()
+	if len(h) < size+RESUME_RANGE_COUNT_SIZE {
+		return false
+	}
+	count := int(binary.LittleEndian.Uint16(h[size : size+RESUME_RANGE_COUNT_SIZE]))
+	return count <= RESUME_MAX_RANGES && len(h) >= size+RESUME_RANGE_COUNT_SIZE+count*RESUME_RANGE_SIZE
+}
@@ -0,0 +1,65 @@
+package packet
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestResumeHandshake(t *testing.T) {
+	id, err := ContentIDOf(bytes.NewReader([]byte("some content")))
+	require.NoError(t, err)
+	other, _ := ContentIDOf(bytes.NewReader([]byte("other content")))
+	assert.NotEqual(t, id, other)
+
+	for _, options := range []Options{OPTION_RESUME, OPTION_RESUME | OPTION_KEY_EXCHANGE} {
+		syn := CreateSyn(testSession, DATAGRAM_SIZE, options)
+		syn.SetContent(id)
+		assert.True(t, syn.Prefix().WellFormed())
+		assert.False(t, syn[:len(syn)-1].Prefix().WellFormed())
+
+		synAck := CreateSynAck(syn, DATAGRAM_SIZE, SUPPORTED_OPTIONS)
+		assert.Equal(t, id, synAck.Content())
+		assert.Empty(t, synAck.Missing())
+
+		missing := []ByteRange{{0, 10}, {20, 30}, {40, STREAM_END}}
+		synAck = synAck.WithMissing(missing)
+		assert.True(t, synAck.Prefix().WellFormed())
+		assert.False(t, synAck[:len(synAck)-1].Prefix().WellFormed())
+		assert.Equal(t, missing, synAck.Missing())
+		assert.Equal(t, id, synAck.Content())
+	}
+}
+
+func TestResumeFoldsExtraRanges(t *testing.T) {
+	var missing []ByteRange
+	for i := 0; i < RESUME_MAX_RANGES+5; i++ {
+		missing = append(missing, ByteRange{OffsetVal(i * 10), OffsetVal(i*10 + 5)})
+	}
+	missing = append(missing, ByteRange{1000, STREAM_END})
+
+	synAck := CreateSynAck(CreateSyn(testSession, DATAGRAM_SIZE, OPTION_RESUME), DATAGRAM_SIZE, SUPPORTED_OPTIONS)
+	listed := synAck.WithMissing(missing).Missing()
+	assert.Len(t, listed, RESUME_MAX_RANGES)
+	assert.Equal(t, missing[:RESUME_MAX_RANGES-1], listed[:RESUME_MAX_RANGES-1])
+	assert.Equal(t, ByteRange{missing[RESUME_MAX_RANGES-1].Start, STREAM_END}, listed[RESUME_MAX_RANGES-1])
+}
+
+func TestExchangeSignsMissingRanges(t *testing.T) {
+	_, identity, _ := ed25519.GenerateKey(nil)
+	syn := CreateSyn(testSession, DATAGRAM_SIZE, OPTION_KEY_EXCHANGE|OPTION_RESUME)
+	_, err := syn.Exchange(identity, nil)
+	require.NoError(t, err)
+
+	synAck := CreateSynAck(syn, DATAGRAM_SIZE, SUPPORTED_OPTIONS).WithMissing([]ByteRange{{100, STREAM_END}})
+	_, err = synAck.Exchange(identity, syn)
+	require.NoError(t, err)
+	assert.True(t, synAck.VerifyExchange(syn))
+
+	// Claiming more is held than really is
+	synAck[len(synAck)-RESUME_RANGE_SIZE] ^= 1
+	assert.False(t, synAck.VerifyExchange(syn))
+}
@@ -0,0 +1,295 @@
+package packet
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// Sealed packets keep the prefix in the clear and follow it with their
+	// own sequence number. Retransmissions reuse a datagram's sequence, so
+	// this one is counted per packet put on the wire instead; it makes the
+	// nonce and keys replay protection.
+	SEAL_SEQUENCE_POINTER = PREFIX_SIZE
+	SEAL_SEQUENCE_SIZE    = 8
+
+	SEALED_HEADER_SIZE = SEAL_SEQUENCE_POINTER + SEAL_SEQUENCE_SIZE
+
+	// The AEAD tag ends every sealed packet, and takes the place of the
+	// checksum data and parity datagrams otherwise carry
+	SEAL_TAG_SIZE = 16
+
+	// How much bigger sealing makes a data or parity datagram
+	SEAL_OVERHEAD = SEAL_SEQUENCE_SIZE + SEAL_TAG_SIZE - CHECKSUM_SIZE
+
+	// Sequences this far behind the highest one opened are turned away
+	// whether or not they were seen
+	REPLAY_WINDOW = 8192
+)
+
+// AEAD a session's packets are sealed with
+type Cipher byte
+
+const (
+	CIPHER_AES_GCM           Cipher = 1
+	CIPHER_CHACHA20_POLY1305 Cipher = 2
+)
+
+var (
+	ErrCipher  = errors.New("unknown cipher")
+	ErrKeySize = fmt.Errorf("keys must be %d bytes", KEY_SIZE)
+)
+
+func (c Cipher) Valid() bool {
+	return c == CIPHER_AES_GCM || c == CIPHER_CHACHA20_POLY1305
+}
+
+func (c Cipher) String() string {
+	switch c {
+	case CIPHER_AES_GCM:
+		return "aes-gcm"
+	case CIPHER_CHACHA20_POLY1305:
+		return "chacha20-poly1305"
+	default:
+		return fmt.Sprintf("cipher(%d)", byte(c))
+	}
+}
+
+// Handshake option asking for packets sealed with c
+func (c Cipher) Option() Options {
+	switch c {
+	case CIPHER_AES_GCM:
+		return OPTION_AES_GCM
+	case CIPHER_CHACHA20_POLY1305:
+		return OPTION_CHACHA20_POLY1305
+	default:
+		return 0
+	}
+}
+
+// The cipher options asks for, or 0 if packets go in the clear
+func CipherOf(options Options) Cipher {
+	switch {
+	case options&OPTION_AES_GCM != 0:
+		return CIPHER_AES_GCM
+	case options&OPTION_CHACHA20_POLY1305 != 0:
+		return CIPHER_CHACHA20_POLY1305
+	default:
+		return 0
+	}
+}
+
+func ParseCipher(name string) (Cipher, error) {
+	switch name {
+	case "aes-gcm", "aes":
+		return CIPHER_AES_GCM, nil
+	case "chacha20-poly1305", "chacha20":
+		return CIPHER_CHACHA20_POLY1305, nil
+	default:
+		return 0, fmt.Errorf("unknown cipher %q", name)
+	}
+}
+
+// Seals every packet one end of a session sends, and opens every packet it
+// receives, turning away any that were forged, tampered with or replayed.
+// A nil Sealer leaves packets in the clear. Safe for concurrent use.
+type Sealer struct {
+	seal cipher.AEAD
+	open cipher.AEAD
+
+	lock   sync.Mutex
+	sent   uint64
+	replay replayWindow
+}
+
+// Derives the session's keys from a secret both ends hold, whether the
+// pre-shared key, the key exchange's or both, and from everything the SYN
+// and SYN-ACK said. There's one key for each direction. The initiator is
+// the end that sent the SYN.
+func NewSealer(c Cipher, secret []byte, syn, synAck Handshake, initiator bool) (*Sealer, error) {
+	if !c.Valid() {
+		return nil, ErrCipher
+	}
+	if len(secret) < KEY_SIZE {
+		return nil, ErrKeySize
+	}
+
+	salt := append(append([]byte(nil), syn.Nonce()...), synAck.Nonce()...)
+	transcript := sha256.New()
+	transcript.Write(syn)
+	transcript.Write(synAck)
+	info := append([]byte("faart session keys"), byte(c))
+	info = transcript.Sum(info)
+	keys := hkdf.New(sha256.New, secret, salt, info)
+
+	var sendKey, recvKey [KEY_SIZE]byte
+	if _, err := io.ReadFull(keys, sendKey[:]); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(keys, recvKey[:]); err != nil {
+		return nil, err
+	}
+	if !initiator {
+		sendKey, recvKey = recvKey, sendKey
+	}
+
+	s := &Sealer{}
+	var err error
+	if s.seal, err = newAEAD(c, sendKey[:]); err != nil {
+		return nil, err
+	}
+	if s.open, err = newAEAD(c, recvKey[:]); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func newAEAD(c Cipher, key []byte) (cipher.AEAD, error) {
+	if c == CIPHER_CHACHA20_POLY1305 {
+		return chacha20poly1305.New(key)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypts and authenticates a packet of any kind, dropping its checksum
+// since the tag covers everything
+func (s *Sealer) Seal(raw []byte) []byte {
+	if s == nil {
+		return raw
+	}
+
+	s.lock.Lock()
+	s.sent++
+	sequence := s.sent
+	s.lock.Unlock()
+
+	body := raw[PREFIX_SIZE:]
+	if pointer, ok := checksumPointer(Prefix(raw).Kind()); ok && len(raw) >= pointer+CHECKSUM_SIZE {
+		body = make([]byte, 0, len(raw)-PREFIX_SIZE-CHECKSUM_SIZE)
+		body = append(body, raw[PREFIX_SIZE:pointer]...)
+		body = append(body, raw[pointer+CHECKSUM_SIZE:]...)
+	}
+
+	sealed := make([]byte, SEALED_HEADER_SIZE, SEALED_HEADER_SIZE+len(body)+SEAL_TAG_SIZE)
+	copy(sealed, raw[:PREFIX_SIZE])
+	binary.LittleEndian.PutUint64(sealed[SEAL_SEQUENCE_POINTER:], sequence)
+	return s.seal.Seal(sealed, nonce(s.seal, sequence), body, sealed[:SEALED_HEADER_SIZE])
+}
+
+// Authenticates and decrypts a sealed packet, returning false if it was
+// forged, tampered with or has been opened before. Checksums come back
+// zeroed, so opened packets are never validated against them.
+func (s *Sealer) Open(sealed []byte) ([]byte, bool) {
+	if s == nil {
+		return sealed, true
+	}
+	if len(sealed) < SEALED_HEADER_SIZE+SEAL_TAG_SIZE {
+		return nil, false
+	}
+
+	sequence := binary.LittleEndian.Uint64(sealed[SEAL_SEQUENCE_POINTER:SEALED_HEADER_SIZE])
+	body, err := s.open.Open(nil, nonce(s.open, sequence), sealed[SEALED_HEADER_SIZE:], sealed[:SEALED_HEADER_SIZE])
+	if err != nil {
+		return nil, false
+	}
+
+	// Only authentic packets may move the window, or forgeries could
+	// push it past the real ones
+	s.lock.Lock()
+	fresh := s.replay.accept(sequence)
+	s.lock.Unlock()
+	if !fresh {
+		return nil, false
+	}
+
+	raw := make([]byte, 0, PREFIX_SIZE+len(body)+CHECKSUM_SIZE)
+	raw = append(raw, sealed[:PREFIX_SIZE]...)
+	if pointer, ok := checksumPointer(Prefix(sealed).Kind()); ok {
+		split := pointer - PREFIX_SIZE
+		if len(body) < split {
+			return nil, false
+		}
+		raw = append(raw, body[:split]...)
+		raw = append(raw, make([]byte, CHECKSUM_SIZE)...)
+		body = body[split:]
+	}
+	return append(raw, body...), true
+}
+
+// Where a kind of packet keeps its checksum, if it has one
+func checksumPointer(kind Kind) (int, bool) {
+	switch kind {
+	case KIND_DATA:
+		return CHECKSUM_POINTER, true
+	case KIND_PARITY:
+		return PARITY_CHECKSUM_POINTER, true
+	default:
+		return 0, false
+	}
+}
+
+// Each direction has its own key, so the sequence alone keeps nonces unique
+func nonce(aead cipher.AEAD, sequence uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.LittleEndian.PutUint64(nonce[len(nonce)-SEAL_SEQUENCE_SIZE:], sequence)
+	return nonce
+}
+
+// Which of the last REPLAY_WINDOW sequences have been seen (RFC 6479)
+type replayWindow struct {
+	highest uint64
+	seen    [REPLAY_WINDOW / 64]uint64
+}
+
+// Marks sequence as seen, returning false if it already was or is too old
+// to tell. Sequences start at 1.
+func (w *replayWindow) accept(sequence uint64) bool {
+	if sequence == 0 || sequence+REPLAY_WINDOW <= w.highest {
+		return false
+	}
+
+	if sequence > w.highest {
+		// Forget whatever the window slides past
+		if sequence-w.highest >= REPLAY_WINDOW {
+			w.seen = [REPLAY_WINDOW / 64]uint64{}
+		} else {
+			for seq := w.highest + 1; seq <= sequence; seq++ {
+				w.clear(seq)
+			}
+		}
+		w.highest = sequence
+	} else if w.has(sequence) {
+		return false
+	}
+
+	w.set(sequence)
+	return true
+}
+
+func (w *replayWindow) has(seq uint64) bool {
+	bit := seq % REPLAY_WINDOW
+	return w.seen[bit/64]&(1<<(bit%64)) != 0
+}
+
+func (w *replayWindow) set(seq uint64) {
+	bit := seq % REPLAY_WINDOW
+	w.seen[bit/64] |= 1 << (bit % 64)
+}
+
+func (w *replayWindow) clear(seq uint64) {
+	bit := seq % REPLAY_WINDOW
+	w.seen[bit/64] &^= 1 << (bit % 64)
+}
@@ -0,0 +1,136 @@
+package packet
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testKey = bytes.Repeat([]byte{7}, KEY_SIZE)
+
+// Both ends of a session sealed with c
+func sealerPair(t *testing.T, c Cipher) (*Sealer, *Sealer) {
+	syn := CreateSyn(testSession, DATAGRAM_SIZE, c.Option())
+	require.NoError(t, syn.RandomizeNonce())
+	synAck := CreateSynAck(syn, DATAGRAM_SIZE, SUPPORTED_OPTIONS)
+	require.NoError(t, synAck.RandomizeNonce())
+
+	initiator, err := NewSealer(c, testKey, syn, synAck, true)
+	require.NoError(t, err)
+	responder, err := NewSealer(c, testKey, syn, synAck, false)
+	require.NoError(t, err)
+	return initiator, responder
+}
+
+func TestSealRoundTrip(t *testing.T) {
+	for _, c := range []Cipher{CIPHER_AES_GCM, CIPHER_CHACHA20_POLY1305} {
+		initiator, responder := sealerPair(t, c)
+
+		datagram := CreateDatagram(testSession, 3, 3*PACKET_SIZE, []byte("secret data"), 0)
+		sealed := initiator.Seal(datagram)
+		assert.Len(t, sealed, len(datagram)+SEAL_OVERHEAD, c.String())
+		assert.False(t, bytes.Contains(sealed, []byte("secret data")), c.String())
+		assert.Equal(t, Prefix(datagram)[:PREFIX_SIZE], Prefix(sealed)[:PREFIX_SIZE], c.String())
+
+		opened, ok := responder.Open(sealed)
+		require.True(t, ok, c.String())
+		assert.Equal(t, datagram.Payload(), Datagram(opened).Payload(), c.String())
+		assert.Equal(t, datagram.Headers().Sequence(), Datagram(opened).Headers().Sequence(), c.String())
+		assert.True(t, Datagram(opened).Consistent(), c.String())
+
+		ack := CreateAck(datagram, 4, nil)
+		opened, ok = initiator.Open(responder.Seal(ack))
+		require.True(t, ok, c.String())
+		assert.Equal(t, []byte(ack), opened, c.String())
+
+		// Nothing but the prefix to seal
+		close := CreateClose(testSession)
+		opened, ok = responder.Open(initiator.Seal(close))
+		require.True(t, ok, c.String())
+		assert.Equal(t, []byte(close), opened, c.String())
+		assert.True(t, Prefix(opened).WellFormed(), c.String())
+	}
+}
+
+func TestSealRejectsTampering(t *testing.T) {
+	initiator, responder := sealerPair(t, CIPHER_AES_GCM)
+	datagram := CreateDatagram(testSession, 0, 0, []byte("data"), 0)
+
+	for _, pointer := range []int{KIND_POINTER, SESSION_POINTER, SEAL_SEQUENCE_POINTER, SEALED_HEADER_SIZE + 2} {
+		sealed := initiator.Seal(datagram)
+		sealed[pointer] ^= 1
+		_, ok := responder.Open(sealed)
+		assert.False(t, ok, "flipped byte %d", pointer)
+	}
+
+	// Nor does a side open what it sealed itself
+	_, ok := initiator.Open(initiator.Seal(datagram))
+	assert.False(t, ok)
+}
+
+func TestSealRejectsReplays(t *testing.T) {
+	initiator, responder := sealerPair(t, CIPHER_CHACHA20_POLY1305)
+	datagram := CreateDatagram(testSession, 0, 0, []byte("data"), 0)
+
+	first := initiator.Seal(datagram)
+	second := initiator.Seal(datagram)
+	_, ok := responder.Open(second)
+	assert.True(t, ok)
+	_, ok = responder.Open(first)
+	assert.True(t, ok, "late but unseen")
+	_, ok = responder.Open(first)
+	assert.False(t, ok, "replayed")
+	_, ok = responder.Open(second)
+	assert.False(t, ok, "replayed")
+}
+
+func TestReplayWindowSlides(t *testing.T) {
+	var window replayWindow
+	assert.False(t, window.accept(0))
+	assert.True(t, window.accept(5))
+	assert.True(t, window.accept(REPLAY_WINDOW+4))
+	assert.False(t, window.accept(4), "fell out of the window")
+	assert.True(t, window.accept(6))
+	assert.False(t, window.accept(6))
+
+	// Far enough ahead to forget everything
+	assert.True(t, window.accept(3*REPLAY_WINDOW+6))
+	assert.True(t, window.accept(2*REPLAY_WINDOW+7))
+	assert.False(t, window.accept(2*REPLAY_WINDOW+6))
+}
+
+func TestLoadKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "faart-key")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	raw := filepath.Join(dir, "raw")
+	require.NoError(t, ioutil.WriteFile(raw, testKey, 0600))
+	key, err := LoadKey(raw)
+	require.NoError(t, err)
+	assert.Equal(t, testKey, key)
+
+	encoded := filepath.Join(dir, "hex")
+	require.NoError(t, ioutil.WriteFile(encoded, []byte(hex.EncodeToString(testKey)+"\n"), 0600))
+	key, err = LoadKey(encoded)
+	require.NoError(t, err)
+	assert.Equal(t, testKey, key)
+
+	short := filepath.Join(dir, "short")
+	require.NoError(t, ioutil.WriteFile(short, []byte("hunter2\n"), 0600))
+	_, err = LoadKey(short)
+	assert.Equal(t, ErrKeyFile, err)
+}
+
+func TestPassphraseKey(t *testing.T) {
+	key := PassphraseKey("correct horse battery staple")
+	assert.Len(t, key, KEY_SIZE)
+	assert.Equal(t, key, PassphraseKey("correct horse battery staple"))
+	assert.NotEqual(t, key, PassphraseKey("correct horse battery stapler"))
+}
@@ -0,0 +1,151 @@
+package faart
+
+import (
+	"sync/atomic"
+
+	"github.com/djreed/faart/packet"
+)
+
+// Cuts a byte stream into datagrams as it is written, handing each one off
+// as soon as it fills, so the stream never has to be held in memory
+type packetizer struct {
+	buffer []byte
+
+	session packet.SessionID
+	// Most bytes of the stream in each datagram; path MTU discovery raises
+	// it from whichever goroutine hears a probe answered, hence atomic
+	packetSize int32
+
+	nextSeq    packet.SeqID
+	nextOffset packet.OffsetVal
+
+	// Set when resuming: only these ranges of the stream are sent, and
+	// the rest is passed over
+	filtered bool
+	wanted   []packet.ByteRange
+
+	queue func(packet.Datagram) error
+}
+
+func newPacketizer(session packet.SessionID, packetSize int, queue func(packet.Datagram) error) *packetizer {
+	return newPacketizerAt(session, packetSize, 0, 0, queue)
+}
+
+// Starts numbering the stream from seq and offset rather than zero
+func newPacketizerAt(session packet.SessionID, packetSize int, seq packet.SeqID, offset packet.OffsetVal, queue func(packet.Datagram) error) *packetizer {
+	return &packetizer{
+		buffer:     make([]byte, 0, packetSize),
+		session:    session,
+		packetSize: int32(packetSize),
+		nextSeq:    seq,
+		nextOffset: offset,
+		queue:      queue,
+	}
+}
+
+// Sends only the given ranges of the stream, in order, from here on;
+// datagrams are cut short where a range ends
+func (p *packetizer) only(ranges []packet.ByteRange) {
+	p.filtered = true
+	p.wanted = ranges
+}
+
+func (p *packetizer) Write(data []byte) (int, error) {
+	p.buffer = append(p.buffer, data...)
+	if err := p.cut(false); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// Sends whatever partial packet is left over
+func (p *packetizer) Flush() error {
+	return p.cut(true)
+}
+
+// Emits every full packet in the buffer, along with any partial one that
+// ends a wanted range or, if final, the stream
+func (p *packetizer) cut(final bool) error {
+	sent := 0
+	defer func() {
+		p.buffer = append(p.buffer[:0], p.buffer[sent:]...)
+	}()
+
+	for {
+		skip, run, ends := p.span(len(p.buffer) - sent)
+		sent += skip
+		p.nextOffset += packet.OffsetVal(skip)
+
+		size := p.size()
+		if run > size {
+			run = size
+		}
+		if run == 0 || (run < size && !ends && !final) {
+			return nil
+		}
+		if err := p.emit(p.buffer[sent : sent+run]); err != nil {
+			return err
+		}
+		sent += run
+	}
+}
+
+// Splits the next available bytes of the stream into a leading stretch
+// that isn't wanted and the wanted run after it, and says whether the run
+// ends a wanted range
+func (p *packetizer) span(available int) (skip int, run int, ends bool) {
+	if !p.filtered {
+		return 0, available, false
+	}
+	for len(p.wanted) > 0 && p.wanted[0].End <= p.nextOffset {
+		p.wanted = p.wanted[1:]
+	}
+	if len(p.wanted) == 0 {
+		return available, 0, false
+	}
+
+	next := p.wanted[0]
+	if next.Start > p.nextOffset {
+		skip = available
+		if gap := next.Start - p.nextOffset; gap < packet.OffsetVal(available) {
+			skip = int(gap)
+		}
+	}
+	run = available - skip
+	start := p.nextOffset + packet.OffsetVal(skip)
+	if left := next.End - start; left <= packet.OffsetVal(run) {
+		return skip, int(left), true
+	}
+	return skip, run, false
+}
+
+func (p *packetizer) size() int {
+	return int(atomic.LoadInt32(&p.packetSize))
+}
+
+// Cuts datagrams with room for size bytes of the stream from here on
+func (p *packetizer) resize(size int) {
+	atomic.StoreInt32(&p.packetSize, int32(size))
+}
+
+// Number of datagrams in the stream so far
+func (p *packetizer) Count() packet.PacketCount {
+	return packet.PacketCount(p.nextSeq)
+}
+
+// Bytes of the stream so far, whether they were sent or passed over
+func (p *packetizer) Length() packet.OffsetVal {
+	return p.nextOffset + packet.OffsetVal(len(p.buffer))
+}
+
+func (p *packetizer) emit(data []byte) error {
+	// The total isn't known until the stream ends; the FIN carries it instead
+	datagram := packet.CreateDatagram(p.session, p.nextSeq, p.nextOffset, data, 0)
+	if err := p.queue(datagram); err != nil {
+		// Never sent, so the same sequence goes to the next attempt
+		return err
+	}
+	p.nextSeq++
+	p.nextOffset += packet.OffsetVal(len(data))
+	return nil
+}
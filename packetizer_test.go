@@ -0,0 +1,145 @@
+package faart
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+
+	"github.com/djreed/faart/packet"
+	"github.com/stretchr/testify/assert"
+)
+
+const testSession = packet.SessionID(0xFAA27)
+
+func collect(datagrams *[]packet.Datagram) func(packet.Datagram) error {
+	return func(dg packet.Datagram) error {
+		*datagrams = append(*datagrams, dg)
+		return nil
+	}
+}
+
+// Deterministic bytes that never repeat on a packet boundary
+type syntheticSource struct {
+	position uint64
+}
+
+func (s *syntheticSource) Read(buffer []byte) (int, error) {
+	for i := range buffer {
+		buffer[i] = byte(s.position*7 + s.position>>11)
+		s.position++
+	}
+	return len(buffer), nil
+}
+
+func TestPacketizerCutsFullPackets(t *testing.T) {
+	var datagrams []packet.Datagram
+	packets := newPacketizer(testSession, packet.PACKET_SIZE, collect(&datagrams))
+
+	io.CopyN(packets, &syntheticSource{}, 3*packet.PACKET_SIZE+10)
+	assert.Len(t, datagrams, 3)
+	packets.Flush()
+	assert.Len(t, datagrams, 4)
+
+	assert.Equal(t, packet.PacketLen(10), datagrams[3].Headers().Length())
+	assert.Equal(t, testSession, datagrams[3].Headers().Session())
+	assert.Equal(t, packet.PacketCount(4), packets.Count())
+}
+
+func TestPacketizerNegotiatedSize(t *testing.T) {
+	var datagrams []packet.Datagram
+	packets := newPacketizer(testSession, 100, collect(&datagrams))
+
+	io.CopyN(packets, &syntheticSource{}, 250)
+	packets.Flush()
+	assert.Len(t, datagrams, 3)
+	assert.Len(t, datagrams[0], packet.HEADER_SIZE+100)
+	assert.Equal(t, packet.OffsetVal(200), datagrams[2].Headers().Offset())
+}
+
+func TestPacketizerAcross32Bits(t *testing.T) {
+	// Start a few packets short of where a 32 bit offset and sequence would wrap
+	startSeq := packet.SeqID(1<<32 - 3)
+	startOffset := packet.OffsetVal(1<<32 - 2*packet.PACKET_SIZE - 100)
+
+	var datagrams []packet.Datagram
+	packets := newPacketizerAt(testSession, packet.PACKET_SIZE, startSeq, startOffset, collect(&datagrams))
+
+	var source bytes.Buffer
+	io.CopyN(io.MultiWriter(packets, &source), &syntheticSource{}, 6*packet.PACKET_SIZE+1)
+	packets.Flush()
+	assert.Len(t, datagrams, 7)
+
+	offset := startOffset
+	var stream []byte
+	for i, datagram := range datagrams {
+		assert.Equal(t, startSeq+packet.SeqID(i), datagram.Headers().Sequence())
+		assert.Equal(t, offset, datagram.Headers().Offset())
+		assert.True(t, datagram.Validate())
+
+		length := datagram.Headers().Length()
+		stream = append(stream, datagram.Packet()[:length]...)
+		offset += packet.OffsetVal(length)
+	}
+
+	assert.True(t, datagrams[6].Headers().Sequence() > 1<<32)
+	assert.True(t, datagrams[6].Headers().Offset() > 1<<32)
+	assert.Equal(t, source.Bytes(), stream)
+}
+
+func TestPacketizerSkipsHeldRanges(t *testing.T) {
+	var datagrams []packet.Datagram
+	packets := newPacketizer(testSession, 100, collect(&datagrams))
+	packets.only([]packet.ByteRange{{Start: 50, End: 180}, {Start: 300, End: packet.STREAM_END}})
+
+	var source bytes.Buffer
+	io.CopyN(io.MultiWriter(packets, &source), &syntheticSource{}, 420)
+	packets.Flush()
+
+	// Cut short where the first range ends, and numbered without gaps
+	var offsets []packet.OffsetVal
+	var lengths []packet.PacketLen
+	for i, datagram := range datagrams {
+		assert.Equal(t, packet.SeqID(i), datagram.Headers().Sequence())
+		offset := datagram.Headers().Offset()
+		length := datagram.Headers().Length()
+		assert.Equal(t, source.Bytes()[offset:offset+packet.OffsetVal(length)], []byte(datagram.Payload()))
+		offsets = append(offsets, offset)
+		lengths = append(lengths, length)
+	}
+	assert.Equal(t, []packet.OffsetVal{50, 150, 300, 400}, offsets)
+	assert.Equal(t, []packet.PacketLen{100, 30, 100, 20}, lengths)
+	assert.Equal(t, packet.OffsetVal(420), packets.Length())
+}
+
+func TestPacketizerStreamsCompressedInput(t *testing.T) {
+	var datagrams []packet.Datagram
+	packets := newPacketizer(testSession, packet.PACKET_SIZE, collect(&datagrams))
+	compressor, err := packet.NewCompressor(packets, packet.CODEC_GZIP, 9)
+	assert.NoError(t, err)
+
+	// Input that doesn't compress goes out in packets as it's written,
+	// rather than held until the end
+	var source bytes.Buffer
+	random := rand.New(rand.NewSource(4))
+	for i := 0; i < 64; i++ {
+		io.CopyN(io.MultiWriter(compressor, &source), random, 4096)
+	}
+	cut := len(datagrams)
+	assert.True(t, cut > 64*4096/packet.PACKET_SIZE/2, "only %d packets cut", cut)
+
+	assert.NoError(t, compressor.Close())
+	assert.NoError(t, packets.Flush())
+	assert.True(t, len(datagrams) > cut)
+
+	var stream []byte
+	for _, datagram := range datagrams {
+		stream = append(stream, datagram.Payload()...)
+	}
+	decompressor, err := packet.NewDecompressor(bytes.NewReader(stream), packet.CodecsOf(packet.CODEC_GZIP))
+	assert.NoError(t, err)
+	decompressed, err := ioutil.ReadAll(decompressor)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(source.Bytes(), decompressed))
+}
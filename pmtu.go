@@ -0,0 +1,136 @@
+package faart
+
+import (
+	"time"
+
+	"github.com/djreed/faart/packet"
+	"github.com/djreed/faart/shared"
+)
+
+// Times a probe size is tried before it's taken to be too big for the path
+// (RFC 8899's MAX_PROBES)
+const PMTU_MAX_PROBES = 3
+
+// The search stops once the largest datagram known to get through is within
+// this many bytes of the smallest known not to
+const PMTU_SEARCH_GRANULARITY = 16
+
+// Path MTU discovery for a sender (DPLPMTUD, RFC 8899): works out the
+// largest datagram the path carries, between the size every path is taken
+// to carry and the most the handshake settled on. Probes are padded
+// datagrams carrying nothing of the stream, sent one at a time, so losing
+// one costs neither data nor congestion window. The ceiling is tried first,
+// since on most paths it works; after that, each failure halves the gap.
+// Each try at a size waits twice as long as the last to be answered, and an
+// answer to any of them counts, so a slow path isn't mistaken for a narrow one.
+// A path that narrows later starts the search over from base.
+// Not safe for concurrent use; the send half's stateLock guards it.
+type pmtuSearch struct {
+	// What every path is taken to carry
+	base int
+	// The largest datagram known to get through, which data goes out at
+	size int
+	// The smallest known not to, or one past the ceiling until a probe fails
+	tooBig int
+	failed bool
+
+	// The size being probed, if non-zero, the ids of its tries so far, and
+	// how many of them have gone unanswered
+	probing  int
+	firstID  uint64
+	probeID  uint64
+	attempts int
+}
+
+func newPMTUSearch(base, ceiling int) *pmtuSearch {
+	if base > ceiling {
+		base = ceiling
+	}
+	return &pmtuSearch{base: base, size: base, tooBig: ceiling + 1}
+}
+
+// The next probe to send: the one awaiting an answer again if it went
+// unanswered, or a new size. False once the search is over.
+func (s *pmtuSearch) probe() (uint64, int, bool) {
+	if s.probing == 0 {
+		switch {
+		case !s.failed && s.tooBig-1 > s.size:
+			s.probing = s.tooBig - 1
+		case s.failed && s.tooBig-s.size > PMTU_SEARCH_GRANULARITY:
+			s.probing = (s.size + s.tooBig) / 2
+		default:
+			return 0, 0, false
+		}
+		s.firstID = s.probeID + 1
+	}
+	s.probeID++
+	return s.probeID, s.probing, true
+}
+
+// Takes in the answer to probe id, returning whether it raised the size
+func (s *pmtuSearch) acked(id uint64) bool {
+	if s.probing == 0 || id < s.firstID || id > s.probeID {
+		return false
+	}
+	s.size = s.probing
+	s.probing = 0
+	s.attempts = 0
+	return true
+}
+
+// Counts probe id as lost, if it's still the one awaiting an answer,
+// giving up on its size after PMTU_MAX_PROBES tries
+func (s *pmtuSearch) lost(id uint64) bool {
+	if s.probing == 0 || id != s.probeID {
+		return false
+	}
+	s.attempts++
+	if s.attempts >= PMTU_MAX_PROBES {
+		s.tooBig = s.probing
+		s.failed = true
+		s.probing = 0
+		s.attempts = 0
+	}
+	return true
+}
+
+// Drops back to base once datagrams of the size found have stopped getting
+// through, and searches again below it. Any probe out is forgotten, so an
+// answer to it can't raise the size again.
+func (s *pmtuSearch) narrowed() {
+	s.tooBig = s.size
+	s.failed = true
+	s.size = s.base
+	s.probing = 0
+	s.attempts = 0
+}
+
+// How long the latest probe has to be answered: rto, doubled for each try
+// at its size gone unanswered, up to shared.MAX_RTO
+func (s *pmtuSearch) timeout(rto time.Duration) time.Duration {
+	for i := 0; i < s.attempts && rto < shared.MAX_RTO; i++ {
+		rto *= 2
+	}
+	if rto > shared.MAX_RTO {
+		return shared.MAX_RTO
+	}
+	return rto
+}
+
+// Room left for data in a datagram of datagramSize; streams leave space for
+// a piggybacked ack, and sealed sessions for the tag
+func payloadSize(datagramSize int, options packet.Options) int {
+	size := datagramSize - packet.HEADER_SIZE - sealOverhead(options)
+	if options&packet.OPTION_STREAM != 0 {
+		size -= packet.ACK_SIZE
+	}
+	return size
+}
+
+// What sealing adds to every packet of a session
+func sealOverhead(options packet.Options) int {
+	if options&packet.OPTION_CIPHERS != 0 {
+		return packet.SEAL_OVERHEAD
+	}
+	return 0
+}
@@ -0,0 +1,25 @@
+package faart
+
+import (
+	"net"
+	"syscall"
+
+	"github.com/djreed/faart/log"
+)
+
+// Sets the don't fragment bit on everything conn sends, whatever the kernel
+// thinks the path MTU is, so that a probe too big for the path is dropped
+// rather than fragmented into getting through (RFC 8899 3)
+func dontFragment(conn *net.UDPConn) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		log.ERR.Printf("[pmtu] %s\n", err)
+		return
+	}
+	raw.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_PROBE)
+	})
+	if err != nil {
+		log.ERR.Printf("[pmtu] can't set don't fragment: %s\n", err)
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package faart
+
+import (
+	"net"
+)
+
+// Left to the platform's defaults, which may fragment probes bigger than
+// the path into getting through
+func dontFragment(conn *net.UDPConn) {}
@@ -0,0 +1,114 @@
+package faart
+
+import (
+	"testing"
+
+	"github.com/djreed/faart/shared"
+	"github.com/stretchr/testify/assert"
+)
+
+// Runs a search against a path that drops anything over mtu, returning
+// where it settled and how many probes it took
+func searchPath(base, ceiling, mtu int) (int, int) {
+	return continueSearch(newPMTUSearch(base, ceiling), mtu)
+}
+
+// Runs s to the end against a path that drops anything over mtu
+func continueSearch(s *pmtuSearch, mtu int) (int, int) {
+	probes := 0
+	for {
+		id, size, ok := s.probe()
+		if !ok {
+			return s.size, probes
+		}
+		probes++
+		if size <= mtu {
+			s.acked(id)
+		} else {
+			s.lost(id)
+		}
+	}
+}
+
+func TestPMTUSearch(t *testing.T) {
+	// The ceiling gets through first time
+	size, probes := searchPath(1200, 1472, 1500)
+	assert.Equal(t, 1472, size)
+	assert.Equal(t, 1, probes)
+
+	// A tunnel somewhere along the way; each size that fails is tried
+	// PMTU_MAX_PROBES times
+	size, _ = searchPath(1200, 9000, 1400)
+	assert.True(t, size <= 1400 && size > 1400-PMTU_SEARCH_GRANULARITY, "settled on %d", size)
+
+	// Nothing past the base, and nothing to search below a small ceiling
+	size, _ = searchPath(1200, 9000, 1000)
+	assert.Equal(t, 1200, size)
+	size, probes = searchPath(1200, 576, 1500)
+	assert.Equal(t, 576, size)
+	assert.Zero(t, probes)
+}
+
+func TestPMTUSearchLateAnswers(t *testing.T) {
+	s := newPMTUSearch(1200, 1472)
+	first, _, _ := s.probe()
+	assert.True(t, s.lost(first))
+	second, size, _ := s.probe()
+	assert.Equal(t, 1472, size)
+	assert.Equal(t, 2*shared.MIN_RTO, s.timeout(shared.MIN_RTO))
+
+	// The first try's answer turns up after the second went out, which is
+	// just as good
+	assert.False(t, s.lost(first))
+	assert.True(t, s.acked(first))
+	assert.Equal(t, 1472, s.size)
+	assert.False(t, s.acked(second))
+	assert.False(t, s.lost(second))
+}
+
+func TestPMTUSearchIgnoresEarlierSizes(t *testing.T) {
+	s := newPMTUSearch(1200, 9000)
+	var stale uint64
+	for i := 0; i < PMTU_MAX_PROBES; i++ {
+		stale, _, _ = s.probe()
+		s.lost(stale)
+	}
+	_, size, _ := s.probe()
+	assert.Equal(t, (1200+9000)/2, size)
+
+	// Far too late for 9000 to count, and nothing to say about 5100
+	assert.False(t, s.acked(stale))
+	assert.Equal(t, 1200, s.size)
+}
+
+func TestPMTUSearchNarrowed(t *testing.T) {
+	s := newPMTUSearch(1200, 1472)
+	size, _ := continueSearch(s, 1500)
+	assert.Equal(t, 1472, size)
+
+	// A route change puts a tunnel in the way; the search starts again
+	// from the base, below what stopped getting through
+	s.narrowed()
+	assert.Equal(t, 1200, s.size)
+	size, _ = continueSearch(s, 1300)
+	assert.True(t, size <= 1300 && size > 1300-PMTU_SEARCH_GRANULARITY, "settled on %d", size)
+
+	// Narrowed partway through the search; the probe out by then no
+	// longer counts
+	s = newPMTUSearch(1200, 9000)
+	for i := 0; i < PMTU_MAX_PROBES; i++ {
+		id, _, _ := s.probe()
+		s.lost(id)
+	}
+	id, _, _ := s.probe()
+	assert.True(t, s.acked(id))
+	assert.Equal(t, 5100, s.size)
+	stale, size, _ := s.probe()
+	assert.Equal(t, 7050, size)
+
+	s.narrowed()
+	assert.False(t, s.acked(stale))
+	assert.Equal(t, 1200, s.size)
+	_, size, _ = s.probe()
+	assert.Equal(t, (1200+5100)/2, size)
+}
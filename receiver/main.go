@@ -1,8 +1,240 @@
 package main
 
-// ./3700recv
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/djreed/faart"
+	"github.com/djreed/faart/archive"
+	"github.com/djreed/faart/identity"
+	"github.com/djreed/faart/log"
+	"github.com/djreed/faart/packet"
+	"github.com/djreed/faart/shared"
+	"golang.org/x/crypto/ed25519"
+)
+
+const SERVE_USAGE = "usage: 3700recv serve [-o template | -d template] [-port N] [-idle duration] [-key file | -passphrase phrase] [-identity file [-authorized-keys file]] [-checkpoints dir]"
+
+const (
+	KEY_USAGE             = "only accept senders sealing every packet with the pre-shared key in this file (32 bytes, raw or hex)"
+	PASSPHRASE_USAGE      = "only accept senders sealing every packet with a key derived from this passphrase"
+	IDENTITY_USAGE        = "only accept senders doing the key exchange, signing this side of it with this private key from faart keygen"
+	AUTHORIZED_KEYS_USAGE = "with -identity, only accept senders whose public keys are listed in this file"
+	CHECKPOINTS_USAGE     = "keep what arrives of each transfer sent with -resume in this directory, so if it's cut short the next attempt picks up where it left off"
+	DIR_USAGE             = "unpack the files and directories 3700send was given into this directory, instead of writing the data out as is"
+	DATAGRAM_SIZE_USAGE   = "largest datagram to take, in bytes; each session probes its way up to the smaller of this and the sender's"
+)
+
+var (
+	outputFlag         = flag.String("o", "", "write received data to this file instead of STDOUT")
+	dirFlag            = flag.String("d", "", DIR_USAGE)
+	portFlag           = flag.Int("port", 0, "UDP port to listen on (0 picks one at random)")
+	keyFlag            = flag.String("key", "", KEY_USAGE)
+	passphraseFlag     = flag.String("passphrase", "", PASSPHRASE_USAGE)
+	identityFlag       = flag.String("identity", "", IDENTITY_USAGE)
+	authorizedKeysFlag = flag.String("authorized-keys", "", AUTHORIZED_KEYS_USAGE)
+	checkpointsFlag    = flag.String("checkpoints", "", CHECKPOINTS_USAGE)
+	datagramFlag       = flag.Int("datagram-size", packet.DATAGRAM_SIZE, DATAGRAM_SIZE_USAGE)
+)
+
+// ./3700recv [-o file | -d dir] [-port N] [-key file | -passphrase phrase] [-identity file [-authorized-keys file]] [-checkpoints dir] [-datagram-size N]
+// ./3700recv serve [-o template | -d template] [-port N] [-idle duration] [-key file | -passphrase phrase] [-identity file [-authorized-keys file]] [-checkpoints dir] [-datagram-size N]
 func main() {
-	if err := receiver(); err != nil {
-		panic(err)
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		if err := serveMain(os.Args[2:]); err != nil {
+			exit(err)
+		}
+		return
+	}
+
+	flag.Parse()
+	config := faart.Config{MaxTransfers: 1, Checkpoints: *checkpointsFlag, DatagramSize: *datagramFlag}
+	if err := secure(&config, *keyFlag, *passphraseFlag, *identityFlag, *authorizedKeysFlag); err != nil {
+		exit(err)
+	}
+
+	if *dirFlag != "" && *outputFlag != "" {
+		exit(errors.New("-o and -d can't both be given"))
+	}
+	into := func(transfer *faart.Transfer) error {
+		_, err := io.Copy(os.Stdout, transfer)
+		return err
+	}
+	if *dirFlag != "" {
+		into = func(transfer *faart.Transfer) error {
+			return archive.Unpack(transfer, *dirFlag)
+		}
+	} else if *outputFlag != "" {
+		into = func(transfer *faart.Transfer) error {
+			return writeFile(*outputFlag, transfer)
+		}
+	}
+
+	if err := receive(into, *portFlag, config); err != nil {
+		exit(err)
+	}
+}
+
+// Receives a single transfer, handing it to into, then returns
+func receive(into func(*faart.Transfer) error, port int, config faart.Config) error {
+	listener, err := listen(port, config)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	transfer, err := listener.Accept()
+	if err != nil {
+		return err
+	}
+	defer transfer.Close()
+
+	return into(transfer)
+}
+
+// Writes everything transfer yields to a temporary file beside path, then
+// renames it into place, so a transfer that fails part way or fails its
+// final check leaves nothing under path
+func writeFile(path string, transfer *faart.Transfer) error {
+	temporary, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+"-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temporary.Name())
+	// As os.Create would have made it, less the umask
+	if err := temporary.Chmod(0644); err != nil {
+		temporary.Close()
+		return err
+	}
+
+	if _, err := io.Copy(temporary, transfer); err != nil {
+		temporary.Close()
+		return err
+	}
+	if err := temporary.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temporary.Name(), path)
+}
+
+// Runs until killed, accepting any number of transfers at once, each
+// written to its own file
+func serveMain(args []string) error {
+	serveFlags := flag.NewFlagSet("serve", flag.ExitOnError)
+	serveFlags.Usage = func() {
+		fmt.Fprintln(serveFlags.Output(), SERVE_USAGE)
+		serveFlags.PrintDefaults()
+	}
+	template := serveFlags.String("o", "faart-{session}.out", "output file for each transfer; {session} and {addr} are filled in")
+	dirTemplate := serveFlags.String("d", "", "unpack each transfer's files and directories into this directory instead; {session} and {addr} are filled in")
+	port := serveFlags.Int("port", 0, "UDP port to listen on (0 picks one at random)")
+	idle := serveFlags.Duration("idle", shared.RECV_READ_TIMEOUT, "evict transfers that go this long without traffic")
+	keyFile := serveFlags.String("key", "", KEY_USAGE)
+	passphrase := serveFlags.String("passphrase", "", PASSPHRASE_USAGE)
+	identityFile := serveFlags.String("identity", "", IDENTITY_USAGE)
+	authorizedKeys := serveFlags.String("authorized-keys", "", AUTHORIZED_KEYS_USAGE)
+	checkpoints := serveFlags.String("checkpoints", "", CHECKPOINTS_USAGE)
+	datagramSize := serveFlags.Int("datagram-size", packet.DATAGRAM_SIZE, DATAGRAM_SIZE_USAGE)
+	serveFlags.Parse(args)
+
+	config := faart.Config{IdleTimeout: *idle, Checkpoints: *checkpoints, DatagramSize: *datagramSize}
+	if err := secure(&config, *keyFile, *passphrase, *identityFile, *authorizedKeys); err != nil {
+		return err
+	}
+	listener, err := listen(*port, config)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	for {
+		transfer, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		if *dirTemplate != "" {
+			go unpackTo(transfer, *dirTemplate)
+		} else {
+			go receiveTo(transfer, *template)
+		}
+	}
+}
+
+// Fills in config's pre-shared key, identity and authorized senders from
+// whichever of the files and passphrase are given
+func secure(config *faart.Config, keyFile, passphrase, identityFile, authorizedKeys string) error {
+	key, err := packet.KeyFrom(keyFile, passphrase)
+	if err != nil {
+		return err
+	}
+	config.Key = key
+
+	if identityFile != "" {
+		if config.Identity, err = identity.LoadPrivateKey(identityFile); err != nil {
+			return err
+		}
+		log.ERR.Printf("[identity] %s\n", identity.Fingerprint(config.Identity.Public().(ed25519.PublicKey)))
+	}
+	if authorizedKeys != "" {
+		if identityFile == "" {
+			return errors.New("-authorized-keys needs -identity, since only the key exchange proves who a sender is")
+		}
+		authorized, err := identity.LoadAuthorizedKeys(authorizedKeys)
+		if err != nil {
+			return err
+		}
+		config.VerifyPeer = authorized.Verify
+	}
+	return nil
+}
+
+func listen(port int, config faart.Config) (*faart.Listener, error) {
+	listener, err := faart.ListenConfig(fmt.Sprintf(":%d", port), config)
+	if err != nil {
+		return nil, err
+	}
+
+	splitAddr := strings.Split(listener.Addr().String(), ":")
+	log.ERR.Printf("[bound] %s", splitAddr[len(splitAddr)-1])
+	return listener, nil
+}
+
+// Writes a transfer to the file named by filling its session and sender's
+// address into template
+func receiveTo(transfer *faart.Transfer, template string) {
+	defer transfer.Close()
+
+	if err := writeFile(outputPath(template, transfer.Session(), transfer.RemoteAddr()), transfer); err != nil {
+		log.ERR.Printf("[failed] %x: %s\n", transfer.Session(), err)
+	}
+}
+
+// Unpacks a transfer's files and directories under the directory named by
+// filling its session and sender's address into template
+func unpackTo(transfer *faart.Transfer, template string) {
+	defer transfer.Close()
+
+	dir := outputPath(template, transfer.Session(), transfer.RemoteAddr())
+	if err := archive.Unpack(transfer, dir); err != nil {
+		log.ERR.Printf("[failed] %x: %s\n", transfer.Session(), err)
 	}
 }
+
+func outputPath(template string, id packet.SessionID, addr net.Addr) string {
+	return strings.NewReplacer(
+		"{session}", fmt.Sprintf("%016x", uint64(id)),
+		"{addr}", strings.Replace(addr.String(), ":", "_", -1),
+	).Replace(template)
+}
+
+func exit(err error) {
+	log.ERR.Printf("[error] %s\n", err)
+	os.Exit(1)
+}
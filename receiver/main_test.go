@@ -0,0 +1,16 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/djreed/faart/packet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutputPath(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4000}
+	session := packet.SessionID(0xFAA27)
+	assert.Equal(t, "out/00000000000faa27-127.0.0.1_4000.bin", outputPath("out/{session}-{addr}.bin", session, addr))
+	assert.Equal(t, "fixed", outputPath("fixed", session, addr))
+}
@@ -0,0 +1,56 @@
+package faart
+
+import (
+	"time"
+
+	"github.com/djreed/faart/log"
+	"github.com/djreed/faart/packet"
+)
+
+const (
+	// Number of later packets that must be SACKed before a hole is
+	// presumed lost (RFC 6675 DupThresh)
+	DUP_THRESH = 3
+)
+
+// Walks the holes below the highest acked sequence and immediately resends
+// any that SACK evidence says are lost, rather than waiting out their RTO.
+// Callers hold stateLock.
+func (h *sendHalf) detectLosses() {
+	srtt := h.rtt.SRTT()
+	threshold := srtt + h.reorderThreshold()
+	latestDelivered := h.rtt.LatestDelivered()
+	now := h.clock.Now()
+
+	sackedAbove := 0
+	for seq := h.highestAcked; seq >= h.cumAcked; seq-- {
+		if h.acked[seq] {
+			sackedAbove++
+		} else if _, inFlight := h.datagrams[seq]; inFlight && !h.fastRetransmitted[seq] {
+			sentAt, sent := h.rtt.SentAt(seq)
+			overdue := sent && srtt > 0 && sentAt.Before(latestDelivered) && now.Sub(sentAt) > threshold
+			if sackedAbove >= DUP_THRESH || overdue {
+				h.fastRetransmit(seq, sackedAbove)
+			}
+		}
+
+		if seq == 0 {
+			break
+		}
+	}
+}
+
+func (h *sendHalf) fastRetransmit(seq packet.SeqID, sackedAbove int) {
+	log.ERR.Printf("[fast retransmit] %d (%d later packets acked)\n", seq, sackedAbove)
+	h.fastRetransmitted[seq] = true
+	h.window.Lost(seq)
+	h.stats.FastRetransmit()
+	h.send(h.datagrams[seq])
+}
+
+func (h *sendHalf) reorderThreshold() time.Duration {
+	if h.reorderWindow > 0 {
+		return h.reorderWindow
+	}
+	return h.rtt.SRTT() / 4
+}
@@ -0,0 +1,164 @@
+package faart
+
+import (
+	"testing"
+	"time"
+
+	"github.com/djreed/faart/packet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// A send half on a virtual clock that records what it puts on the wire
+// rather than sending it anywhere
+type recoveryTest struct {
+	t     *testing.T
+	clock *virtualClock
+	out   *sendHalf
+	// Every datagram by sequence, and how many times each has gone out
+	datagrams map[packet.SeqID]packet.Datagram
+	sends     map[packet.SeqID]int
+}
+
+func newRecoveryTest(t *testing.T, config Config) *recoveryTest {
+	r := &recoveryTest{
+		t:         t,
+		clock:     newVirtualClock(),
+		datagrams: make(map[packet.SeqID]packet.Datagram),
+		sends:     make(map[packet.SeqID]int),
+	}
+	out, err := newSendHalf(config, r.clock)
+	require.NoError(t, err)
+	out.synchronous = true
+	out.attach(testSession, packet.PACKET_SIZE, func(datagram packet.Datagram) error {
+		seq := datagram.Headers().Sequence()
+		r.datagrams[seq] = datagram
+		r.sends[seq]++
+		return nil
+	})
+	r.out = out
+	return r
+}
+
+func (r *recoveryTest) emit(count int) {
+	for i := 0; i < count; i++ {
+		require.NoError(r.t, r.out.packets.emit([]byte("data")))
+	}
+}
+
+// Moves the clock on by d, running whatever comes due on the way
+func (r *recoveryTest) advance(d time.Duration) {
+	at := r.clock.Now().Add(d)
+	r.clock.AfterFunc(d, func() {})
+	for r.clock.Now().Before(at) {
+		require.True(r.t, r.clock.step())
+	}
+}
+
+// Answers seq with everything below cumulative and the rest of received
+func (r *recoveryTest) ack(seq, cumulative packet.SeqID, received ...packet.SeqID) {
+	held := make(map[packet.SeqID]bool)
+	for _, seq := range received {
+		held[seq] = true
+	}
+	ack := packet.CreateAck(r.datagrams[seq], cumulative, held)
+	ack.SetWindow(packet.UNLIMITED_WINDOW)
+	r.out.processAck(ack)
+}
+
+func TestFastRetransmitOnDuplicateSacks(t *testing.T) {
+	quietly(func() {
+		r := newRecoveryTest(t, Config{})
+		r.emit(8)
+		r.advance(100 * time.Millisecond)
+
+		// 1 goes missing. Everything was sent at once, so only the count of
+		// later packets acked can say it's lost.
+		r.ack(0, 1)
+		r.ack(2, 1, 2)
+		r.ack(3, 1, 2, 3)
+		assert.Equal(t, 1, r.sends[1])
+		r.ack(4, 1, 2, 3, 4)
+		assert.Equal(t, 2, r.sends[1], "resent once DUP_THRESH later packets were acked")
+
+		// Further evidence about the same hole doesn't resend it again
+		r.ack(5, 1, 2, 3, 4, 5)
+		r.ack(6, 1, 2, 3, 4, 5, 6)
+		r.ack(7, 1, 2, 3, 4, 5, 6, 7)
+		assert.Equal(t, 2, r.sends[1])
+		assert.Equal(t, uint64(1), r.out.stats.fastRetransmits)
+		assert.Zero(t, r.out.stats.rtoRetransmits)
+
+		// so if the resend is lost too, the RTO is left to find it
+		for r.sends[1] < 3 {
+			require.True(t, r.clock.step())
+		}
+		assert.Equal(t, uint64(1), r.out.stats.fastRetransmits)
+		assert.Equal(t, uint64(1), r.out.stats.rtoRetransmits)
+
+		// Once the hole is filled a new one can be fast retransmitted. The
+		// timeout restarted slow start, so the window only lets a couple
+		// more out at a time.
+		r.ack(1, 8)
+		r.emit(2)
+		r.ack(9, 8, 9)
+		r.emit(1)
+		r.ack(10, 8, 9, 10)
+		r.emit(1)
+		r.ack(11, 8, 9, 10, 11)
+		assert.Equal(t, 2, r.sends[8])
+		assert.Equal(t, uint64(2), r.out.stats.fastRetransmits)
+	})
+}
+
+func TestFastRetransmitOnReorderTimeout(t *testing.T) {
+	// 1 is sent 10ms before 2, and 2 is acked 60ms after 1 went out, over
+	// a 50ms round trip
+	run := func(config Config) *recoveryTest {
+		r := newRecoveryTest(t, config)
+		r.emit(1)
+		r.advance(50 * time.Millisecond)
+		r.ack(0, 1)
+		r.emit(1)
+		r.advance(10 * time.Millisecond)
+		r.emit(1)
+		r.advance(50 * time.Millisecond)
+		r.ack(2, 1, 2)
+		return r
+	}
+
+	quietly(func() {
+		// Within the default SRTT / 4 of being late, so not yet lost
+		r := run(Config{})
+		assert.Equal(t, 1, r.sends[1])
+		assert.Zero(t, r.out.stats.fastRetransmits)
+
+		// A tighter reorder window gives up on it with one later packet acked
+		r = run(Config{Reorder: 5 * time.Millisecond})
+		assert.Equal(t, 2, r.sends[1])
+		assert.Equal(t, uint64(1), r.out.stats.fastRetransmits)
+		assert.Zero(t, r.out.stats.rtoRetransmits)
+	})
+}
+
+func TestRefusalTakesNoRTTSample(t *testing.T) {
+	quietly(func() {
+		r := newRecoveryTest(t, Config{})
+		r.emit(1)
+		r.advance(100 * time.Millisecond)
+
+		// Turned away for want of room: no sample, and still timed from
+		// when it was sent
+		refusal := packet.CreateAck(r.datagrams[0], 0, nil)
+		refusal.SetStatus(packet.ACK_STATUS_NO_ROOM)
+		r.out.processAck(refusal)
+		assert.Zero(t, r.out.rtt.SRTT())
+		sentAt, tracked := r.out.rtt.SentAt(0)
+		assert.True(t, tracked)
+		assert.Equal(t, r.clock.start, sentAt)
+
+		r.advance(50 * time.Millisecond)
+		r.ack(0, 1)
+		assert.Equal(t, 150*time.Millisecond, r.out.rtt.SRTT())
+	})
+}
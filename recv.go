@@ -0,0 +1,298 @@
+package faart
+
+import (
+	"io"
+	"math"
+
+	"github.com/djreed/faart/log"
+	"github.com/djreed/faart/packet"
+	"github.com/djreed/faart/shared"
+)
+
+const RECV_TEMPLATE = "[recv data] %x %d (%d) %s\n"
+
+// Everything needed to put one direction of a session's byte stream back
+// together: reordering, duplicate suppression and what to ack
+type recvHalf struct {
+	id packet.SessionID
+
+	// Datagrams that arrived ahead of a hole, waiting to be written out;
+	// bounded by the sender's window
+	datagrams shared.DataMap
+
+	// Every sequence below cumulative has been received and written out,
+	// along with the sequences in received
+	cumulative packet.SeqID
+	received   shared.AckMap
+
+	nextOffset packet.OffsetVal
+	maxSeqNum  packet.PacketCount
+	// Where the stream ends, and what it hashes to before compression, as
+	// the FIN says; digest is nil if the FIN doesn't say
+	streamLength packet.OffsetVal
+	digest       []byte
+	// Set by the first FIN; the reader may be checking against it by the
+	// time any copy of the FIN arrives
+	finSeen bool
+
+	// Moving estimate of the fraction of datagrams lost on the way, from
+	// the sequences skipped over as new ones arrive
+	loss        float64
+	highestSeen packet.SeqID
+	seenAny     bool
+
+	// Rebuilds lost datagrams from parity; nil unless the session uses FEC
+	fec *fecDecoder
+
+	// Set when datagrams were opened from sealed packets, whose tag already
+	// vouches for them in place of the checksum
+	sealed bool
+
+	// Where the in-order stream goes
+	output io.Writer
+	// Why the stream couldn't be written out; once set, nothing more is
+	// taken in or acked, and the owner fails the session with it
+	err error
+	// Where the in-order stream waits to be read, when that's output. The
+	// room left in it, counted in datagrams past cumulative of packetSize,
+	// the most data any has carried yet, is the window acks advertise; nil
+	// for no limit.
+	limit      *streamBuffer
+	packetSize int
+	// The window as last worked out, and whether the datagram just taken
+	// in fell past it, for the next ack to say so
+	window  uint32
+	refused bool
+	// Keeps every datagram on disk as it arrives, in place of output; nil
+	// unless the transfer can be resumed
+	checkpoint *checkpoint
+}
+
+func newRecvHalf(id packet.SessionID, output io.Writer) recvHalf {
+	return recvHalf{
+		id:        id,
+		datagrams: make(shared.DataMap),
+		received:  make(shared.AckMap),
+		output:    output,
+	}
+}
+
+// Takes in a datagram, returning whether it should be acked and whether it
+// was the FIN
+func (r *recvHalf) acceptDatagram(datagram packet.Datagram) (bool, bool) {
+	if datagram.Headers().Session() != r.id {
+		log.ERR.Printf("[recv unknown session] %x\n", datagram.Headers().Session())
+		return false, false
+	}
+	if r.err != nil {
+		return false, false
+	}
+	r.window = r.room()
+	r.refused = false
+
+	if datagram.Headers().Done() {
+		if !r.intact(datagram) {
+			log.ERR.Printf("[recv corrupt packet] %x\n", r.id)
+			return false, false
+		}
+		// Only the FIN knows how many packets the stream came to
+		if !r.finSeen {
+			r.finSeen = true
+			r.maxSeqNum = datagram.Headers().Count()
+			r.streamLength = datagram.Headers().Offset()
+			r.digest = datagram.Digest()
+		}
+		return true, true
+	}
+
+	seq := datagram.Headers().Sequence()
+	_, existing := r.datagrams[seq]
+	if !existing && seq >= r.cumulative+packet.SeqID(r.window) {
+		// Either a probe or a sender that didn't listen; acked with the
+		// window, but not taken
+		log.ERR.Printf("[recv no room] %x %d (window %d)\n", r.id, datagram.Headers().Offset(), r.window)
+		r.refused = true
+		return true, false
+	}
+	if !existing && seq >= r.cumulative {
+		if !r.intact(datagram) {
+			log.ERR.Printf("[recv corrupt packet] %x\n", r.id)
+			return false, false
+		}
+		// The window is counted in the largest datagrams yet, which grow
+		// as the sender finds the path takes them
+		if length := int(datagram.Headers().Length()); length > r.packetSize {
+			r.packetSize = length
+		}
+		if err := r.checkpoint.save(datagram); err != nil {
+			// Left unacked, so it's sent again
+			log.ERR.Printf("[checkpoint failed] %x: %s\n", r.id, err)
+			return false, false
+		}
+
+		if seq == r.cumulative {
+			log.ERR.Printf(RECV_TEMPLATE, r.id, datagram.Headers().Offset(), datagram.Headers().Length(), shared.ACCEPTED_IN_ORDER)
+		} else {
+			log.ERR.Printf(RECV_TEMPLATE, r.id, datagram.Headers().Offset(), datagram.Headers().Length(), shared.ACCEPTED_OUT_ORDER)
+		}
+		r.trackLoss(seq)
+		r.datagrams[seq] = datagram
+		if r.fec != nil {
+			r.fec.remember(datagram)
+		}
+		if err := r.markReceived(seq); err != nil {
+			// Whatever went out before it is fine, but nothing can follow
+			log.ERR.Printf("[write failed] %x: %s\n", r.id, err)
+			r.err = err
+			return false, false
+		}
+		if r.fec != nil {
+			r.fec.forget(r.cumulative)
+		}
+	} else {
+		log.ERR.Printf(RECV_TEMPLATE, r.id, datagram.Headers().Offset(), datagram.Headers().Length(), shared.IGNORED)
+	}
+	return true, false
+}
+
+// Takes in a parity datagram, returning any datagrams it rebuilt; they
+// still need accepting
+func (r *recvHalf) acceptParity(parity packet.Parity) []packet.Datagram {
+	if r.fec == nil || parity.Prefix().Session() != r.id {
+		return nil
+	}
+	if (r.sealed && !parity.Consistent()) || (!r.sealed && !parity.Validate()) {
+		log.ERR.Printf("[recv corrupt parity] %x\n", r.id)
+		return nil
+	}
+
+	rebuilt := r.fec.acceptParity(r.id, parity)
+	for _, datagram := range rebuilt {
+		log.ERR.Printf("[fec recovered] %x %d (%d)\n", r.id, datagram.Headers().Offset(), datagram.Headers().Length())
+	}
+	return rebuilt
+}
+
+func (r *recvHalf) intact(datagram packet.Datagram) bool {
+	if r.sealed {
+		return datagram.Consistent()
+	}
+	return datagram.Validate()
+}
+
+// Acks datagram along with everything received so far, advertising the
+// window. Straight after acceptDatagram refused datagram, says so instead
+// of acking it.
+func (r *recvHalf) ack(datagram packet.Datagram) packet.Ack {
+	ack := packet.CreateAck(datagram, r.cumulative, r.received)
+	ack.SetLoss(r.loss)
+	r.window = r.room()
+	ack.SetWindow(r.window)
+	if r.refused {
+		ack.SetStatus(packet.ACK_STATUS_NO_ROOM)
+		r.refused = false
+	}
+	return ack
+}
+
+// Acks a path MTU probe. The sender may send datagrams as big as it once it
+// hears, so the window is counted in those from here on, lest it promise
+// room for more than will fit.
+func (r *recvHalf) answerProbe(probe packet.Probe) packet.Probe {
+	if size := len(probe) - packet.HEADER_SIZE; size > r.packetSize {
+		r.packetSize = size
+	}
+	return packet.CreateProbeAck(probe)
+}
+
+// Datagrams past cumulative there's room for. Once the reader has taken
+// everything there's always room for one, or a buffer smaller than a
+// datagram would never take any.
+func (r *recvHalf) room() uint32 {
+	if r.limit == nil {
+		return packet.UNLIMITED_WINDOW
+	}
+	free := r.limit.free()
+	if free == r.limit.capacity && free < r.packetSize {
+		return 1
+	}
+	return uint32(free / r.packetSize)
+}
+
+// Works the window out afresh, returning whether reads have opened it up
+// by a quarter of the buffer since the latest ack advertised it; a sender
+// that ran out of room is waiting to hear that
+func (r *recvHalf) windowOpened() bool {
+	if r.limit == nil {
+		return false
+	}
+	step := uint32(r.limit.capacity / r.packetSize / 4)
+	if step == 0 {
+		step = 1
+	}
+	room := r.room()
+	if room < r.window+step {
+		return false
+	}
+	r.window = room
+	r.refused = false
+	return true
+}
+
+// Counts any sequences skipped over on the way to seq as lost, and seq
+// itself as arrived. Retransmissions and rebuilt datagrams fill in earlier
+// holes, so they don't count either way.
+func (r *recvHalf) trackLoss(seq packet.SeqID) {
+	if r.seenAny && seq <= r.highestSeen {
+		return
+	}
+	skipped := seq
+	if r.seenAny {
+		skipped = seq - r.highestSeen - 1
+	}
+	r.highestSeen = seq
+	r.seenAny = true
+
+	r.loss = 1 - (1-r.loss)*math.Pow(1-LOSS_GAIN, float64(skipped))
+	r.loss -= r.loss * LOSS_GAIN
+}
+
+// Records seq as received, writing out and advancing the cumulative ack
+// point past any run it completes. Stops at the first datagram that can't
+// be written out, returning why.
+func (r *recvHalf) markReceived(seq packet.SeqID) error {
+	r.received[seq] = true
+	for r.received[r.cumulative] {
+		if err := r.writeDatagram(r.datagrams[r.cumulative]); err != nil {
+			return err
+		}
+		delete(r.datagrams, r.cumulative)
+		delete(r.received, r.cumulative)
+		r.cumulative++
+	}
+	return nil
+}
+
+// Appends an in-order datagram's payload to the output stream, unless the
+// checkpoint already has it. One that doesn't start where the stream got
+// to would leave a gap or an overlap, so is refused.
+func (r *recvHalf) writeDatagram(datagram packet.Datagram) error {
+	if r.checkpoint != nil {
+		return nil
+	}
+	offset := datagram.Headers().Offset()
+	if offset != r.nextOffset {
+		log.ERR.Printf("[offset mismatch] %x expected %d, got %d\n", r.id, r.nextOffset, offset)
+		return ErrOffsetMismatch
+	}
+	payload := datagram.Payload()
+	if _, err := r.output.Write(payload); err != nil {
+		return err
+	}
+	r.nextOffset = offset + packet.OffsetVal(len(payload))
+	return nil
+}
+
+func (r *recvHalf) receivedAllPackets() bool {
+	return r.maxSeqNum != 0 && packet.PacketCount(r.cumulative) == r.maxSeqNum
+}
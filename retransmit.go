@@ -0,0 +1,133 @@
+package faart
+
+import (
+	"container/heap"
+	"time"
+
+	"github.com/djreed/faart/packet"
+	"github.com/djreed/faart/shared"
+)
+
+// When each datagram in flight is due to be resent, kept in a min-heap so
+// that a single timer armed for the earliest deadline serves them all.
+// Each unanswered resend doubles the datagram's wait (RFC 6298 5.5), up to
+// shared.MAX_RTO. Not safe for concurrent use; the send half's stateLock
+// guards it.
+type retransmitter struct {
+	deadlines retransmitHeap
+	bySeq     map[packet.SeqID]*retransmission
+}
+
+type retransmission struct {
+	datagram packet.Datagram
+	due      time.Time
+	// The wait before backing off; looked up again on every resend, so
+	// RTT samples taken in the meantime count
+	timeout func() time.Duration
+	// Whether the wait doubles with each resend
+	backoff bool
+	resends uint
+	// Where it sits in the heap, for cancelling
+	index int
+}
+
+func newRetransmitter() *retransmitter {
+	return &retransmitter{bySeq: make(map[packet.SeqID]*retransmission)}
+}
+
+// Resends datagram timeout() after now unless cancelled first, replacing
+// whatever was scheduled for its sequence
+func (r *retransmitter) schedule(datagram packet.Datagram, timeout func() time.Duration, backoff bool, now time.Time) {
+	seq := datagram.Headers().Sequence()
+	r.cancel(seq)
+	entry := &retransmission{datagram: datagram, due: now.Add(timeout()), timeout: timeout, backoff: backoff}
+	heap.Push(&r.deadlines, entry)
+	r.bySeq[seq] = entry
+}
+
+// Forgets seq, once it has been acked
+func (r *retransmitter) cancel(seq packet.SeqID) {
+	entry, ok := r.bySeq[seq]
+	if !ok {
+		return
+	}
+	heap.Remove(&r.deadlines, entry.index)
+	delete(r.bySeq, seq)
+}
+
+// Takes every datagram due by now, earliest first, and schedules each to
+// be resent again after its next, longer wait
+func (r *retransmitter) expired(now time.Time) []packet.Datagram {
+	var due []packet.Datagram
+	for len(r.deadlines) > 0 && !r.deadlines[0].due.After(now) {
+		entry := r.deadlines[0]
+		due = append(due, entry.datagram)
+		if entry.backoff {
+			entry.resends++
+		}
+		entry.due = now.Add(entry.wait())
+		heap.Fix(&r.deadlines, 0)
+	}
+	return due
+}
+
+// Times seq has been resent and backed off, with no ack in between
+func (r *retransmitter) resends(seq packet.SeqID) uint {
+	if entry, ok := r.bySeq[seq]; ok {
+		return entry.resends
+	}
+	return 0
+}
+
+// The earliest deadline, if anything is scheduled
+func (r *retransmitter) next() (time.Time, bool) {
+	if len(r.deadlines) == 0 {
+		return time.Time{}, false
+	}
+	return r.deadlines[0].due, true
+}
+
+func (r *retransmitter) pending() int {
+	return len(r.deadlines)
+}
+
+// The timeout doubled once per resend so far, capped at shared.MAX_RTO
+func (entry *retransmission) wait() time.Duration {
+	wait := entry.timeout()
+	for i := uint(0); i < entry.resends && wait < shared.MAX_RTO; i++ {
+		wait *= 2
+	}
+	if wait > shared.MAX_RTO {
+		return shared.MAX_RTO
+	}
+	return wait
+}
+
+// Orders retransmissions by when they're due, then by sequence
+type retransmitHeap []*retransmission
+
+func (h retransmitHeap) Len() int { return len(h) }
+func (h retransmitHeap) Less(i, j int) bool {
+	if h[i].due.Equal(h[j].due) {
+		return h[i].datagram.Headers().Sequence() < h[j].datagram.Headers().Sequence()
+	}
+	return h[i].due.Before(h[j].due)
+}
+func (h retransmitHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *retransmitHeap) Push(x interface{}) {
+	entry := x.(*retransmission)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *retransmitHeap) Pop() interface{} {
+	old := *h
+	last := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return last
+}
@@ -0,0 +1,71 @@
+package faart
+
+import (
+	"testing"
+	"time"
+
+	"github.com/djreed/faart/packet"
+	"github.com/djreed/faart/shared"
+	"github.com/stretchr/testify/assert"
+)
+
+func sequences(datagrams []packet.Datagram) []packet.SeqID {
+	var seqs []packet.SeqID
+	for _, datagram := range datagrams {
+		seqs = append(seqs, datagram.Headers().Sequence())
+	}
+	return seqs
+}
+
+func TestRetransmitterOrderAndCancel(t *testing.T) {
+	r := newRetransmitter()
+	start := time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+	datagrams, _ := syntheticDatagrams(0, 0, 4)
+	r.schedule(datagrams[2], fixedTimeout(30*time.Millisecond), true, start)
+	r.schedule(datagrams[0], fixedTimeout(20*time.Millisecond), true, start)
+	r.schedule(datagrams[1], fixedTimeout(20*time.Millisecond), true, start)
+	r.schedule(datagrams[3], fixedTimeout(10*time.Millisecond), true, start)
+
+	due, ok := r.next()
+	assert.True(t, ok)
+	assert.Equal(t, start.Add(10*time.Millisecond), due)
+	assert.Empty(t, r.expired(start.Add(5*time.Millisecond)))
+
+	// Acked before its deadline, so never resent
+	r.cancel(3)
+	assert.Equal(t, []packet.SeqID{0, 1}, sequences(r.expired(start.Add(20*time.Millisecond))))
+	r.cancel(0)
+	r.cancel(1)
+	r.cancel(2)
+	assert.Equal(t, 0, r.pending())
+	_, ok = r.next()
+	assert.False(t, ok)
+}
+
+func TestRetransmitterBacksOff(t *testing.T) {
+	r := newRetransmitter()
+	now := time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+	datagrams, _ := syntheticDatagrams(0, 0, 2)
+	r.schedule(datagrams[0], fixedTimeout(time.Second), true, now)
+	r.schedule(datagrams[1], fixedTimeout(time.Second), false, now)
+
+	// Each resend of the first doubles its wait; the second keeps to its own
+	var waits []time.Duration
+	for i := 0; i < 8; i++ {
+		now, _ = r.next()
+		for _, datagram := range r.expired(now) {
+			if datagram.Headers().Sequence() == 0 {
+				due := r.bySeq[0].due
+				waits = append(waits, due.Sub(now))
+			} else {
+				assert.Equal(t, time.Second, r.bySeq[1].due.Sub(now))
+			}
+		}
+	}
+	assert.Equal(t, []time.Duration{2 * time.Second, 4 * time.Second}, waits[:2])
+
+	// and never past MAX_RTO
+	entry := r.bySeq[0]
+	entry.resends = 20
+	assert.Equal(t, shared.MAX_RTO, entry.wait())
+}
@@ -0,0 +1,203 @@
+package faart
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/djreed/faart/netem"
+	"github.com/djreed/faart/packet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ed25519"
+)
+
+var testKey = bytes.Repeat([]byte{7}, packet.KEY_SIZE)
+
+func TestSealedTransfer(t *testing.T) {
+	for _, cipher := range []packet.Cipher{packet.CIPHER_AES_GCM, packet.CIPHER_CHACHA20_POLY1305} {
+		listener, err := ListenConfig("127.0.0.1:0", Config{Key: testKey})
+		require.NoError(t, err)
+
+		var source bytes.Buffer
+		io.CopyN(&source, &syntheticSource{}, 200000)
+
+		sent := make(chan error, 1)
+		go func() {
+			conn, err := DialConfig(context.Background(), listener.Addr().String(), Config{Key: testKey, Cipher: cipher})
+			if err != nil {
+				sent <- err
+				return
+			}
+			if _, err := conn.Write(source.Bytes()); err != nil {
+				sent <- err
+				return
+			}
+			sent <- conn.Close()
+		}()
+
+		transfer, err := listener.Accept()
+		require.NoError(t, err)
+		received, err := ioutil.ReadAll(transfer)
+		assert.NoError(t, err, cipher.String())
+		assert.NoError(t, <-sent, cipher.String())
+		assert.True(t, bytes.Equal(source.Bytes(), received), cipher.String())
+		listener.Close()
+	}
+}
+
+func TestSealedStream(t *testing.T) {
+	listener, err := ListenConfig("127.0.0.1:0", Config{Key: testKey})
+	require.NoError(t, err)
+	defer listener.Close()
+
+	dialled, err := DialStreamConfig(context.Background(), listener.Addr().String(), Config{Key: testKey})
+	require.NoError(t, err)
+	accepted, err := listener.AcceptStream()
+	require.NoError(t, err)
+
+	go func() {
+		dialled.Write([]byte("ping"))
+		dialled.CloseWrite()
+	}()
+	received, err := ioutil.ReadAll(accepted)
+	assert.NoError(t, err)
+	assert.Equal(t, "ping", string(received))
+}
+
+func TestSealingRefused(t *testing.T) {
+	// A listener without the key can't seal anything
+	open, err := Listen("127.0.0.1:0")
+	require.NoError(t, err)
+	defer open.Close()
+	_, err = DialConfig(context.Background(), open.Addr().String(), Config{Key: testKey})
+	assert.Equal(t, ErrSealUnsupported, err)
+
+	// And a listener with one never answers in the clear
+	sealed, err := ListenConfig("127.0.0.1:0", Config{Key: testKey})
+	require.NoError(t, err)
+	defer sealed.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, err = Dial(ctx, sealed.Addr().String())
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	_, err = ListenConfig("127.0.0.1:0", Config{Key: []byte("too short")})
+	assert.Equal(t, packet.ErrKeySize, err)
+}
+
+// Sends a little data from a Conn configured by dialer to a listener
+// configured by listener, returning what each side ended up with
+func exchangeTransfer(t *testing.T, listenerConfig, dialerConfig Config) ([]byte, error) {
+	listener, err := ListenConfig("127.0.0.1:0", listenerConfig)
+	require.NoError(t, err)
+	defer listener.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	conn, err := DialConfig(ctx, listener.Addr().String(), dialerConfig)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		conn.Write([]byte("hello"))
+		conn.Close()
+	}()
+
+	transfer, err := listener.Accept()
+	require.NoError(t, err)
+	return ioutil.ReadAll(transfer)
+}
+
+func TestKeyExchange(t *testing.T) {
+	receiverPublic, receiverIdentity, _ := ed25519.GenerateKey(nil)
+	senderPublic, senderIdentity, _ := ed25519.GenerateKey(nil)
+
+	var sawReceiver, sawSender ed25519.PublicKey
+	received, err := exchangeTransfer(t,
+		Config{Identity: receiverIdentity, VerifyPeer: func(_ string, key ed25519.PublicKey) error {
+			sawSender = key
+			return nil
+		}},
+		Config{Identity: senderIdentity, VerifyPeer: func(_ string, key ed25519.PublicKey) error {
+			sawReceiver = key
+			return nil
+		}},
+	)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(received))
+	assert.Equal(t, receiverPublic, sawReceiver)
+	assert.Equal(t, senderPublic, sawSender)
+
+	// A pre-shared key mixes in, and a throwaway identity will do
+	received, err = exchangeTransfer(t,
+		Config{Identity: receiverIdentity, Key: testKey},
+		Config{Key: testKey, Cipher: packet.CIPHER_CHACHA20_POLY1305, VerifyPeer: func(string, ed25519.PublicKey) error { return nil }},
+	)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(received))
+}
+
+func TestKeyExchangeRefused(t *testing.T) {
+	_, receiverIdentity, _ := ed25519.GenerateKey(nil)
+	_, senderIdentity, _ := ed25519.GenerateKey(nil)
+	errPinned := errors.New("pinned to another key")
+
+	// The sender won't trust the receiver
+	_, err := exchangeTransfer(t,
+		Config{Identity: receiverIdentity},
+		Config{VerifyPeer: func(string, ed25519.PublicKey) error { return errPinned }},
+	)
+	assert.Equal(t, errPinned, err)
+
+	// The receiver has no identity to do the exchange with
+	_, err = exchangeTransfer(t, Config{}, Config{Identity: senderIdentity})
+	assert.Equal(t, ErrSealUnsupported, err)
+
+	// The receiver won't take the sender, or anyone not doing the exchange
+	onlyOthers := Config{Identity: receiverIdentity, VerifyPeer: func(string, ed25519.PublicKey) error { return errPinned }}
+	_, err = exchangeTransfer(t, onlyOthers, Config{Identity: senderIdentity})
+	assert.Equal(t, context.DeadlineExceeded, err)
+	_, err = exchangeTransfer(t, onlyOthers, Config{Key: testKey})
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestSimulateKeyExchange(t *testing.T) {
+	_, identity, _ := ed25519.GenerateKey(nil)
+	sim := Simulation{
+		Size:   128 << 10,
+		Link:   netem.Config{Loss: 0.02, Latency: 20 * time.Millisecond, Seed: 8},
+		Config: Config{Identity: identity},
+	}
+
+	var first, second SimulationResult
+	quietly(func() {
+		var err error
+		first, err = Simulate(sim)
+		require.NoError(t, err)
+		second, err = Simulate(sim)
+		require.NoError(t, err)
+	})
+	assert.Equal(t, first, second)
+}
+
+func TestSimulateSealedCorruptLink(t *testing.T) {
+	// Corruption anywhere in a sealed packet, headers included, is caught
+	sim := Simulation{
+		Size:   256 << 10,
+		Link:   netem.Config{Loss: 0.02, Corrupt: 0.05, Latency: 20 * time.Millisecond, Seed: 5},
+		Config: Config{Key: testKey, Cipher: packet.CIPHER_CHACHA20_POLY1305},
+	}
+
+	var result SimulationResult
+	var err error
+	quietly(func() {
+		result, err = Simulate(sim)
+	})
+	require.NoError(t, err)
+	assert.NotZero(t, result.Upstream.Corrupted)
+}
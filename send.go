@@ -0,0 +1,717 @@
+package faart
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/djreed/faart/congestion"
+	"github.com/djreed/faart/log"
+	"github.com/djreed/faart/packet"
+	"github.com/djreed/faart/shared"
+)
+
+// Everything needed to get one direction of a session's byte stream across
+// reliably: the send window, retransmissions and the FIN. Owners feed it the
+// acks they read off the socket and decide what writing a datagram means.
+type sendHalf struct {
+	// Puts a datagram on the wire
+	write func(packet.Datagram) error
+
+	clock shared.Clock
+	// Set when the half is driven from a single goroutine, as a simulation
+	// does: datagrams go straight to write, and the owner hands acks to
+	// processAck itself
+	synchronous bool
+
+	// Guards datagrams, acked, cumAcked, loss, the FIN's state and the rest
+	// of the ack bookkeeping, which writers, handleAcks and the timeout
+	// goroutines all share. Everything set before run stays as it was; the
+	// window, rtt and stats guard themselves.
+	stateLock sync.Mutex
+
+	// Datagrams sent but not yet acked; bounded by the send window
+	datagrams shared.DataMap
+
+	// Every sequence below cumAcked has been acked, along with those in acked
+	cumAcked packet.SeqID
+	acked    shared.AckMap
+
+	// Highest sequence acked so far
+	highestAcked packet.SeqID
+
+	// Sequences already fast retransmitted; any further loss is left to the RTO
+	fastRetransmitted shared.AckMap
+	// Sequences the receiver turned away for want of room, to send again
+	// as soon as its window takes them in
+	refused shared.AckMap
+
+	// When each datagram in flight is resent if it goes unacked, and the
+	// one timer that fires for the earliest; retransmitAt is when that is,
+	// and zero while it isn't armed
+	retransmits     *retransmitter
+	retransmitTimer shared.Timer
+	retransmitAt    time.Time
+
+	// How long past SRTT a packet may stay unacked once a packet sent after
+	// it has been acked, before it is presumed lost; 0 means SRTT / 4
+	reorderWindow time.Duration
+
+	dataChan  shared.DataChannel
+	ackChan   shared.AckChannel
+	completed shared.ErrChannel
+
+	session packet.SessionID
+	packets *packetizer
+
+	// Sends parity after each block of data; nil unless the session uses
+	// FEC. loss is the receiver's latest estimate, which sizes the blocks.
+	fec  *fecEncoder
+	loss float64
+
+	// Finds out how big a datagram the path takes; nil if the session
+	// keeps to the size it started at. pmtuOptions say how much of each
+	// datagram is left for data.
+	pmtu        *pmtuSearch
+	pmtuOptions packet.Options
+	// The size the search is at, for transmit to split anything cut
+	// bigger than the path now takes; 0 for no limit. Atomic, since
+	// transmit doesn't always hold stateLock.
+	datagramSize int32
+	// Numbers the datagrams transmit splits; only the send loop uses it
+	fragmentGroup uint64
+
+	// Set once the stream has been flushed
+	readDone     bool
+	packetCount  packet.PacketCount
+	streamLength packet.OffsetVal
+	finSent      bool
+
+	// What the FIN carries for the receiver to check the stream against;
+	// nil sends none
+	digest []byte
+	// When the receiver last answered the FIN, and whether it said it was
+	// still checking the stream
+	finHeard   time.Time
+	finPending bool
+
+	rtt    *shared.RTTEstimator
+	window *sendWindow
+	stats  *transferStats
+
+	// When a blocked write gives up; nil for never
+	writeDeadline func() time.Time
+
+	// Closed once this half is over, stopping its goroutines; err says why
+	closed    chan struct{}
+	closeOnce sync.Once
+	err       error
+
+	finishOnce sync.Once
+	finishErr  error
+}
+
+func newSendHalf(config Config, clock shared.Clock) (*sendHalf, error) {
+	controller, err := congestion.New(config.congestion(), config.maxWindow())
+	if err != nil {
+		return nil, err
+	}
+
+	h := &sendHalf{
+		datagrams:         make(shared.DataMap),
+		acked:             make(shared.AckMap),
+		fastRetransmitted: make(shared.AckMap),
+		refused:           make(shared.AckMap),
+		retransmits:       newRetransmitter(),
+		reorderWindow:     config.Reorder,
+		dataChan:          shared.NewDataChan(),
+		ackChan:           shared.NewAckChan(),
+		completed:         make(shared.ErrChannel, 1),
+		clock:             clock,
+		rtt:               shared.NewRTTEstimatorClock(clock),
+		stats:             newTransferStats(clock),
+		closed:            make(chan struct{}),
+	}
+	h.window = newSendWindow(controller, config.maxWindow(), h.closed, clock)
+	return h, nil
+}
+
+// Starts the goroutines that put datagrams on the wire and take in acks;
+// the half is set up by then
+func (h *sendHalf) run() {
+	go h.sendData()
+	go h.handleAcks()
+}
+
+func (h *sendHalf) attach(session packet.SessionID, packetSize int, write func(packet.Datagram) error) {
+	h.session = session
+	h.write = write
+	h.packets = newPacketizer(session, packetSize, h.queueData)
+}
+
+// Sends data in datagrams of base bytes at first, while probing for how
+// much bigger the path takes them, up to ceiling; options say how much of
+// each is left for data. Called before the half runs.
+func (h *sendHalf) discoverPMTU(base, ceiling int, options packet.Options) {
+	h.pmtu = newPMTUSearch(base, ceiling)
+	h.pmtuOptions = options
+	h.resize()
+
+	h.stateLock.Lock()
+	defer h.stateLock.Unlock()
+	h.sendProbe()
+}
+
+// Sends whichever probe the search calls for next, if any. It has an RTO
+// to be answered in, doubled for each earlier try at its size. Probing
+// stops once the stream has ended, since no more datagrams will be cut.
+// Callers hold stateLock.
+func (h *sendHalf) sendProbe() {
+	if h.readDone {
+		return
+	}
+	id, size, ok := h.pmtu.probe()
+	if !ok {
+		log.ERR.Printf("[pmtu] %x settled on %d byte datagrams\n", h.session, h.pmtu.size)
+		return
+	}
+	h.send(packet.Datagram(packet.CreateProbe(h.session, id, size-sealOverhead(h.pmtuOptions))))
+	h.clock.AfterFunc(h.pmtu.timeout(h.rtt.RTO()), func() {
+		h.probeLost(id)
+	})
+}
+
+// Sends data in datagrams the size of probe from here on, if it's a try at
+// the size the search is waiting on, and moves the search along
+func (h *sendHalf) probeAcked(probe packet.Probe) {
+	h.stateLock.Lock()
+	defer h.stateLock.Unlock()
+
+	if h.pmtu == nil || !h.pmtu.acked(probe.ID()) {
+		return
+	}
+	log.ERR.Printf("[pmtu] %x %d byte datagrams get through\n", h.session, h.pmtu.size)
+	h.resize()
+	h.sendProbe()
+}
+
+// Counts probe id as lost if it's still unanswered, and moves the search
+// along
+func (h *sendHalf) probeLost(id uint64) {
+	select {
+	case <-h.closed:
+		return
+	default:
+	}
+
+	h.stateLock.Lock()
+	defer h.stateLock.Unlock()
+	if h.pmtu.lost(id) {
+		log.ERR.Printf("[pmtu] %x probe %d unanswered\n", h.session, id)
+		h.sendProbe()
+	}
+}
+
+// Takes the path to have narrowed under the size found, once a datagram
+// bigger than the base size has timed out PMTU_MAX_PROBES times in a row
+// (RFC 8899's black hole detection): data drops back to the base size and
+// the search starts over. Callers hold stateLock.
+func (h *sendHalf) narrowed() {
+	if h.pmtu.size <= h.pmtu.base {
+		return
+	}
+	log.ERR.Printf("[pmtu] %x %d byte datagrams stopped getting through\n", h.session, h.pmtu.size)
+	h.pmtu.narrowed()
+	h.resize()
+	h.sendProbe()
+}
+
+// Whether datagram carries more than one of the search's base size could,
+// and so may be too big for a path that has narrowed
+func (h *sendHalf) big(datagram packet.Datagram) bool {
+	return h.pmtu != nil && int(datagram.Headers().Length()) > payloadSize(h.pmtu.base, h.pmtuOptions)
+}
+
+// Cuts datagrams the size the search is at from here on
+func (h *sendHalf) resize() {
+	h.packets.resize(payloadSize(h.pmtu.size, h.pmtuOptions))
+	atomic.StoreInt32(&h.datagramSize, int32(h.pmtu.size))
+}
+
+// Hands an ack read off the socket to handleAcks
+func (h *sendHalf) receiveAck(ack packet.Ack) {
+	select {
+	case h.ackChan <- ack:
+	case <-h.closed:
+	}
+}
+
+// Marks the stream as ended, waits for every packet to be acked, then sees
+// the FIN through, carrying digest for the receiver to check the stream
+// against (nil for none). Only the first call does any of that; the rest
+// return the same result.
+func (h *sendHalf) close(digest []byte) error {
+	h.finishOnce.Do(func() {
+		select {
+		case <-h.closed:
+			h.finishErr = h.failure()
+			return
+		default:
+		}
+
+		h.end(digest)
+		h.finishErr = h.finish()
+	})
+	return h.finishErr
+}
+
+// Marks the stream as ended, without waiting on anything
+func (h *sendHalf) end(digest []byte) {
+	h.stateLock.Lock()
+	defer h.stateLock.Unlock()
+
+	h.digest = digest
+	h.readDone = true
+	h.packetCount = h.packets.Count()
+	h.streamLength = h.packets.Length()
+	if h.fec != nil {
+		for _, parity := range h.fec.flush() {
+			h.send(parity)
+		}
+	}
+	if h.doneSending() {
+		h.drained()
+	}
+}
+
+// Waits for the stream and the FIN to be acked
+func (h *sendHalf) finish() error {
+	select {
+	case err := <-h.completed:
+		log.ERR.Printf("[completed]\n")
+		h.stats.Print()
+		h.shutdown(err)
+		return err
+	case <-h.closed:
+		return h.failure()
+	}
+}
+
+// Moves an ended stream along each time everything sent has been acked:
+// first the FIN goes out, then once that's acked too the half is complete.
+// Callers hold stateLock.
+func (h *sendHalf) drained() {
+	if h.finSent {
+		h.complete(nil)
+		return
+	}
+	h.finSent = true
+
+	// The FIN's offset is where the stream ends, which a resumed transfer
+	// may not have sent all of
+	doneID := packet.SeqID(h.packetCount)
+	finalDatagram := packet.CreateDatagram(h.session, doneID, h.streamLength, h.digest, h.packetCount)
+	finalDatagram.Headers().SetDone(true)
+	h.datagrams[doneID] = finalDatagram
+	h.send(finalDatagram)
+	// Resent steadily rather than backing off, since the receiver's answers
+	// to it are what keep lingerFin waiting
+	h.scheduleRetransmit(finalDatagram, fixedTimeout(shared.FIN_TIMEOUT), false)
+
+	h.finHeard = h.clock.Now()
+	h.lingerFin(h.finWait())
+}
+
+// How long the receiver may go without answering the FIN: FIN_TIMEOUT_WAIT,
+// or on a link slow enough for it to be longer, a couple of RTOs
+func (h *sendHalf) finWait() time.Duration {
+	if wait := 2 * h.rtt.RTO(); wait > shared.FIN_TIMEOUT_WAIT {
+		return wait
+	}
+	return shared.FIN_TIMEOUT_WAIT
+}
+
+// Gives up on the FIN once the receiver has gone finWait without
+// answering it, since without its ack nothing says the receiver has it all.
+// A receiver still checking the stream answers every resent FIN, so this
+// waits for as long as the check takes.
+func (h *sendHalf) lingerFin(wait time.Duration) {
+	h.clock.AfterFunc(wait, func() {
+		select {
+		case <-h.closed:
+			return
+		default:
+		}
+
+		h.stateLock.Lock()
+		quiet := h.clock.Now().Sub(h.finHeard)
+		pending := h.finPending
+		h.stateLock.Unlock()
+		if wait := h.finWait(); quiet < wait {
+			h.lingerFin(wait - quiet)
+			return
+		}
+
+		if pending {
+			h.complete(ErrUnconfirmed)
+			return
+		}
+		log.ERR.Printf("[fin unanswered] %x\n", h.session)
+		h.complete(ErrFinUnanswered)
+	})
+}
+
+// Ends the half with err, returning whichever error ended it first
+func (h *sendHalf) fail(err error) error {
+	h.shutdown(err)
+	return h.failure()
+}
+
+// Stops every goroutine, recording err as the reason
+func (h *sendHalf) shutdown(err error) {
+	h.closeOnce.Do(func() {
+		h.err = err
+		close(h.closed)
+	})
+}
+
+// Why the half ended; only meaningful once closed is
+func (h *sendHalf) failure() error {
+	if h.err != nil {
+		return h.err
+	}
+	return ErrClosed
+}
+
+// Reports the outcome to finish; only the first report counts
+func (h *sendHalf) complete(err error) {
+	select {
+	case h.completed <- err:
+	default:
+	}
+}
+
+// Queues a datagram for sending, unless the half is already over
+func (h *sendHalf) send(datagram packet.Datagram) {
+	if h.synchronous {
+		h.transmit(datagram)
+		return
+	}
+	select {
+	case h.dataChan <- datagram:
+	case <-h.closed:
+	}
+}
+
+// Resends datagram after timeout() and then after twice as long each time
+// (if it's to back off), until it has been acked. The caller queues the
+// first send, so datagrams go out in the order they're queued. Callers hold
+// stateLock.
+func (h *sendHalf) scheduleRetransmit(datagram packet.Datagram, timeout func() time.Duration, backoff bool) {
+	h.retransmits.schedule(datagram, timeout, backoff, h.clock.Now())
+	h.armRetransmit()
+}
+
+// Makes sure the retransmit timer fires by the earliest deadline. A
+// deadline that moves later, once its datagram is acked, leaves the timer
+// to fire early and find nothing due. Callers hold stateLock.
+func (h *sendHalf) armRetransmit() {
+	due, ok := h.retransmits.next()
+	if !ok || (!h.retransmitAt.IsZero() && !due.Before(h.retransmitAt)) {
+		return
+	}
+	if h.retransmitTimer != nil {
+		h.retransmitTimer.Stop()
+	}
+	h.retransmitAt = due
+	h.retransmitTimer = h.clock.AfterFunc(due.Sub(h.clock.Now()), func() {
+		h.retransmit(due)
+	})
+}
+
+// Resends everything whose deadline has passed, counting each as a loss
+// against the congestion window, then arms the timer for what's next.
+// Checked and resent under the lock, so an ack landing in between can't
+// have the window count a delivered packet as lost.
+func (h *sendHalf) retransmit(armedFor time.Time) {
+	select {
+	case <-h.closed:
+		return
+	default:
+	}
+
+	h.stateLock.Lock()
+	defer h.stateLock.Unlock()
+	if !h.retransmitAt.Equal(armedFor) {
+		// Stopped too late; a newer timer has taken over
+		return
+	}
+	h.retransmitAt = time.Time{}
+	expired := h.retransmits.expired(h.clock.Now())
+	blackHole := false
+	for _, datagram := range expired {
+		seq := datagram.Headers().Sequence()
+		if h.window.Beyond(seq) {
+			// Went unanswered for want of room, not lost
+			log.ERR.Printf("[zero window probe] %d\n", seq)
+			h.stats.WindowProbe()
+		} else {
+			h.window.TimedOut(seq)
+			h.stats.RTORetransmit()
+			if h.big(datagram) && h.retransmits.resends(seq) == PMTU_MAX_PROBES {
+				blackHole = true
+			}
+		}
+	}
+	// Before anything is resent, so it goes out in pieces if the path
+	// has narrowed
+	if blackHole {
+		h.narrowed()
+	}
+	for _, datagram := range expired {
+		h.send(datagram)
+	}
+	h.armRetransmit()
+}
+
+func fixedTimeout(timeout time.Duration) func() time.Duration {
+	return func() time.Duration {
+		return timeout
+	}
+}
+
+func (h *sendHalf) sendData() {
+	for {
+		select {
+		case datagram := <-h.dataChan:
+			if !h.transmit(datagram) {
+				return
+			}
+		case <-h.closed:
+			return
+		}
+	}
+}
+
+// Puts a datagram on the wire, in fragments if it was cut for a wider path
+// than the one there is now, returning false if the half has failed
+func (h *sendHalf) transmit(datagram packet.Datagram) bool {
+	if packet.Prefix(datagram).Kind() == packet.KIND_PROBE {
+		// One too big for this host's own interface fails here, and is left
+		// to go unanswered like one the path drops
+		if err := h.write(datagram); err != nil {
+			log.ERR.Printf("[pmtu] %x probe %d not sent: %s\n", h.session, packet.Probe(datagram).ID(), err)
+		}
+		return true
+	}
+	if err := h.writeFitted(datagram); err != nil {
+		h.shutdown(err)
+		return false
+	}
+	h.stats.Sent(len(datagram))
+	if parity := packet.Parity(datagram); parity.Prefix().Kind() == packet.KIND_PARITY {
+		h.stats.ParitySent()
+		log.ERR.Printf("[send parity] %d+%d (%d of %d)\n", parity.Block(), parity.DataCount(), parity.Index()+1, parity.ParityCount())
+		return true
+	}
+	h.rtt.Sent(datagram.Headers().Sequence())
+	log.ERR.Printf("[send data] %d (%d)\n", datagram.Headers().Offset(), datagram.Headers().Length())
+	return true
+}
+
+// Writes datagram whole if it fits the size the search is at, or split into
+// as many fragments as it takes otherwise. A stream's data may have an ack
+// attached on its way out, so needs room for one.
+func (h *sendHalf) writeFitted(datagram packet.Datagram) error {
+	size := int(atomic.LoadInt32(&h.datagramSize)) - sealOverhead(h.pmtuOptions)
+	limit := size
+	if h.pmtuOptions&packet.OPTION_STREAM != 0 && packet.Prefix(datagram).Kind() == packet.KIND_DATA {
+		limit -= packet.ACK_SIZE
+	}
+	if size <= 0 || len(datagram) <= limit {
+		return h.write(datagram)
+	}
+
+	h.fragmentGroup++
+	fragments := packet.SplitDatagram(h.session, h.fragmentGroup, datagram, size)
+	log.ERR.Printf("[send fragmented] %x group %d in %d\n", h.session, h.fragmentGroup, len(fragments))
+	for _, fragment := range fragments {
+		if err := h.write(packet.Datagram(fragment)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Waits for room in the congestion window, then puts the datagram on the
+// wire until it has been acked
+func (h *sendHalf) queueData(datagram packet.Datagram) error {
+	if err := h.window.Acquire(datagram.Headers().Sequence(), h.writeDeadline); err == ErrClosed {
+		return h.failure()
+	} else if err != nil {
+		return err
+	}
+
+	h.stateLock.Lock()
+	h.datagrams[datagram.Headers().Sequence()] = datagram
+	h.scheduleRetransmit(datagram, h.rtt.RTO, true)
+	h.stateLock.Unlock()
+
+	h.send(datagram)
+
+	if h.fec != nil {
+		h.stateLock.Lock()
+		parities := h.fec.add(datagram, h.loss)
+		h.stateLock.Unlock()
+		for _, parity := range parities {
+			h.send(parity)
+		}
+	}
+	return nil
+}
+
+func (h *sendHalf) handleAcks() {
+	for {
+		select {
+		case ack := <-h.ackChan:
+			h.processAck(ack)
+		case <-h.closed:
+			return
+		}
+	}
+}
+
+// Marks everything ack covers as delivered, then either moves an ended
+// stream along or looks for holes to fill
+func (h *sendHalf) processAck(ack packet.Ack) {
+	prefix := ack.Prefix()
+	if prefix.WellFormed() && prefix.Kind() == packet.KIND_PROBE_ACK && prefix.Session() == h.session {
+		h.probeAcked(packet.Probe(ack))
+		return
+	}
+	if !prefix.WellFormed() || prefix.Kind() != packet.KIND_ACK || prefix.Session() != h.session {
+		log.ERR.Printf("[recv unknown packet] kind %d session %x\n", prefix.Kind(), prefix.Session())
+		return
+	}
+
+	h.stats.AckReceived()
+	log.ERR.Printf("[recv ack] %d (cumulative %d, %d sack blocks)\n", ack.Offset(), ack.Cumulative(), len(ack.SackBlocks()))
+
+	h.stateLock.Lock()
+	defer h.stateLock.Unlock()
+
+	h.loss = ack.Loss()
+	h.window.Advertise(ack.Cumulative(), ack.Window())
+	newlyAcked := false
+	switch ack.Status() {
+	case packet.ACK_STATUS_PENDING:
+		// The FIN arrived, but isn't acked until the receiver has checked
+		// the stream
+		h.sampleRTT(ack.Sequence())
+		h.finHeard = h.clock.Now()
+		h.finPending = true
+	case packet.ACK_STATUS_MISMATCH:
+		h.complete(ErrDigestMismatch)
+		return
+	case packet.ACK_STATUS_FAILED:
+		h.complete(ErrReceiverFailed)
+		return
+	case packet.ACK_STATUS_NO_ROOM:
+		// Answers a probe with the window; the datagram wasn't taken, so
+		// its round trip says nothing, and it's still timed for its resend
+		if _, inFlight := h.datagrams[ack.Sequence()]; inFlight {
+			h.refused[ack.Sequence()] = true
+		}
+	default:
+		h.sampleRTT(ack.Sequence())
+		newlyAcked = h.markAcked(ack.Sequence())
+	}
+	blocks := ack.SackBlocks()
+	for seq := range h.datagrams {
+		if seq < ack.Cumulative() || sacked(seq, blocks) {
+			newlyAcked = h.markAcked(seq) || newlyAcked
+		}
+	}
+	for h.acked[h.cumAcked] {
+		delete(h.acked, h.cumAcked)
+		h.cumAcked++
+	}
+	h.resendRefused()
+
+	if newlyAcked && h.doneSending() {
+		h.drained()
+	} else if newlyAcked {
+		h.detectLosses()
+	}
+}
+
+// Times the round trip to an ack saying the receiver took seq in, unless
+// seq was ever resent. Callers hold stateLock.
+func (h *sendHalf) sampleRTT(seq packet.SeqID) {
+	if sample := h.rtt.Acked(seq); sample > 0 {
+		log.ERR.Printf("[rtt] sample %s srtt %s rttvar %s rto %s\n", sample, h.rtt.SRTT(), h.rtt.RTTVar(), h.rtt.RTO())
+	}
+}
+
+// Marks a single in-flight sequence as delivered, returning whether it was
+// news. Callers hold stateLock.
+func (h *sendHalf) markAcked(seq packet.SeqID) bool {
+	if _, inFlight := h.datagrams[seq]; !inFlight {
+		return false
+	}
+
+	delete(h.datagrams, seq)
+	delete(h.refused, seq)
+	h.retransmits.cancel(seq)
+	h.acked[seq] = true
+	delete(h.fastRetransmitted, seq)
+	h.rtt.Delivered(seq)
+	if !h.readDone || seq < packet.SeqID(h.packetCount) {
+		if seq > h.highestAcked {
+			h.highestAcked = seq
+		}
+		h.window.Release(h.rtt.SRTT())
+	}
+	return true
+}
+
+// Sends again whatever the receiver turned away that its window now has
+// room for, lowest first, without counting it as lost. Callers hold
+// stateLock.
+func (h *sendHalf) resendRefused() {
+	var room []packet.SeqID
+	for seq := range h.refused {
+		if !h.window.Beyond(seq) {
+			room = append(room, seq)
+		}
+	}
+	sort.Slice(room, func(i, j int) bool { return room[i] < room[j] })
+
+	for _, seq := range room {
+		delete(h.refused, seq)
+		log.ERR.Printf("[resend refused] %d\n", seq)
+		h.send(h.datagrams[seq])
+		h.scheduleRetransmit(h.datagrams[seq], h.rtt.RTO, true)
+	}
+}
+
+func sacked(seq packet.SeqID, blocks []packet.SackBlock) bool {
+	for _, block := range blocks {
+		if block.Contains(seq) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *sendHalf) isAcked(seq packet.SeqID) bool {
+	h.stateLock.Lock()
+	defer h.stateLock.Unlock()
+	return seq < h.cumAcked || h.acked[seq]
+}
+
+// Callers hold stateLock
+func (h *sendHalf) doneSending() bool {
+	return h.readDone && len(h.datagrams) == 0
+}
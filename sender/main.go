@@ -1,18 +1,144 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
+	"io"
 	"os"
+
+	"github.com/djreed/faart"
+	"github.com/djreed/faart/archive"
+	"github.com/djreed/faart/congestion"
+	"github.com/djreed/faart/identity"
+	"github.com/djreed/faart/log"
+	"github.com/djreed/faart/packet"
+)
+
+var (
+	congestionFlag = flag.String("cc", congestion.NEWRENO, "congestion control algorithm: newreno or cubic")
+	windowFlag     = flag.Int("window", congestion.MAX_WINDOW, "maximum number of packets in flight")
+	reorderFlag    = flag.Duration("reorder", 0, "how long past SRTT a packet may go unacked after later packets are acked before it is resent (0 = SRTT/4)")
+	fecFlag        = flag.String("fec", "", "forward error correction: xor or rs (off unless set)")
+	keyFlag        = flag.String("key", "", "seal every packet with the pre-shared key in this file (32 bytes, raw or hex)")
+	passphraseFlag = flag.String("passphrase", "", "seal every packet with a key derived from this passphrase")
+	cipherFlag     = flag.String("cipher", "aes-gcm", "AEAD to seal packets with: aes-gcm or chacha20-poly1305")
+	identityFlag   = flag.String("identity", "", "do the key exchange, signing this side of it with this private key from faart keygen")
+	knownHostsFlag = flag.String("known-hosts", "", "do the key exchange, pinning each receiver's key in this file the first time and refusing it if it changes (~/.faart/known_hosts with -identity)")
+	codecFlag      = flag.String("codec", "gzip", "compress the stream with gzip, zlib, flate, lzw or none")
+	levelFlag      = flag.Int("level", packet.COMPRESS_LEVEL, "compression level for gzip, zlib and flate, from 1 (fastest) to 9 (smallest)")
+	forceCodecFlag = flag.Bool("force-codec", false, "compress with -codec even if the input looks incompressible")
+	datagramFlag   = flag.Int("datagram-size", packet.DATAGRAM_SIZE, "largest datagram to send, in bytes; the session probes its way up to the smaller of this and the receiver's")
+	resumeFlag     = flag.Bool("resume", false, "name the data by its SHA-256, so a receiver keeping checkpoints can pick up where an earlier transfer of it left off; STDIN must be a file, unless paths are given")
 )
 
-// ./3700send <recv_host>:<recv_port>
+// ./3700send [-cc newreno|cubic] [-window packets] [-reorder duration] [-fec xor|rs] [-key file | -passphrase phrase] [-cipher aes-gcm|chacha20-poly1305] [-identity file] [-known-hosts file] [-codec gzip|zlib|flate|lzw|none] [-level N] [-force-codec] [-datagram-size N] [-resume] <recv_host>:<recv_port> [path ...]
 func main() {
-	if len(os.Args) != 2 {
-		panic("Must pass in a single argument: <recv_host>:<recv_port>\nData will be read from STDIN")
+	flag.Parse()
+	if flag.NArg() < 1 {
+		exit(errors.New("must pass in <recv_host>:<recv_port>, then any files or directories to send; without them, data will be read from STDIN"))
+	}
+
+	config := faart.Config{
+		Congestion:    *congestionFlag,
+		MaxWindow:     *windowFlag,
+		Reorder:       *reorderFlag,
+		CompressLevel: *levelFlag,
+		ForceCodec:    *forceCodecFlag,
+		DatagramSize:  *datagramFlag,
+	}
+	if *fecFlag != "" {
+		scheme, err := packet.ParseFECScheme(*fecFlag)
+		if err != nil {
+			exit(err)
+		}
+		config.FEC = scheme
+	}
+	codec, err := packet.ParseCodec(*codecFlag)
+	if err != nil {
+		exit(err)
+	}
+	config.Codec = codec
+	key, err := packet.KeyFrom(*keyFlag, *passphraseFlag)
+	if err != nil {
+		exit(err)
+	}
+	config.Key = key
+	if config.Cipher, err = packet.ParseCipher(*cipherFlag); err != nil {
+		exit(err)
+	}
+
+	knownHosts := *knownHostsFlag
+	if *identityFlag != "" {
+		if config.Identity, err = identity.LoadPrivateKey(*identityFlag); err != nil {
+			exit(err)
+		}
+		if knownHosts == "" {
+			if knownHosts, err = identity.DefaultPath(identity.DEFAULT_KNOWN_HOSTS); err != nil {
+				exit(err)
+			}
+		}
+	}
+	if knownHosts != "" {
+		config.VerifyPeer = identity.NewKnownHosts(knownHosts).Verify
+	}
+
+	// Paths go as an archive for 3700recv -d to unpack; packing them twice
+	// over gives the same stream, as long as nothing changes in between
+	var source io.Reader = os.Stdin
+	if flag.NArg() > 1 {
+		manifest, err := archive.Scan(flag.Args()[1:])
+		if err != nil {
+			exit(err)
+		}
+		if *resumeFlag {
+			if config.ContentID, err = packet.ContentIDOf(manifest.Reader()); err != nil {
+				exit(err)
+			}
+		}
+		source = manifest.Reader()
+	} else if *resumeFlag {
+		if config.ContentID, err = contentID(os.Stdin); err != nil {
+			exit(err)
+		}
+	}
+	if err := send(flag.Arg(0), source, config); err != nil {
+		exit(err)
 	}
+}
 
-	target := os.Args[1]
-	source := os.Stdin
-	if err := sender(target, source); err != nil {
-		panic(err)
+func send(target string, source io.Reader, config faart.Config) error {
+	conn, err := faart.DialConfig(context.Background(), target, config)
+	if err != nil {
+		return err
 	}
+
+	if _, err := io.Copy(conn, source); err != nil {
+		conn.Close()
+		return err
+	}
+	return conn.Close()
+}
+
+// Hashes file, then rewinds it to be sent
+func contentID(file *os.File) (packet.ContentID, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return packet.ContentID{}, err
+	}
+	if !info.Mode().IsRegular() {
+		return packet.ContentID{}, errors.New("-resume reads STDIN twice, so it must be redirected from a file")
+	}
+
+	id, err := packet.ContentIDOf(file)
+	if err != nil {
+		return packet.ContentID{}, err
+	}
+	_, err = file.Seek(0, io.SeekStart)
+	return id, err
+}
+
+func exit(err error) {
+	log.ERR.Printf("[error] %s\n", err)
+	os.Exit(1)
 }
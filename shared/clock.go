@@ -0,0 +1,29 @@
+package shared
+
+import "time"
+
+// Where the protocol gets the time from, so that a simulation can swap in
+// virtual time for the wall clock
+type Clock interface {
+	Now() time.Time
+	// Calls f once d has passed, unless the returned Timer is stopped first
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+type Timer interface {
+	// Returns whether the call stopped the timer before it fired
+	Stop() bool
+}
+
+// The real time, with AfterFunc calls run on their own goroutines
+var WallClock Clock = wallClock{}
+
+type wallClock struct{}
+
+func (wallClock) Now() time.Time {
+	return time.Now()
+}
+
+func (wallClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
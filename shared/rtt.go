@@ -0,0 +1,182 @@
+package shared
+
+import (
+	"sync"
+	"time"
+
+	"github.com/djreed/faart/packet"
+)
+
+const (
+	// Jacobson/Karels gains (RFC 6298): alpha = 1/8, beta = 1/4
+	RTT_ALPHA_SHIFT = 3
+	RTT_BETA_SHIFT  = 2
+
+	// RTO = SRTT + max(G, K * RTTVAR)
+	RTT_VAR_MULTIPLIER = 4
+)
+
+// RTTEstimator tracks the smoothed round trip time and its variance for a
+// single session, and derives the retransmission timeout from them.
+type RTTEstimator struct {
+	lock  sync.Mutex
+	clock Clock
+
+	srtt   time.Duration
+	rttvar time.Duration
+	rto    time.Duration
+
+	sampled bool
+
+	// When each sequence was last put on the wire
+	sentAt map[packet.SeqID]time.Time
+
+	// Sequences sent more than once; Karn's rule says their acks are ambiguous
+	retransmitted AckMap
+
+	// Most recent send time of any packet known to be delivered
+	latestDelivered time.Time
+}
+
+func NewRTTEstimator() *RTTEstimator {
+	return NewRTTEstimatorClock(WallClock)
+}
+
+// An estimator timing round trips by clock rather than the wall clock
+func NewRTTEstimatorClock(clock Clock) *RTTEstimator {
+	return &RTTEstimator{
+		clock:         clock,
+		rto:           INITIAL_RTO,
+		sentAt:        make(map[packet.SeqID]time.Time),
+		retransmitted: make(AckMap),
+	}
+}
+
+// Sent records that a sequence was just transmitted
+func (e *RTTEstimator) Sent(seq packet.SeqID) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if _, existing := e.sentAt[seq]; existing {
+		e.retransmitted[seq] = true
+	}
+	e.sentAt[seq] = e.clock.Now()
+}
+
+// Acked records the arrival of an ack for a sequence, and folds its round
+// trip into the estimate unless the sequence was ever retransmitted.
+// Returns the measured sample, or 0 if none was taken.
+func (e *RTTEstimator) Acked(seq packet.SeqID) time.Duration {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	sentAt, existing := e.sentAt[seq]
+	if !existing {
+		return 0
+	}
+	delete(e.sentAt, seq)
+	e.delivered(sentAt)
+
+	if e.retransmitted[seq] {
+		delete(e.retransmitted, seq)
+		return 0
+	}
+
+	sample := e.clock.Now().Sub(sentAt)
+	e.sample(sample)
+	return sample
+}
+
+// SentAt is when seq was last put on the wire, if it is still being tracked
+func (e *RTTEstimator) SentAt(seq packet.SeqID) (time.Time, bool) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	sentAt, existing := e.sentAt[seq]
+	return sentAt, existing
+}
+
+// Delivered records that seq arrived without taking a sample, for sequences
+// acked as part of a range rather than by their own ack
+func (e *RTTEstimator) Delivered(seq packet.SeqID) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if sentAt, existing := e.sentAt[seq]; existing {
+		e.delivered(sentAt)
+	}
+	delete(e.sentAt, seq)
+	delete(e.retransmitted, seq)
+}
+
+func (e *RTTEstimator) delivered(sentAt time.Time) {
+	if sentAt.After(e.latestDelivered) {
+		e.latestDelivered = sentAt
+	}
+}
+
+// LatestDelivered is the most recent send time of any delivered packet;
+// anything sent before it and still unacked may have been lost (RACK)
+func (e *RTTEstimator) LatestDelivered() time.Time {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.latestDelivered
+}
+
+// Sample folds a single round trip measurement into the estimate
+func (e *RTTEstimator) Sample(rtt time.Duration) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.sample(rtt)
+}
+
+func (e *RTTEstimator) sample(rtt time.Duration) {
+	if !e.sampled {
+		e.srtt = rtt
+		e.rttvar = rtt / 2
+		e.sampled = true
+	} else {
+		delta := e.srtt - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		e.rttvar += (delta - e.rttvar) >> RTT_BETA_SHIFT
+		e.srtt += (rtt - e.srtt) >> RTT_ALPHA_SHIFT
+	}
+
+	variance := RTT_VAR_MULTIPLIER * e.rttvar
+	if variance < RTT_GRANULARITY {
+		variance = RTT_GRANULARITY
+	}
+	e.rto = clampRTO(e.srtt + variance)
+}
+
+// SRTT is the smoothed round trip time, or 0 before the first sample
+func (e *RTTEstimator) SRTT() time.Duration {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.srtt
+}
+
+// RTTVar is the round trip time variance, or 0 before the first sample
+func (e *RTTEstimator) RTTVar() time.Duration {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.rttvar
+}
+
+// RTO is the current retransmission timeout
+func (e *RTTEstimator) RTO() time.Duration {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.rto
+}
+
+func clampRTO(rto time.Duration) time.Duration {
+	if rto < MIN_RTO {
+		return MIN_RTO
+	}
+	if rto > MAX_RTO {
+		return MAX_RTO
+	}
+	return rto
+}
@@ -0,0 +1,72 @@
+package shared
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRTTInitialTimeout(t *testing.T) {
+	rtt := NewRTTEstimator()
+	assert.Equal(t, INITIAL_RTO, rtt.RTO())
+	assert.Equal(t, time.Duration(0), rtt.SRTT())
+}
+
+func TestRTTFirstSample(t *testing.T) {
+	rtt := NewRTTEstimator()
+	rtt.Sample(100 * time.Millisecond)
+	assert.Equal(t, 100*time.Millisecond, rtt.SRTT())
+	assert.Equal(t, 50*time.Millisecond, rtt.RTTVar())
+	assert.Equal(t, 300*time.Millisecond, rtt.RTO())
+}
+
+func TestRTTSmoothing(t *testing.T) {
+	rtt := NewRTTEstimator()
+	rtt.Sample(100 * time.Millisecond)
+	rtt.Sample(200 * time.Millisecond)
+	assert.Equal(t, 112500*time.Microsecond, rtt.SRTT())
+	assert.Equal(t, 62500*time.Microsecond, rtt.RTTVar())
+}
+
+func TestRTTClamped(t *testing.T) {
+	rtt := NewRTTEstimator()
+	rtt.Sample(time.Microsecond)
+	assert.Equal(t, MIN_RTO, rtt.RTO())
+	rtt.Sample(time.Hour)
+	assert.Equal(t, MAX_RTO, rtt.RTO())
+}
+
+func TestRTTKarnIgnoresRetransmits(t *testing.T) {
+	rtt := NewRTTEstimator()
+	rtt.Sent(1)
+	rtt.Sent(1)
+	assert.Equal(t, time.Duration(0), rtt.Acked(1))
+	assert.Equal(t, INITIAL_RTO, rtt.RTO())
+
+	rtt.Sent(2)
+	assert.NotEqual(t, time.Duration(0), rtt.Acked(2))
+	assert.NotEqual(t, INITIAL_RTO, rtt.RTO())
+}
+
+func TestRTTLatestDelivered(t *testing.T) {
+	rtt := NewRTTEstimator()
+	assert.True(t, rtt.LatestDelivered().IsZero())
+
+	rtt.Sent(1)
+	rtt.Sent(2)
+	second, _ := rtt.SentAt(2)
+
+	// Whether acked itself or as part of a range, and in any order, the
+	// latest send time delivered only moves forward
+	rtt.Delivered(2)
+	assert.Equal(t, second, rtt.LatestDelivered())
+	rtt.Acked(1)
+	assert.Equal(t, second, rtt.LatestDelivered())
+	_, tracked := rtt.SentAt(1)
+	assert.False(t, tracked)
+
+	// and nothing is learned from a sequence no longer tracked
+	rtt.Delivered(1)
+	assert.Equal(t, second, rtt.LatestDelivered())
+}
@@ -6,9 +6,23 @@ var (
 	// How long to wait between packet sends
 	SEND_PACKET_WAIT = time.Duration(1 * time.Microsecond)
 
-	// How long to wait before re-queueing packets
+	// How long to wait before re-queueing packets, until an RTT has been measured
 	SEND_PACKET_TIMEOUT = time.Duration(1000 * time.Millisecond)
 
+	// Retransmission timeout bounds once RTT is being tracked
+	INITIAL_RTO = SEND_PACKET_TIMEOUT
+	MIN_RTO     = time.Duration(20 * time.Millisecond)
+	MAX_RTO     = time.Duration(60 * time.Second)
+
+	// Floor on the RTO's variance term, so a perfectly steady RTT can't
+	// drive the timeout to within scheduling jitter of it
+	RTT_GRANULARITY = time.Duration(10 * time.Millisecond)
+
+	// How long to wait for a SYN-ACK before resending the SYN, doubling
+	// each time, and how many SYNs to send before giving up
+	HANDSHAKE_TIMEOUT = INITIAL_RTO
+	HANDSHAKE_RETRIES = 5
+
 	// How long to wait before re-queueing the FIN
 	FIN_TIMEOUT = time.Duration(200 * time.Millisecond)
 
@@ -16,6 +30,15 @@ var (
 	// an ACK to its FIN
 	FIN_TIMEOUT_WAIT = 5 * FIN_TIMEOUT
 
+	// How long a receiver keeps answering the FIN after its final ack,
+	// once the sender goes quiet without closing; by then the sender has
+	// stopped resending it
+	TIME_WAIT = FIN_TIMEOUT_WAIT
+
+	// On a stream, how long an ack may wait for outgoing data to ride along
+	// on before it is sent by itself
+	ACK_DELAY = MIN_RTO / 4
+
 	// How long to wait on the receiver before completing if no data received
 	RECV_READ_TIMEOUT = 10 * SEND_PACKET_TIMEOUT
 )
@@ -56,3 +56,8 @@ func SendAck(conn *net.UDPConn, target *net.UDPAddr, ack packet.Ack) error {
 	_, err := conn.WriteToUDP(ack, target)
 	return err
 }
+
+func SendHandshake(conn *net.UDPConn, target *net.UDPAddr, handshake packet.Handshake) error {
+	_, err := conn.WriteToUDP(handshake, target)
+	return err
+}
@@ -0,0 +1,528 @@
+package faart
+
+import (
+	"container/heap"
+	"crypto/sha256"
+	"errors"
+	"math/rand"
+	"net"
+	"runtime"
+	"time"
+
+	"github.com/djreed/faart/netem"
+	"github.com/djreed/faart/packet"
+	"github.com/djreed/faart/shared"
+	"golang.org/x/crypto/ed25519"
+)
+
+const (
+	// Bytes a Simulation sends unless told otherwise
+	SIMULATION_SIZE = 1 << 20
+	// Virtual time a Simulation may take unless told otherwise
+	SIMULATION_LIMIT = time.Hour
+
+	// Most a simulated application reads at once, and how often one with
+	// a read rate is let read some more
+	SIMULATION_READ_SIZE = 32 << 10
+	SIMULATION_READ_TICK = 10 * time.Millisecond
+)
+
+var (
+	// The simulated transfer hadn't completed by its time limit
+	ErrSimulationLimit = errors.New("faart: simulated transfer ran past its time limit")
+	// Nothing was left to happen, yet the simulated transfer hadn't completed
+	ErrSimulationStalled = errors.New("faart: simulated transfer stalled")
+)
+
+// A single transfer run in virtual time over an impaired in-memory link.
+// The real sender and receiver state machines do the work, a send half and
+// a Transfer, but from one goroutine and with every timer on a virtual
+// clock, so an hour of transfer takes moments and the same Simulation always
+// plays out the same way. The receiver checks the stream against the
+// sender's digest as it would over a socket, and the sender hears how that
+// went. Config sets up both ends, as if the listener had been given it too.
+type Simulation struct {
+	// Bytes to send, drawn from an RNG seeded by Link.Seed;
+	// SIMULATION_SIZE unless set
+	Size int64
+	// Impairments applied to each direction of the link
+	Link netem.Config
+	// The sender's options, as for Dial
+	Config Config
+	// How much virtual time the transfer may take; SIMULATION_LIMIT unless set
+	Limit time.Duration
+	// Bytes a second the receiving application reads at, so that the
+	// receive window can fill; as fast as they arrive unless set
+	ReadRate int64
+}
+
+// How a simulated transfer went
+type SimulationResult struct {
+	// Virtual time from the first packet until the sender completed
+	Elapsed time.Duration
+	// Timers and deliveries the clock ran through
+	Events int
+
+	PacketsSent     uint64
+	AcksReceived    uint64
+	RTORetransmits  uint64
+	FastRetransmits uint64
+	// Datagrams sent past the receive window, for it to answer with room
+	WindowProbes uint64
+	// Parity datagrams sent, and data datagrams the receiver rebuilt from them
+	ParitySent uint64
+	Recovered  uint64
+	// Bytes the receiving application read
+	Received int64
+
+	// The largest datagram path MTU discovery found the link takes
+	DatagramSize int
+
+	// What the link did to data heading to the receiver, and to acks
+	// heading back
+	Upstream   netem.Stats
+	Downstream netem.Stats
+}
+
+// Runs sim until the sender completes, the time limit passes or nothing is
+// left to happen. Fails as the sender would if the receiver didn't get
+// exactly what was sent.
+func Simulate(sim Simulation) (SimulationResult, error) {
+	size := sim.Size
+	if size == 0 {
+		size = SIMULATION_SIZE
+	}
+	limit := sim.Limit
+	if limit == 0 {
+		limit = SIMULATION_LIMIT
+	}
+
+	if err := sim.Config.checkSealing(); err != nil {
+		return SimulationResult{}, err
+	}
+	if err := sim.Config.checkDatagramSize(); err != nil {
+		return SimulationResult{}, err
+	}
+	if err := sim.Config.checkReceiveBuffer(); err != nil {
+		return SimulationResult{}, err
+	}
+
+	clock := newVirtualClock()
+	out, err := newSendHalf(sim.Config, clock)
+	if err != nil {
+		return SimulationResult{}, err
+	}
+	out.synchronous = true
+
+	source := rand.New(rand.NewSource(sim.Link.Seed))
+	syn, synAck, sendSealer, recvSealer, err := simulateHandshake(sim.Config, source)
+	if err != nil {
+		return SimulationResult{}, err
+	}
+	session := syn.Prefix().Session()
+	processAck := func(raw []byte) {
+		if ack, ok := sendSealer.Open(raw); ok {
+			out.processAck(packet.Ack(ack))
+		}
+	}
+
+	upstream := newSimulatedLink(clock, netem.NewModel(sim.Link, netem.UPSTREAM))
+	downstream := newSimulatedLink(clock, netem.NewModel(sim.Link, netem.DOWNSTREAM))
+
+	// The receiver, as a Listener sets a Transfer up, but driven from here
+	in := newTransfer(session, nil, sim.Config.receiveBuffer(TRANSFER_BUFFER), payloadSize(baseDatagramSize(synAck), synAck.Options()))
+	if synAck.Options()&packet.OPTION_FEC != 0 {
+		in.fec = newFECDecoder()
+	}
+	in.sealer = recvSealer
+	in.sealed = recvSealer != nil
+	in.codecs = synAck.Codecs()
+	in.clock = clock
+	in.synchronous = true
+	in.queueAck = func(addr *net.UDPAddr, ack packet.Ack) {
+		downstream.carry(ack, processAck)
+	}
+	in.sendAck = in.queueAck
+	in.forget = func() {}
+	in.start(sim.Config.IdleTimeout)
+	reader := newSimulatedReader(in, clock, sim.ReadRate)
+	defer reader.stop()
+
+	out.attach(session, packetSize(synAck), func(datagram packet.Datagram) error {
+		// A socket would copy it too, and the sender holds on to its own
+		upstream.carry(append([]byte(nil), sendSealer.Seal(datagram)...), func(sealed []byte) {
+			in.deliver(packet.AddressedDatagram{Datagram: sealed})
+		})
+		return nil
+	})
+	out.discoverPMTU(baseDatagramSize(synAck), synAck.DatagramSize(), synAck.Options())
+	if synAck.Options()&packet.OPTION_FEC != 0 {
+		out.fec = newFECEncoder(sim.Config.FEC, session)
+	}
+
+	// The application, writing as fast as the window allows. The data is
+	// random, so like a Conn it goes uncompressed, behind the byte that
+	// says so.
+	sent := sha256.New()
+	stream := []byte{byte(packet.CODEC_NONE)}
+	var written int64
+	write := func() {
+		for written < size && out.window.HasRoom(out.packets.nextSeq) {
+			chunk := make([]byte, out.packets.size()-len(stream))
+			if remaining := size - written; remaining < int64(len(chunk)) {
+				chunk = chunk[:remaining]
+			}
+			source.Read(chunk)
+			sent.Write(chunk)
+			if err := out.packets.emit(append(stream, chunk...)); err != nil {
+				return
+			}
+			stream = nil
+			written += int64(len(chunk))
+		}
+		if written == size && !out.readDone {
+			out.end(sent.Sum(nil))
+		}
+	}
+
+	recovered := func() uint64 {
+		if in.fec == nil {
+			return 0
+		}
+		return in.fec.recovered
+	}
+	result := func() SimulationResult {
+		return SimulationResult{
+			Elapsed:         clock.Now().Sub(clock.start),
+			Events:          clock.events,
+			PacketsSent:     out.stats.packetsSent,
+			AcksReceived:    out.stats.acksReceived,
+			RTORetransmits:  out.stats.rtoRetransmits,
+			FastRetransmits: out.stats.fastRetransmits,
+			WindowProbes:    out.stats.windowProbes,
+			ParitySent:      out.stats.paritySent,
+			Recovered:       recovered(),
+			Received:        reader.received,
+			DatagramSize:    out.pmtu.size,
+			Upstream:        upstream.model.Stats(),
+			Downstream:      downstream.model.Stats(),
+		}
+	}
+
+	write()
+	reader.read()
+	for {
+		select {
+		case err := <-out.completed:
+			out.shutdown(err)
+			return result(), err
+		default:
+		}
+
+		if clock.Now().Sub(clock.start) > limit {
+			out.shutdown(ErrSimulationLimit)
+			return result(), ErrSimulationLimit
+		}
+		if !clock.step() {
+			out.shutdown(ErrSimulationStalled)
+			return result(), ErrSimulationStalled
+		}
+		write()
+		reader.read()
+	}
+}
+
+// Settles a session as Dial and a Listener would, less the round trip,
+// returning what seals each end's packets; nil sealers leave them in the
+// clear. Both ends share the sender's key and datagram size, and for the
+// key exchange its identity too. VerifyPeer is never asked, and the
+// receiver keeps no checkpoints to resume from.
+func simulateHandshake(config Config, source *rand.Rand) (packet.Handshake, packet.Handshake, *packet.Sealer, *packet.Sealer, error) {
+	syn := packet.CreateSyn(packet.SessionID(source.Uint64()), config.datagramSize(), config.options()&^packet.OPTION_RESUME)
+	syn.SetCodecs(packet.CodecsOf(packet.CODEC_NONE))
+	synAck := packet.CreateSynAck(syn, config.datagramSize(), packet.SUPPORTED_OPTIONS)
+	if config.Key == nil && !config.exchanges() {
+		return syn, synAck, nil, nil, nil
+	}
+	source.Read(syn.Nonce())
+	source.Read(synAck.Nonce())
+
+	var sendEphemeral, recvEphemeral []byte
+	if config.exchanges() {
+		var err error
+		identity := config.Identity
+		if identity == nil {
+			if _, identity, err = ed25519.GenerateKey(source); err != nil {
+				return nil, nil, nil, nil, err
+			}
+		}
+		if sendEphemeral, err = syn.Exchange(identity, nil); err != nil {
+			return nil, nil, nil, nil, err
+		}
+		if recvEphemeral, err = synAck.Exchange(identity, syn); err != nil {
+			return nil, nil, nil, nil, err
+		}
+	}
+
+	sendSealer, err := config.sealer(syn, synAck, true, sendEphemeral)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	recvSealer, err := config.sealer(syn, synAck, false, recvEphemeral)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	return syn, synAck, sendSealer, recvSealer, nil
+}
+
+// The application reading a simulated transfer. A Transfer's reads block,
+// so it reads from a goroutine of its own, but only ever while the
+// simulation waits for it to finish a read or park for want of data; only
+// one of them runs at a time, and always in the same order.
+type simulatedReader struct {
+	transfer *Transfer
+
+	// Bytes a second it reads, and how many more it may read before the
+	// next tick; no limit if rate is 0
+	rate      int64
+	allowance int64
+
+	// Hands the goroutine a read of up to so many bytes
+	turn chan int
+	// The goroutine parks on these, waiting for the transfer to have more
+	parked chan struct{}
+	resume chan struct{}
+	// and hands back how each read went
+	done chan simulatedRead
+	// Closed once the simulation is over
+	quit chan struct{}
+
+	// Whether it's parked in a read
+	waiting bool
+
+	// Bytes read so far, and why reads ended, once they have
+	received int64
+	err      error
+}
+
+type simulatedRead struct {
+	read int
+	err  error
+}
+
+func newSimulatedReader(t *Transfer, clock *virtualClock, rate int64) *simulatedReader {
+	r := &simulatedReader{
+		transfer: t,
+		rate:     rate,
+		turn:     make(chan int),
+		parked:   make(chan struct{}),
+		resume:   make(chan struct{}),
+		done:     make(chan simulatedRead),
+		quit:     make(chan struct{}),
+	}
+	t.compressed.park = r.park
+	go r.run()
+	if rate > 0 {
+		r.tick(clock)
+	}
+	return r
+}
+
+func (r *simulatedReader) run() {
+	buffer := make([]byte, SIMULATION_READ_SIZE)
+	for {
+		var size int
+		select {
+		case size = <-r.turn:
+		case <-r.quit:
+			return
+		}
+		read, err := r.transfer.Read(buffer[:size])
+		select {
+		case r.done <- simulatedRead{read, err}:
+		case <-r.quit:
+			return
+		}
+	}
+}
+
+// Waits for the simulation to say there's more to read. Quitting unwinds
+// the goroutine from here, so the transfer never hears of it.
+func (r *simulatedReader) park() {
+	select {
+	case r.parked <- struct{}{}:
+	case <-r.quit:
+		runtime.Goexit()
+	}
+	select {
+	case <-r.resume:
+	case <-r.quit:
+		runtime.Goexit()
+	}
+}
+
+// Lets it read a tick's worth more, every tick until reads have ended
+func (r *simulatedReader) tick(clock *virtualClock) {
+	if r.err != nil {
+		return
+	}
+	r.allowance = r.rate * int64(SIMULATION_READ_TICK) / int64(time.Second)
+	clock.AfterFunc(SIMULATION_READ_TICK, func() {
+		r.tick(clock)
+	})
+}
+
+// Reads for as long as there's something to read and it's allowed to,
+// telling the sender of any room that makes
+func (r *simulatedReader) read() {
+	for r.err == nil {
+		size := SIMULATION_READ_SIZE
+		if r.rate > 0 {
+			if r.allowance <= 0 {
+				return
+			}
+			if r.allowance < int64(size) {
+				size = int(r.allowance)
+			}
+		}
+
+		if r.waiting {
+			if !r.transfer.compressed.ready() {
+				return
+			}
+			r.waiting = false
+			r.resume <- struct{}{}
+		} else {
+			r.turn <- size
+		}
+
+		select {
+		case <-r.parked:
+			r.waiting = true
+		case done := <-r.done:
+			r.received += int64(done.read)
+			r.allowance -= int64(done.read)
+			r.err = done.err
+			if done.read == 0 && done.err == nil {
+				return
+			}
+		}
+		r.transfer.windowUpdate()
+	}
+}
+
+func (r *simulatedReader) stop() {
+	close(r.quit)
+}
+
+// One direction of the simulated link, delivering on the virtual clock
+type simulatedLink struct {
+	clock *virtualClock
+	model *netem.Model
+	// Deliveries planned but not yet made
+	pending int
+}
+
+func newSimulatedLink(clock *virtualClock, model *netem.Model) *simulatedLink {
+	return &simulatedLink{clock: clock, model: model}
+}
+
+// Sends raw across the link, to come out the far end through receive
+func (l *simulatedLink) carry(raw []byte, receive func([]byte)) {
+	for _, delivery := range l.model.Plan(raw, l.clock.Now()) {
+		if l.pending >= netem.QUEUE_LIMIT {
+			l.model.Overflowed()
+			continue
+		}
+		l.pending++
+
+		data := delivery.Data
+		l.clock.AfterFunc(delivery.At.Sub(l.clock.Now()), func() {
+			l.pending--
+			l.model.Forwarded()
+			receive(data)
+		})
+	}
+}
+
+// A clock that only moves when step is called, jumping straight to
+// whatever is due next. Not safe for concurrent use.
+type virtualClock struct {
+	start time.Time
+	now   time.Time
+
+	timers    timerHeap
+	scheduled uint64
+	events    int
+}
+
+func newVirtualClock() *virtualClock {
+	start := time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+	return &virtualClock{start: start, now: start}
+}
+
+func (c *virtualClock) Now() time.Time {
+	return c.now
+}
+
+func (c *virtualClock) AfterFunc(d time.Duration, f func()) shared.Timer {
+	timer := &virtualTimer{at: c.now.Add(d), order: c.scheduled, f: f}
+	c.scheduled++
+	heap.Push(&c.timers, timer)
+	return timer
+}
+
+// Advances to the next timer and runs it, returning false if none are left
+func (c *virtualClock) step() bool {
+	for len(c.timers) > 0 {
+		timer := heap.Pop(&c.timers).(*virtualTimer)
+		if timer.stopped {
+			continue
+		}
+		if timer.at.After(c.now) {
+			c.now = timer.at
+		}
+		timer.stopped = true
+		c.events++
+		timer.f()
+		return true
+	}
+	return false
+}
+
+type virtualTimer struct {
+	at time.Time
+	// Tiebreak, so timers due at once fire in the order they were set
+	order   uint64
+	f       func()
+	stopped bool
+}
+
+func (t *virtualTimer) Stop() bool {
+	pending := !t.stopped
+	t.stopped = true
+	return pending
+}
+
+// Orders timers by when they're due
+type timerHeap []*virtualTimer
+
+func (h timerHeap) Len() int { return len(h) }
+func (h timerHeap) Less(i, j int) bool {
+	if h[i].at.Equal(h[j].at) {
+		return h[i].order < h[j].order
+	}
+	return h[i].at.Before(h[j].at)
+}
+func (h timerHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *timerHeap) Push(x interface{}) {
+	*h = append(*h, x.(*virtualTimer))
+}
+
+func (h *timerHeap) Pop() interface{} {
+	old := *h
+	last := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return last
+}
@@ -0,0 +1,165 @@
+package faart
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/djreed/faart/log"
+	"github.com/djreed/faart/netem"
+	"github.com/djreed/faart/packet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Simulations log every packet like the real thing; there's no need to see it
+func quietly(f func()) {
+	log.ERR.SetOutput(ioutil.Discard)
+	defer log.ERR.SetOutput(os.Stderr)
+	f()
+}
+
+func TestSimulateSlowLink(t *testing.T) {
+	// Minutes of transfer over a 0.1 mb/s, 500ms link
+	sim := Simulation{
+		Size: 4 << 20,
+		Link: netem.Config{Loss: 0.01, Latency: 500 * time.Millisecond, Jitter: 20 * time.Millisecond, Rate: 1e5, Seed: 3},
+	}
+
+	var result SimulationResult
+	var err error
+	quietly(func() {
+		result, err = Simulate(sim)
+	})
+	require.NoError(t, err)
+	assert.Equal(t, sim.Size, result.Received)
+	assert.True(t, result.Elapsed > 5*time.Minute, "took %s", result.Elapsed)
+	assert.NotZero(t, result.Upstream.Dropped)
+}
+
+func TestSimulateReplays(t *testing.T) {
+	sim := Simulation{
+		Size: 512 << 10,
+		Link: netem.Config{Loss: 0.05, Latency: 40 * time.Millisecond, Jitter: 10 * time.Millisecond, Reorder: 0.05, Duplicate: 0.05, Seed: 11},
+	}
+	reseeded := sim
+	reseeded.Link.Seed = 12
+
+	var first, second, other SimulationResult
+	quietly(func() {
+		var err error
+		first, err = Simulate(sim)
+		require.NoError(t, err)
+		second, err = Simulate(sim)
+		require.NoError(t, err)
+		other, err = Simulate(reseeded)
+		require.NoError(t, err)
+	})
+	assert.Equal(t, first, second)
+	assert.NotEqual(t, first, other)
+}
+
+func TestSimulateFEC(t *testing.T) {
+	for _, scheme := range []packet.FECScheme{packet.FEC_XOR, packet.FEC_REED_SOLOMON} {
+		sim := Simulation{
+			Size:   1 << 20,
+			Config: Config{FEC: scheme},
+			Link:   netem.Config{Loss: 0.05, Latency: 50 * time.Millisecond, Seed: 5},
+		}
+
+		var result SimulationResult
+		var err error
+		quietly(func() {
+			result, err = Simulate(sim)
+		})
+		require.NoError(t, err, scheme.String())
+		assert.NotZero(t, result.ParitySent, scheme.String())
+		assert.NotZero(t, result.Recovered, scheme.String())
+	}
+}
+
+func TestSimulateSlowReader(t *testing.T) {
+	// An application reading 200 kb/s from a 64 kb buffer, well behind what
+	// the link carries, so the receive window keeps closing
+	sim := Simulation{
+		Size:     1000000,
+		Link:     netem.Config{Latency: 30 * time.Millisecond, Seed: 7},
+		Config:   Config{ReceiveBuffer: 64 << 10},
+		ReadRate: 200000,
+	}
+
+	var result SimulationResult
+	var err error
+	quietly(func() {
+		result, err = Simulate(sim)
+	})
+	require.NoError(t, err)
+	assert.Equal(t, sim.Size, result.Received)
+	assert.True(t, result.Elapsed >= 5*time.Second, "took %s", result.Elapsed)
+}
+
+func TestSimulateLimit(t *testing.T) {
+	sim := Simulation{Size: 64 << 10, Link: netem.Config{Loss: 1}, Limit: time.Minute}
+
+	var result SimulationResult
+	var err error
+	quietly(func() {
+		result, err = Simulate(sim)
+	})
+	assert.Equal(t, ErrSimulationLimit, err)
+	assert.True(t, result.Elapsed >= time.Minute)
+	assert.NotZero(t, result.RTORetransmits)
+}
+
+func TestSimulatePathMTU(t *testing.T) {
+	// Offered jumbo frames over a 1 mb/s link that silently drops anything
+	// past 1400
+	sim := Simulation{
+		Size:   4 << 20,
+		Link:   netem.Config{Latency: 10 * time.Millisecond, Rate: 1e6, MTU: 1400, Seed: 5},
+		Config: Config{DatagramSize: 9000},
+	}
+
+	var result SimulationResult
+	var err error
+	quietly(func() {
+		result, err = Simulate(sim)
+	})
+	require.NoError(t, err)
+	assert.True(t, result.DatagramSize <= 1400 && result.DatagramSize > 1400-PMTU_SEARCH_GRANULARITY, "settled on %d after %s", result.DatagramSize, result.Elapsed)
+	assert.NotZero(t, result.Upstream.Oversized)
+}
+
+func TestVirtualClockOrder(t *testing.T) {
+	clock := newVirtualClock()
+	var fired []int
+	clock.AfterFunc(2*time.Second, func() { fired = append(fired, 3) })
+	clock.AfterFunc(time.Second, func() { fired = append(fired, 1) })
+	clock.AfterFunc(time.Second, func() { fired = append(fired, 2) })
+	clock.AfterFunc(time.Second, func() { fired = append(fired, 0) }).Stop()
+
+	for clock.step() {
+	}
+	assert.Equal(t, []int{1, 2, 3}, fired)
+	assert.Equal(t, 2*time.Second, clock.Now().Sub(clock.start))
+}
+
+func TestSimulatePathNarrows(t *testing.T) {
+	// A route change partway through puts a 1300 byte hop in the way,
+	// after discovery has settled on 1472
+	sim := Simulation{
+		Size: 4 << 20,
+		Link: netem.Config{Latency: 20 * time.Millisecond, Rate: 2e6, ShrunkMTU: 1300, ShrinkAfter: 5 * time.Second, Seed: 5},
+	}
+
+	var result SimulationResult
+	var err error
+	quietly(func() {
+		result, err = Simulate(sim)
+	})
+	require.NoError(t, err)
+	assert.Equal(t, sim.Size, result.Received)
+	assert.True(t, result.DatagramSize <= 1300 && result.DatagramSize > 1300-PMTU_SEARCH_GRANULARITY, "settled on %d after %s", result.DatagramSize, result.Elapsed)
+	assert.NotZero(t, result.Upstream.Oversized)
+}
@@ -0,0 +1,61 @@
+package faart
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/djreed/faart/log"
+	"github.com/djreed/faart/shared"
+)
+
+// Counters for a single transfer, safe to bump from any goroutine
+type transferStats struct {
+	clock   shared.Clock
+	started time.Time
+
+	packetsSent     uint64
+	bytesSent       uint64
+	acksReceived    uint64
+	rtoRetransmits  uint64
+	fastRetransmits uint64
+	paritySent      uint64
+	windowProbes    uint64
+}
+
+func newTransferStats(clock shared.Clock) *transferStats {
+	return &transferStats{clock: clock, started: clock.Now()}
+}
+
+func (s *transferStats) Sent(bytes int) {
+	atomic.AddUint64(&s.packetsSent, 1)
+	atomic.AddUint64(&s.bytesSent, uint64(bytes))
+}
+
+func (s *transferStats) AckReceived() {
+	atomic.AddUint64(&s.acksReceived, 1)
+}
+
+func (s *transferStats) RTORetransmit() {
+	atomic.AddUint64(&s.rtoRetransmits, 1)
+}
+
+func (s *transferStats) FastRetransmit() {
+	atomic.AddUint64(&s.fastRetransmits, 1)
+}
+
+func (s *transferStats) ParitySent() {
+	atomic.AddUint64(&s.paritySent, 1)
+}
+
+func (s *transferStats) WindowProbe() {
+	atomic.AddUint64(&s.windowProbes, 1)
+}
+
+func (s *transferStats) Print() {
+	log.ERR.Printf("[stats] %d packets (%d bytes) sent, %d acks received in %s\n",
+		atomic.LoadUint64(&s.packetsSent), atomic.LoadUint64(&s.bytesSent),
+		atomic.LoadUint64(&s.acksReceived), s.clock.Now().Sub(s.started))
+	log.ERR.Printf("[stats] %d timeout retransmits, %d fast retransmits, %d parity, %d zero window probes\n",
+		atomic.LoadUint64(&s.rtoRetransmits), atomic.LoadUint64(&s.fastRetransmits), atomic.LoadUint64(&s.paritySent),
+		atomic.LoadUint64(&s.windowProbes))
+}
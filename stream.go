@@ -0,0 +1,362 @@
+package faart
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/djreed/faart/log"
+	"github.com/djreed/faart/packet"
+	"github.com/djreed/faart/shared"
+)
+
+// A full-duplex reliable byte stream, usable anywhere a TCP net.Conn is.
+// Both peers send datagrams, and acks ride along on data heading the other
+// way whenever there is some. Unlike a Conn nothing is compressed, and every
+// Write is on the wire without waiting for more.
+type Stream struct {
+	local  net.Addr
+	remote net.Addr
+
+	out *sendHalf
+	in  recvHalf
+
+	// Seals everything sent and opens everything received; nil if the
+	// stream is in the clear
+	sealer *packet.Sealer
+
+	// In-order bytes waiting to be read
+	buffer *streamBuffer
+
+	// Data datagrams for the receive loop
+	inbound shared.AddressedDataChannel
+	// Datagrams the peer had to split, as their pieces arrive
+	fragments *reassembly
+
+	// Seals a raw packet and puts it on the wire to the peer
+	write func([]byte) error
+	// Lets go of the socket, or of the listener's hold on the session
+	release func()
+
+	// An ack waiting to ride along on the next outgoing datagram
+	ackLock    sync.Mutex
+	pendingAck packet.Ack
+
+	writeLock     sync.Mutex
+	deadlineLock  sync.Mutex
+	writeDeadline time.Time
+
+	// Closed once the peer's FIN arrives
+	peerDone    chan struct{}
+	finReceived bool
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+var _ net.Conn = (*Stream)(nil)
+
+// Opens a stream to the listener at address with the default Config
+func DialStream(ctx context.Context, address string) (*Stream, error) {
+	return DialStreamConfig(ctx, address, Config{})
+}
+
+// Opens a stream to the listener at address. ctx bounds the handshake only.
+func DialStreamConfig(ctx context.Context, address string, config Config) (*Stream, error) {
+	conn, synAck, sealer, out, err := dial(ctx, address, config, packet.OPTION_STREAM|config.options()&^(packet.OPTION_FEC|packet.OPTION_RESUME))
+	if err != nil {
+		return nil, err
+	}
+	if synAck.Options()&packet.OPTION_STREAM == 0 {
+		conn.Close()
+		return nil, ErrStreamUnsupported
+	}
+
+	write := func(raw []byte) error {
+		_, err := conn.Write(raw)
+		return err
+	}
+	release := func() {
+		conn.Close()
+	}
+	s := newStream(synAck, config.receiveBuffer(STREAM_BUFFER), out, sealer, conn.LocalAddr(), conn.RemoteAddr(), write, release)
+	go s.readSocket(conn, synAck.DatagramSize())
+	return s, nil
+}
+
+// A stream for the session synAck settled, already under way
+func newStream(synAck packet.Handshake, bufferSize int, out *sendHalf, sealer *packet.Sealer, local, remote net.Addr, write func([]byte) error, release func()) *Stream {
+	id := synAck.Prefix().Session()
+	s := &Stream{
+		local:     local,
+		remote:    remote,
+		out:       out,
+		sealer:    sealer,
+		buffer:    newStreamBuffer(bufferSize),
+		inbound:   shared.NewAddressedDataChan(),
+		fragments: newReassembly(),
+		release:   release,
+		peerDone:  make(chan struct{}),
+		closed:    make(chan struct{}),
+	}
+	s.write = func(raw []byte) error {
+		return write(sealer.Seal(raw))
+	}
+	s.in = newRecvHalf(id, s.buffer)
+	s.in.sealed = sealer != nil
+	s.in.limit = s.buffer
+	s.in.packetSize = payloadSize(baseDatagramSize(synAck), synAck.Options())
+
+	out.writeDeadline = s.getWriteDeadline
+	out.attach(id, packetSize(synAck), s.writeDatagram)
+	out.discoverPMTU(baseDatagramSize(synAck), synAck.DatagramSize(), synAck.Options())
+	out.run()
+	go s.receive()
+	return s
+}
+
+// Session the two peers agreed to
+func (s *Stream) Session() packet.SessionID {
+	return s.in.id
+}
+
+func (s *Stream) LocalAddr() net.Addr {
+	return s.local
+}
+
+func (s *Stream) RemoteAddr() net.Addr {
+	return s.remote
+}
+
+func (s *Stream) Read(data []byte) (int, error) {
+	return s.buffer.Read(data)
+}
+
+// Sends data, a packet at a time, blocking while the send window is full
+func (s *Stream) Write(data []byte) (int, error) {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	written := 0
+	for len(data) > 0 {
+		select {
+		case <-s.out.closed:
+			return written, s.out.failure()
+		default:
+		}
+
+		size := len(data)
+		if size > s.out.packets.size() {
+			size = s.out.packets.size()
+		}
+		if err := s.out.packets.emit(data[:size]); err != nil {
+			return written, err
+		}
+		written += size
+		data = data[size:]
+	}
+	return written, nil
+}
+
+// Sends a FIN once everything written has been acked. The peer's reads end
+// with io.EOF, while this side can carry on reading.
+func (s *Stream) CloseWrite() error {
+	return s.out.close(nil)
+}
+
+// Closes the write side as CloseWrite does and stops reading, then lingers
+// until the peer's FIN so that whatever it still sends is acked
+func (s *Stream) Close() error {
+	err := s.CloseWrite()
+	s.buffer.discard(ErrClosed)
+
+	select {
+	case <-s.peerDone:
+	case <-time.After(shared.FIN_TIMEOUT_WAIT):
+	case <-s.closed:
+	}
+	s.abort(ErrClosed)
+	return err
+}
+
+func (s *Stream) SetDeadline(deadline time.Time) error {
+	s.SetReadDeadline(deadline)
+	return s.SetWriteDeadline(deadline)
+}
+
+func (s *Stream) SetReadDeadline(deadline time.Time) error {
+	s.buffer.SetDeadline(deadline)
+	return nil
+}
+
+func (s *Stream) SetWriteDeadline(deadline time.Time) error {
+	s.deadlineLock.Lock()
+	s.writeDeadline = deadline
+	s.deadlineLock.Unlock()
+
+	// Wake a blocked Write so it notices
+	s.out.window.signal()
+	return nil
+}
+
+func (s *Stream) getWriteDeadline() time.Time {
+	s.deadlineLock.Lock()
+	defer s.deadlineLock.Unlock()
+	return s.writeDeadline
+}
+
+// Tears the stream down at once; reads and writes fail with err
+func (s *Stream) abort(err error) {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		s.out.shutdown(err)
+		s.buffer.discard(err)
+		s.release()
+	})
+}
+
+// Routes a packet from the peer to whichever half it's for
+func (s *Stream) deliver(addressedDatagram packet.AddressedDatagram) {
+	raw, ok := s.sealer.Open(addressedDatagram.Datagram)
+	if !ok {
+		log.ERR.Printf("[recv unauthenticated] %x\n", s.in.id)
+		return
+	}
+	if !packet.Prefix(raw).WellFormed() {
+		return
+	}
+	if raw, ok = s.fragments.add(raw); !ok {
+		return
+	}
+	addressedDatagram.Datagram = raw
+
+	prefix := packet.Prefix(addressedDatagram.Datagram)
+	if !prefix.WellFormed() || prefix.Session() != s.in.id {
+		return
+	}
+
+	switch prefix.Kind() {
+	case packet.KIND_ACK, packet.KIND_PROBE_ACK:
+		s.out.receiveAck(packet.Ack(addressedDatagram.Datagram))
+
+	case packet.KIND_DATA, packet.KIND_PROBE:
+		if prefix.Kind() == packet.KIND_DATA {
+			if ack := addressedDatagram.Datagram.Piggyback(); ack != nil {
+				s.out.receiveAck(ack)
+			}
+		}
+		select {
+		case s.inbound <- addressedDatagram:
+		default:
+			// Falling behind; the peer will retransmit
+			log.ERR.Printf("[recv dropped] %x\n", s.in.id)
+		}
+	}
+}
+
+func (s *Stream) readSocket(conn *net.UDPConn, datagramSize int) {
+	buffer := packet.NewDatagram(readBufferSize(datagramSize))
+	for {
+		read, err := conn.Read(buffer)
+		if read > 0 {
+			datagram := append(packet.Datagram(nil), buffer[:read]...)
+			s.deliver(packet.AddressedDatagram{Datagram: datagram})
+		} else if err != nil {
+			select {
+			case <-s.closed:
+				return
+			default:
+			}
+		}
+	}
+}
+
+// Takes in the peer's data and acks it until the stream is torn down,
+// telling the peer whenever reads open up room for more
+func (s *Stream) receive() {
+	// The latest datagram taken in, for window updates to answer
+	var last packet.Datagram
+	for {
+		select {
+		case addressedDatagram := <-s.inbound:
+			if probe := packet.Probe(addressedDatagram.Datagram); probe.Prefix().Kind() == packet.KIND_PROBE {
+				s.write(s.in.answerProbe(probe))
+				continue
+			}
+			needAck, finalPacket := s.in.acceptDatagram(addressedDatagram.Datagram)
+			if s.in.err != nil {
+				s.abort(s.in.err)
+				return
+			}
+			if !needAck {
+				continue
+			}
+			if !s.in.refused {
+				last = addressedDatagram.Datagram
+			}
+			s.queueAck(s.in.ack(addressedDatagram.Datagram))
+
+			if finalPacket && !s.finReceived {
+				s.finReceived = true
+				s.buffer.finish()
+				close(s.peerDone)
+			}
+
+		case <-s.buffer.writable:
+			// Past the FIN, an ack for it would say everything was read
+			if last != nil && !s.finReceived && s.in.windowOpened() {
+				log.ERR.Printf("[window update] %x %d\n", s.in.id, s.in.window)
+				s.queueAck(s.in.ack(last))
+			}
+
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+// Holds ack for the next outgoing datagram if one is about to leave, or
+// sends it by itself otherwise. A held ack goes out alone after ACK_DELAY
+// if nothing picks it up.
+func (s *Stream) queueAck(ack packet.Ack) {
+	s.ackLock.Lock()
+	if len(s.out.dataChan) == 0 {
+		s.pendingAck = nil
+		s.ackLock.Unlock()
+		s.write(ack)
+		return
+	}
+
+	if s.pendingAck == nil {
+		time.AfterFunc(shared.ACK_DELAY, s.flushAck)
+	}
+	// Each ack covers everything the last one did
+	s.pendingAck = ack
+	s.ackLock.Unlock()
+}
+
+func (s *Stream) flushAck() {
+	s.ackLock.Lock()
+	ack := s.pendingAck
+	s.pendingAck = nil
+	s.ackLock.Unlock()
+
+	if ack != nil {
+		s.write(ack)
+	}
+}
+
+// Puts one of the send half's datagrams on the wire, with the held ack
+// riding along if there is one
+func (s *Stream) writeDatagram(datagram packet.Datagram) error {
+	s.ackLock.Lock()
+	// Probes are padded to exactly the size being tried
+	if s.pendingAck != nil && packet.Prefix(datagram).Kind() == packet.KIND_DATA {
+		datagram = datagram.Attach(s.pendingAck)
+		s.pendingAck = nil
+	}
+	s.ackLock.Unlock()
+
+	return s.write(datagram)
+}
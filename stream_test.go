@@ -0,0 +1,97 @@
+package faart
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// A stream dialled to a fresh listener, along with the listener's end
+func streamPair(t *testing.T) (*Listener, *Stream, *Stream) {
+	listener, err := Listen("127.0.0.1:0")
+	assert.NoError(t, err)
+
+	dialled, err := DialStream(context.Background(), listener.Addr().String())
+	assert.NoError(t, err)
+	accepted, err := listener.AcceptStream()
+	assert.NoError(t, err)
+	return listener, dialled, accepted
+}
+
+func TestStreamFullDuplex(t *testing.T) {
+	listener, dialled, accepted := streamPair(t)
+	defer listener.Close()
+
+	var request, response bytes.Buffer
+	io.CopyN(&request, &syntheticSource{}, 300000)
+	io.CopyN(&response, &syntheticSource{position: 12345}, 200000)
+
+	// Both sides write at once, then half-close and read what the other sent
+	exchange := func(conn net.Conn, data []byte, result chan<- []byte) {
+		go func() {
+			conn.Write(data)
+			conn.(*Stream).CloseWrite()
+		}()
+		received, _ := ioutil.ReadAll(conn)
+		result <- received
+	}
+	atDialled := make(chan []byte, 1)
+	atAccepted := make(chan []byte, 1)
+	go exchange(dialled, request.Bytes(), atDialled)
+	go exchange(accepted, response.Bytes(), atAccepted)
+
+	assert.True(t, bytes.Equal(request.Bytes(), <-atAccepted))
+	assert.True(t, bytes.Equal(response.Bytes(), <-atDialled))
+	assert.NoError(t, dialled.Close())
+	assert.NoError(t, accepted.Close())
+}
+
+func TestStreamReadAfterCloseWrite(t *testing.T) {
+	listener, dialled, accepted := streamPair(t)
+	defer listener.Close()
+
+	dialled.Write([]byte("ping"))
+	assert.NoError(t, dialled.CloseWrite())
+	_, err := dialled.Write([]byte("too late"))
+	assert.Equal(t, ErrClosed, err)
+
+	request, err := ioutil.ReadAll(accepted)
+	assert.NoError(t, err)
+	assert.Equal(t, "ping", string(request))
+
+	// The dialled side can still hear back after closing its own half
+	accepted.Write([]byte("pong"))
+	accepted.Close()
+	response, err := ioutil.ReadAll(dialled)
+	assert.NoError(t, err)
+	assert.Equal(t, "pong", string(response))
+	dialled.Close()
+}
+
+func TestStreamReadDeadline(t *testing.T) {
+	listener, dialled, accepted := streamPair(t)
+	defer listener.Close()
+
+	dialled.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err := dialled.Read(make([]byte, 10))
+	netErr, ok := err.(net.Error)
+	assert.True(t, ok)
+	assert.True(t, netErr.Timeout())
+
+	// Clearing the deadline lets reads carry on
+	dialled.SetReadDeadline(time.Time{})
+	accepted.Write([]byte("late"))
+	buffer := make([]byte, 10)
+	read, err := dialled.Read(buffer)
+	assert.NoError(t, err)
+	assert.Equal(t, "late", string(buffer[:read]))
+
+	dialled.Close()
+	accepted.Close()
+}
@@ -0,0 +1,548 @@
+package faart
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/djreed/faart/log"
+	"github.com/djreed/faart/packet"
+	"github.com/djreed/faart/shared"
+)
+
+// Most bytes of compressed stream a transfer holds for its reader, unless
+// Config.ReceiveBuffer says otherwise; the sender is told how much room is
+// left
+const TRANSFER_BUFFER = 4 << 20
+
+// The receiving end of a single session's transfer, handed out by
+// Listener.Accept. Reads yield the decompressed stream and end with io.EOF
+// once the sender has finished and the stream has been checked against the
+// digest its FIN carried, or with ErrDigestMismatch if it doesn't match. The
+// sender hears which it was. A Transfer is not safe for concurrent reads.
+type Transfer struct {
+	recvHalf
+	addr *net.UDPAddr
+
+	// Opens the sender's packets and seals acks; nil if the transfer is in
+	// the clear
+	sealer *packet.Sealer
+
+	// Datagrams routed to this transfer by the listener
+	dataChan shared.AddressedDataChannel
+	// Datagrams the sender had to split, as their pieces arrive
+	fragments *reassembly
+
+	// Put sealed acks on the wire: queueAck in turn with the listener's
+	// others, sendAck at once. forget has the listener let go of the
+	// session, and closed is closed along with the listener.
+	queueAck func(addr *net.UDPAddr, ack packet.Ack)
+	sendAck  func(addr *net.UDPAddr, ack packet.Ack)
+	forget   func()
+	closed   <-chan struct{}
+
+	clock shared.Clock
+	// Set when one goroutine drives the transfer, as a simulation does:
+	// datagrams, window updates, the verdict and timers are handled as they
+	// happen rather than by the run loop
+	synchronous bool
+	// Timers that have fired, for the run loop to handle
+	timers chan func()
+
+	// The in-order compressed stream; the run loop writes it and Read
+	// decompresses it as it arrives. Nil when the checkpoint holds it.
+	compressed   *streamBuffer
+	decompressor io.ReadCloser
+	// Whichever of compressed and the checkpoint the decompressor reads
+	source io.Reader
+	// Codecs the handshake allowed the stream to be compressed with
+	codecs packet.Codecs
+
+	// Hashes what Read hands out, to check against the FIN's digest
+	hash hash.Hash
+	// Why reads ended, once they have
+	readErr error
+	// Read's verdict on the whole stream, nil if it checked out, for the
+	// run loop to pass on to the sender
+	verdict chan error
+	// Closed once the run loop has told the sender how the transfer went
+	done chan struct{}
+	// Closed once it has stopped answering the sender, which has either
+	// closed the session or given up on it
+	lingered chan struct{}
+	// Set once the FIN has arrived and the output stream has ended
+	finReceived bool
+
+	// The run loop's state. last is the latest datagram taken in, for
+	// window updates and the verdict to answer. The transfer goes idle
+	// once idleAt passes, if idle is set.
+	last      packet.AddressedDatagram
+	idle      time.Duration
+	idleAt    time.Time
+	idleArmed bool
+	// Set once the sender has been sent the verdict, final; from then on
+	// the transfer lingers, answering with it, until lingerUntil passes
+	reported    bool
+	final       packet.Ack
+	lingerUntil time.Time
+	// Set once the transfer has stopped answering the sender altogether
+	over bool
+
+	// Closed to stop the run loop early, with abortErr as the reason
+	aborted   chan struct{}
+	abortOnce sync.Once
+	abortErr  error
+}
+
+// A transfer that holds up to bufferSize bytes of its compressed stream
+// for the reader, in datagrams carrying at least packetSize bytes of it
+func newTransfer(id packet.SessionID, addr *net.UDPAddr, bufferSize int, packetSize int) *Transfer {
+	compressed := newStreamBuffer(bufferSize)
+	t := newOutputTransfer(id, addr, compressed, packetSize)
+	t.compressed = compressed
+	t.limit = compressed
+	return t
+}
+
+// A transfer that keeps its compressed stream in checkpoint, and reads it
+// back from there; the disk is all the room it needs
+func newCheckpointedTransfer(id packet.SessionID, addr *net.UDPAddr, checkpoint *checkpoint, packetSize int) *Transfer {
+	t := newOutputTransfer(id, addr, ioutil.Discard, packetSize)
+	t.checkpoint = checkpoint
+	return t
+}
+
+// A transfer that writes its in-order compressed stream to output
+func newOutputTransfer(id packet.SessionID, addr *net.UDPAddr, output io.Writer, packetSize int) *Transfer {
+	t := &Transfer{
+		recvHalf:  newRecvHalf(id, output),
+		addr:      addr,
+		dataChan:  shared.NewAddressedDataChan(),
+		fragments: newReassembly(),
+		clock:     shared.WallClock,
+		timers:    make(chan func()),
+		hash:      sha256.New(),
+		verdict:   make(chan error, 1),
+		done:      make(chan struct{}),
+		lingered:  make(chan struct{}),
+		aborted:   make(chan struct{}),
+	}
+	t.packetSize = packetSize
+	return t
+}
+
+// Session the sender proposed
+func (t *Transfer) Session() packet.SessionID {
+	return t.id
+}
+
+// Address the transfer's SYN came from
+func (t *Transfer) RemoteAddr() net.Addr {
+	return t.addr
+}
+
+func (t *Transfer) Read(data []byte) (int, error) {
+	if t.readErr != nil {
+		return 0, t.readErr
+	}
+	if t.decompressor == nil {
+		var compressed io.Reader = t.compressed
+		if t.checkpoint != nil {
+			compressed = t.checkpoint
+		}
+		decompressor, err := packet.NewDecompressor(compressed, t.codecs)
+		if err != nil {
+			return 0, t.conclude(err)
+		}
+		t.decompressor = decompressor
+		t.source = compressed
+	}
+
+	read, err := t.decompressor.Read(data)
+	t.hash.Write(data[:read])
+	if err == io.EOF {
+		err = t.drain()
+	}
+	if err == io.EOF {
+		err = t.verify()
+	}
+	if err != nil {
+		err = t.conclude(err)
+	}
+	return read, err
+}
+
+// Some codecs know where their data ends and stop short of the stream's
+// end, which only the FIN marks. Reads on to that end, returning io.EOF if
+// nothing follows the codec's data, or ErrTrailingData if something does.
+func (t *Transfer) drain() error {
+	trailing, err := io.Copy(ioutil.Discard, t.source)
+	if err != nil {
+		return err
+	}
+	if trailing > 0 {
+		return ErrTrailingData
+	}
+	return io.EOF
+}
+
+// Checks the whole stream against the FIN's digest, returning io.EOF if it
+// matches or the FIN carried none. The FIN has always been taken in by the
+// time the stream ends.
+func (t *Transfer) verify() error {
+	if t.digest != nil && !bytes.Equal(t.digest, t.hash.Sum(nil)) {
+		log.ERR.Printf("[digest mismatch] %x\n", t.id)
+		return ErrDigestMismatch
+	}
+	return io.EOF
+}
+
+// Ends reading with err, handing the verdict to the run loop and waiting
+// until the sender has been told, so a caller that exits on io.EOF doesn't
+// take the socket with it first
+func (t *Transfer) conclude(err error) error {
+	t.readErr = err
+	if t.compressed != nil {
+		// Anything more the run loop hands over is dropped
+		t.compressed.discard(err)
+	}
+	verdict := err
+	if err == io.EOF {
+		verdict = nil
+	}
+	if t.synchronous {
+		if !t.reported {
+			t.report(verdict)
+		}
+	} else {
+		select {
+		case t.verdict <- verdict:
+		default:
+		}
+	}
+	<-t.done
+	return err
+}
+
+// Stops reading, failing the transfer if it hadn't ended yet, and waits
+// until the sender has heard how it went or given up on hearing, and the
+// listener has let go of the session
+func (t *Transfer) Close() error {
+	t.abort(ErrClosed)
+	<-t.lingered
+	return nil
+}
+
+// Hands the run loop a datagram from the listener, once the whole of it has
+// arrived, dropping it if the transfer is falling behind; the sender will
+// retransmit
+func (t *Transfer) deliver(addressedDatagram packet.AddressedDatagram) {
+	raw, ok := t.sealer.Open(addressedDatagram.Datagram)
+	if !ok {
+		log.ERR.Printf("[recv unauthenticated] %x\n", t.id)
+		return
+	}
+	if !packet.Prefix(raw).WellFormed() {
+		return
+	}
+	if raw, ok = t.fragments.add(raw); !ok {
+		return
+	}
+	addressedDatagram.Datagram = raw
+
+	prefix := packet.Prefix(raw)
+	if !prefix.WellFormed() || prefix.Kind() == packet.KIND_ACK {
+		return
+	}
+	if t.synchronous {
+		t.receive(addressedDatagram)
+		return
+	}
+	select {
+	case t.dataChan <- addressedDatagram:
+	default:
+		log.ERR.Printf("[recv dropped] %x\n", t.id)
+	}
+}
+
+// Ends the transfer early with err, unblocking the run loop and any reader
+func (t *Transfer) abort(err error) {
+	t.abortOnce.Do(func() {
+		t.abortErr = err
+		if t.compressed != nil {
+			t.compressed.discard(err)
+		}
+		t.checkpoint.stop(err)
+		close(t.aborted)
+	})
+}
+
+// Sends the transfer's acks from l's socket, and has l let go of the
+// session once the transfer is over
+func (t *Transfer) serveFrom(l *Listener) {
+	t.queueAck = func(addr *net.UDPAddr, ack packet.Ack) {
+		select {
+		case l.ackChan <- packet.AddressedAck{Addr: addr, Ack: ack}:
+		case <-l.closed:
+		}
+	}
+	t.sendAck = func(addr *net.UDPAddr, ack packet.Ack) {
+		shared.SendAck(l.conn, addr, ack)
+	}
+	t.forget = func() {
+		l.forget(t.id)
+	}
+	t.closed = l.closed
+}
+
+// Accepts and acks this transfer's datagrams until the reader has checked
+// the whole stream, the transfer is aborted, or it goes quiet for longer
+// than idle (never, if idle is 0). Until the reader is done, the FIN is
+// answered with acks saying so, which keep the sender waiting. Then lingers
+// until the sender has heard the verdict.
+func (t *Transfer) run(idle time.Duration) {
+	t.start(idle)
+
+	// Signalled as the reader makes room; nil for a checkpoint, which
+	// always has room
+	var opened chan struct{}
+	if t.compressed != nil {
+		opened = t.compressed.writable
+	}
+	for !t.over {
+		verdict, aborted, room := t.verdict, t.aborted, opened
+		var closed <-chan struct{}
+		if t.reported {
+			// Lingering, which only the listener closing cuts short
+			verdict, aborted, room = nil, nil, nil
+			closed = t.closed
+		}
+
+		select {
+		case addressedDatagram := <-t.dataChan:
+			t.receive(addressedDatagram)
+		case <-room:
+			t.windowUpdate()
+		case err := <-verdict:
+			t.report(err)
+		case <-aborted:
+			t.report(t.abortErr)
+		case due := <-t.timers:
+			due()
+		case <-closed:
+			t.finish()
+		}
+	}
+}
+
+// Sets the idle timer going; the run loop's first step, or the first thing
+// a simulation does with a synchronous transfer
+func (t *Transfer) start(idle time.Duration) {
+	t.idle = idle
+	t.resetIdle()
+}
+
+// Calls f after d on the run loop, or straight from the clock if the
+// transfer is synchronous
+func (t *Transfer) after(d time.Duration, f func()) {
+	if t.synchronous {
+		t.clock.AfterFunc(d, f)
+		return
+	}
+	t.clock.AfterFunc(d, func() {
+		select {
+		case t.timers <- f:
+		case <-t.lingered:
+		}
+	})
+}
+
+// Puts the idle timeout off for another idle. The timer is only moved on
+// when it fires early, rather than set afresh for every datagram.
+func (t *Transfer) resetIdle() {
+	if t.idle == 0 {
+		return
+	}
+	t.idleAt = t.clock.Now().Add(t.idle)
+	if !t.idleArmed {
+		t.idleArmed = true
+		t.after(t.idle, t.idleExpired)
+	}
+}
+
+func (t *Transfer) idleExpired() {
+	t.idleArmed = false
+	if t.reported {
+		return
+	}
+	if wait := t.idleAt.Sub(t.clock.Now()); wait > 0 {
+		t.idleArmed = true
+		t.after(wait, t.idleExpired)
+		return
+	}
+	if t.finReceived {
+		// The sender has given up waiting, but the reader can still
+		// finish
+		return
+	}
+	t.report(ErrIdle)
+}
+
+// Takes in a datagram from the sender, acking it, or answers it with the
+// verdict if the transfer is lingering
+func (t *Transfer) receive(addressedDatagram packet.AddressedDatagram) {
+	if t.reported {
+		t.lingerOn(addressedDatagram)
+		return
+	}
+
+	datagrams := []packet.Datagram{addressedDatagram.Datagram}
+	switch packet.Prefix(addressedDatagram.Datagram).Kind() {
+	case packet.KIND_PARITY:
+		datagrams = t.acceptParity(packet.Parity(addressedDatagram.Datagram))
+	case packet.KIND_CLOSE:
+		// Only sent once the sender has heard a verdict
+		return
+	case packet.KIND_PROBE:
+		probeAck := t.answerProbe(packet.Probe(addressedDatagram.Datagram))
+		t.queueAck(addressedDatagram.Addr, packet.Ack(t.sealer.Seal(probeAck)))
+		return
+	}
+
+	for _, datagram := range datagrams {
+		needAck, finalPacket := t.acceptDatagram(datagram)
+		if t.err != nil {
+			t.report(t.err)
+			return
+		}
+		if !needAck {
+			continue
+		}
+		t.resetIdle()
+		if !t.refused {
+			t.last = packet.AddressedDatagram{Datagram: datagram, Addr: addressedDatagram.Addr}
+		}
+
+		ack := t.ack(datagram)
+		if finalPacket {
+			if !t.finReceived {
+				t.finReceived = true
+				if err := t.end(nil); err != nil {
+					t.report(err)
+					return
+				}
+			}
+			ack.SetStatus(packet.ACK_STATUS_PENDING)
+		}
+		t.queueAck(addressedDatagram.Addr, packet.Ack(t.sealer.Seal(ack)))
+	}
+}
+
+// Tells a sender waiting on room that reads have made some, once they've
+// made enough to be worth an ack
+func (t *Transfer) windowUpdate() {
+	// Past the FIN, an ack for it would say the reader was done
+	if t.reported || t.last.Datagram == nil || t.finReceived || !t.windowOpened() {
+		return
+	}
+	log.ERR.Printf("[window update] %x %d\n", t.id, t.window)
+	t.queueAck(t.last.Addr, packet.Ack(t.sealer.Seal(t.ack(t.last.Datagram))))
+}
+
+// Ends the output stream, passing err on to the reader; returns why the
+// transfer failed, if it did
+func (t *Transfer) end(err error) error {
+	if t.checkpoint != nil {
+		return t.checkpoint.finish(t.streamLength, err)
+	}
+	if err != nil {
+		t.compressed.discard(err)
+	} else {
+		t.compressed.finish()
+	}
+	return err
+}
+
+// Ends the transfer with err, ending the output stream if the FIN hasn't,
+// and tells the sender how it went by answering the latest datagram, then
+// lingers until it has heard
+func (t *Transfer) report(err error) {
+	t.reported = true
+	if !t.finReceived {
+		t.end(err)
+	}
+	if err != nil {
+		log.ERR.Printf("[failed] %x: %s\n", t.id, err)
+	} else {
+		log.ERR.Printf("[completed] %x\n", t.id)
+	}
+	if t.last.Datagram == nil {
+		close(t.done)
+		t.finish()
+		return
+	}
+
+	ack := t.ack(t.last.Datagram)
+	switch err {
+	case nil:
+		ack.SetStatus(packet.ACK_STATUS_OK)
+	case ErrDigestMismatch:
+		ack.SetStatus(packet.ACK_STATUS_MISMATCH)
+	default:
+		ack.SetStatus(packet.ACK_STATUS_FAILED)
+	}
+	// Sent directly, so it's out before a reader that exits on io.EOF
+	// closes the socket
+	t.sendAck(t.last.Addr, packet.Ack(t.sealer.Seal(ack)))
+	close(t.done)
+	// A sender that has gone quiet for that long won't be resending anything
+	if err == ErrIdle {
+		t.finish()
+		return
+	}
+	t.final = ack
+	t.lingerUntil = t.clock.Now().Add(shared.TIME_WAIT)
+	t.after(shared.TIME_WAIT, t.lingerExpired)
+}
+
+// Answers whatever the sender still sends with the final ack, in case it
+// was lost, until the sender closes the session or goes TIME_WAIT without
+// sending anything. Each answer is sealed afresh, since the sender drops
+// replays.
+func (t *Transfer) lingerOn(addressedDatagram packet.AddressedDatagram) {
+	if packet.Prefix(addressedDatagram.Datagram).Kind() == packet.KIND_CLOSE {
+		log.ERR.Printf("[closed] %x\n", t.id)
+		t.finish()
+		return
+	}
+	t.sendAck(addressedDatagram.Addr, packet.Ack(t.sealer.Seal(t.final)))
+	t.lingerUntil = t.clock.Now().Add(shared.TIME_WAIT)
+}
+
+func (t *Transfer) lingerExpired() {
+	if t.over {
+		return
+	}
+	if wait := t.lingerUntil.Sub(t.clock.Now()); wait > 0 {
+		t.after(wait, t.lingerExpired)
+		return
+	}
+	log.ERR.Printf("[time wait over] %x\n", t.id)
+	t.finish()
+}
+
+// Lets the listener forget the session, and anyone waiting on the transfer
+// go
+func (t *Transfer) finish() {
+	if t.over {
+		return
+	}
+	t.over = true
+	t.forget()
+	close(t.lingered)
+}
@@ -0,0 +1,191 @@
+package faart
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+
+	"github.com/djreed/faart/packet"
+	"github.com/stretchr/testify/assert"
+)
+
+// A transfer picking up a stream from seq and offset, along with a channel
+// that yields everything it writes out once its stream is closed
+func newTestTransfer(seq packet.SeqID, offset packet.OffsetVal) (*Transfer, chan []byte) {
+	t := newTransfer(testSession, nil, TRANSFER_BUFFER, packet.PACKET_SIZE)
+	t.cumulative = seq
+	t.nextOffset = offset
+
+	result := make(chan []byte, 1)
+	go func() {
+		data, _ := ioutil.ReadAll(t.compressed)
+		result <- data
+	}()
+	return t, result
+}
+
+// Deterministic stream bytes, cut into packets numbered from seq and offset
+func syntheticDatagrams(seq packet.SeqID, offset packet.OffsetVal, count int) ([]packet.Datagram, []byte) {
+	var datagrams []packet.Datagram
+	var stream []byte
+	for i := 0; i < count; i++ {
+		data := make([]byte, packet.PACKET_SIZE-i)
+		for j := range data {
+			data[j] = byte(uint64(offset) + uint64(j)*13)
+		}
+		datagrams = append(datagrams, packet.CreateDatagram(testSession, seq, offset, data, 0))
+		stream = append(stream, data...)
+		seq++
+		offset += packet.OffsetVal(len(data))
+	}
+	return datagrams, stream
+}
+
+func TestAcceptInOrder(t *testing.T) {
+	tr, result := newTestTransfer(0, 0)
+	datagrams, stream := syntheticDatagrams(0, 0, 5)
+	for _, datagram := range datagrams {
+		needAck, final := tr.acceptDatagram(datagram)
+		assert.True(t, needAck)
+		assert.False(t, final)
+	}
+	assert.Equal(t, packet.SeqID(5), tr.cumulative)
+
+	tr.compressed.finish()
+	assert.Equal(t, stream, <-result)
+}
+
+func TestWritesOutAsHolesFill(t *testing.T) {
+	var output bytes.Buffer
+	in := newRecvHalf(testSession, &output)
+	datagrams, stream := syntheticDatagrams(0, 0, 4)
+	end := func(count int) []byte {
+		var length int
+		for _, datagram := range datagrams[:count] {
+			length += len(datagram.Payload())
+		}
+		return stream[:length]
+	}
+
+	in.acceptDatagram(datagrams[0])
+	assert.Equal(t, end(1), output.Bytes())
+
+	// Held back until the hole before them is filled, then written at once
+	in.acceptDatagram(datagrams[2])
+	in.acceptDatagram(datagrams[3])
+	assert.Equal(t, end(1), output.Bytes())
+	assert.Len(t, in.datagrams, 2)
+
+	in.acceptDatagram(datagrams[1])
+	assert.Equal(t, stream, output.Bytes())
+	assert.Empty(t, in.datagrams)
+	assert.Equal(t, packet.SeqID(4), in.cumulative)
+}
+
+func TestOffsetMismatchStopsTaking(t *testing.T) {
+	var output bytes.Buffer
+	in := newRecvHalf(testSession, &output)
+	datagrams, stream := syntheticDatagrams(0, 0, 3)
+	in.acceptDatagram(datagrams[0])
+
+	// Starts a byte past where the stream got to
+	skewed := packet.CreateDatagram(testSession, 1, datagrams[1].Headers().Offset()+1, []byte(datagrams[1].Payload()), 0)
+	needAck, _ := in.acceptDatagram(skewed)
+	assert.False(t, needAck)
+	assert.Equal(t, ErrOffsetMismatch, in.err)
+
+	needAck, _ = in.acceptDatagram(datagrams[2])
+	assert.False(t, needAck)
+	assert.Equal(t, stream[:len(datagrams[0].Payload())], output.Bytes())
+	assert.Equal(t, packet.SeqID(1), in.cumulative)
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(data []byte) (int, error) {
+	return 0, io.ErrShortWrite
+}
+
+func TestWriteFailureStopsTaking(t *testing.T) {
+	in := newRecvHalf(testSession, failingWriter{})
+	datagrams, _ := syntheticDatagrams(0, 0, 2)
+
+	needAck, _ := in.acceptDatagram(datagrams[0])
+	assert.False(t, needAck)
+	assert.Equal(t, io.ErrShortWrite, in.err)
+	needAck, _ = in.acceptDatagram(datagrams[1])
+	assert.False(t, needAck)
+	assert.Equal(t, packet.SeqID(0), in.cumulative)
+}
+
+func TestAcceptAcross32Bits(t *testing.T) {
+	startSeq := packet.SeqID(1<<32 - 4)
+	startOffset := packet.OffsetVal(1<<32 - 3*packet.PACKET_SIZE)
+	tr, result := newTestTransfer(startSeq, startOffset)
+
+	datagrams, stream := syntheticDatagrams(startSeq, startOffset, 10)
+	shuffled := make([]packet.Datagram, len(datagrams))
+	copy(shuffled, datagrams)
+	rand.New(rand.NewSource(1)).Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+
+	for _, datagram := range shuffled {
+		tr.acceptDatagram(datagram)
+		// Duplicates are acked but never written twice
+		tr.acceptDatagram(datagram)
+	}
+	assert.Equal(t, startSeq+10, tr.cumulative)
+	assert.Empty(t, tr.received)
+
+	final := packet.CreateDatagram(testSession, startSeq+10, 0, []byte{}, packet.PacketCount(startSeq+10))
+	final.Headers().SetDone(true)
+	_, done := tr.acceptDatagram(final)
+	assert.True(t, done)
+	assert.True(t, tr.receivedAllPackets())
+
+	tr.compressed.finish()
+	assert.True(t, bytes.Equal(stream, <-result))
+}
+
+func TestAcceptUnknownSession(t *testing.T) {
+	tr, _ := newTestTransfer(0, 0)
+	datagrams, _ := syntheticDatagrams(0, 0, 1)
+	datagrams[0].Headers().SetSession(testSession + 1)
+
+	needAck, _ := tr.acceptDatagram(datagrams[0])
+	assert.False(t, needAck)
+	assert.Equal(t, packet.SeqID(0), tr.cumulative)
+}
+
+func TestAcceptRefusesPastWindow(t *testing.T) {
+	tr := newTransfer(testSession, nil, 3*packet.PACKET_SIZE, packet.PACKET_SIZE)
+	datagrams, _ := syntheticDatagrams(0, 0, 5)
+
+	// Room for three; the fifth, arriving early, is past the window
+	needAck, _ := tr.acceptDatagram(datagrams[4])
+	assert.True(t, needAck)
+	ack := tr.ack(datagrams[4])
+	assert.Equal(t, packet.ACK_STATUS_NO_ROOM, ack.Status())
+	assert.Equal(t, uint32(3), ack.Window())
+
+	for _, datagram := range datagrams[:3] {
+		tr.acceptDatagram(datagram)
+		assert.Equal(t, packet.ACK_STATUS_OK, tr.ack(datagram).Status())
+	}
+	tr.acceptDatagram(datagrams[3])
+	ack = tr.ack(datagrams[3])
+	assert.Equal(t, packet.ACK_STATUS_NO_ROOM, ack.Status())
+	assert.Equal(t, packet.SeqID(3), ack.Cumulative())
+	assert.Equal(t, uint32(0), ack.Window())
+	assert.False(t, tr.windowOpened())
+
+	// Reading makes room again
+	read := make([]byte, 2*packet.PACKET_SIZE)
+	_, err := io.ReadFull(tr.compressed, read)
+	assert.NoError(t, err)
+	assert.True(t, tr.windowOpened())
+	assert.Equal(t, uint32(2), tr.ack(datagrams[2]).Window())
+}
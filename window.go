@@ -0,0 +1,204 @@
+package faart
+
+import (
+	"sync"
+	"time"
+
+	"github.com/djreed/faart/congestion"
+	"github.com/djreed/faart/log"
+	"github.com/djreed/faart/packet"
+	"github.com/djreed/faart/shared"
+)
+
+// Gates packets onto the wire so no more than the congestion window are
+// ever in flight at once, and none past the receiver's window but a probe
+type sendWindow struct {
+	lock  sync.Mutex
+	clock shared.Clock
+
+	controller congestion.CongestionController
+	maxWindow  int
+
+	// Distinct packets sent but not yet acked
+	inFlight int
+
+	// Highest sequence admitted so far
+	highestSent packet.SeqID
+	admitted    bool
+
+	// Highest sequence in flight when the window last shrank; losses at or
+	// below it belong to the same congestion event
+	recoveryPoint packet.SeqID
+	recovering    bool
+
+	// Highest sequence in flight when a retransmission timeout last
+	// collapsed the window; timeouts at or below it are the same event
+	timeoutPoint packet.SeqID
+	timedOut     bool
+
+	// The first sequence past the room the receiver last advertised, and
+	// the cumulative ack it came with; no limit until it has advertised any
+	edge       packet.SeqID
+	edgeFrom   packet.SeqID
+	advertised bool
+
+	// Signalled whenever room may have opened up
+	open chan struct{}
+	// Closed once nothing more will ever be sent
+	done <-chan struct{}
+}
+
+func newSendWindow(controller congestion.CongestionController, maxWindow int, done <-chan struct{}, clock shared.Clock) *sendWindow {
+	return &sendWindow{
+		clock:      clock,
+		controller: controller,
+		maxWindow:  maxWindow,
+		open:       make(chan struct{}, 1),
+		done:       done,
+	}
+}
+
+func (w *sendWindow) size() int {
+	size := w.controller.Window()
+	if size > w.maxWindow {
+		size = w.maxWindow
+	}
+	return size
+}
+
+// Blocks until seq may be sent without exceeding the window. Gives up with
+// errDeadline once deadline (if given) passes, or ErrClosed if the transfer
+// ends first. Past the receiver's window, seq goes once nothing else is in
+// flight, as a probe for the receiver to answer with its window.
+func (w *sendWindow) Acquire(seq packet.SeqID, deadline func() time.Time) error {
+	for {
+		w.lock.Lock()
+		if w.inFlight < w.size() && (w.inFlight == 0 || !w.beyond(seq)) {
+			w.inFlight++
+			w.highestSent = seq
+			w.admitted = true
+			w.lock.Unlock()
+			return nil
+		}
+		w.lock.Unlock()
+
+		if err := w.wait(deadline); err != nil {
+			return err
+		}
+	}
+}
+
+// Whether Acquire would return at once for seq
+func (w *sendWindow) HasRoom(seq packet.SeqID) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.inFlight < w.size() && (w.inFlight == 0 || !w.beyond(seq))
+}
+
+// Waits for room to open up, the deadline to pass or the transfer to end
+func (w *sendWindow) wait(deadline func() time.Time) error {
+	var expired <-chan time.Time
+	if deadline != nil && !deadline().IsZero() {
+		wait := time.Until(deadline())
+		if wait <= 0 {
+			return errDeadline
+		}
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case <-w.open:
+		return nil
+	case <-expired:
+		return errDeadline
+	case <-w.done:
+		return ErrClosed
+	}
+}
+
+// Takes in the window of room past cumulative an ack advertised. The
+// receiver may shrink it, when the datagrams it counts in grow, so the edge
+// can move in as well as out; only acks older than the one it was last set
+// from are ignored, since they arrived out of order.
+func (w *sendWindow) Advertise(cumulative packet.SeqID, window uint32) {
+	w.lock.Lock()
+	if !w.advertised || cumulative >= w.edgeFrom {
+		w.edge = cumulative + packet.SeqID(window)
+		w.edgeFrom = cumulative
+		w.advertised = true
+	}
+	w.lock.Unlock()
+	w.signal()
+}
+
+// Whether seq lies past the receiver's window, so sending it can only
+// probe for room
+func (w *sendWindow) Beyond(seq packet.SeqID) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.beyond(seq)
+}
+
+func (w *sendWindow) beyond(seq packet.SeqID) bool {
+	return w.advertised && seq >= w.edge
+}
+
+// Called once when a packet admitted by Acquire is first acked
+func (w *sendWindow) Release(rtt time.Duration) {
+	w.lock.Lock()
+	w.inFlight--
+	w.controller.OnAck(w.clock.Now(), rtt)
+	w.lock.Unlock()
+	w.signal()
+}
+
+// Called when seq is presumed lost. Only the first loss after the window
+// last shrank counts as a new congestion event, and sequences that were
+// never admitted (such as the FIN) are ignored.
+func (w *sendWindow) Lost(seq packet.SeqID) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if !w.admitted || seq > w.highestSent {
+		return
+	}
+	if w.recovering && seq <= w.recoveryPoint {
+		return
+	}
+
+	w.controller.OnLoss(w.clock.Now())
+	w.recoveryPoint = w.highestSent
+	w.recovering = true
+	log.ERR.Printf("[cwnd] %s loss at %d, window now %d\n", w.controller.Name(), seq, w.size())
+}
+
+// Called when a retransmission timeout finds seq lost. Collapses the window
+// even in the middle of recovering from a fast retransmit, but only once for
+// everything in flight at the time.
+func (w *sendWindow) TimedOut(seq packet.SeqID) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if !w.admitted || seq > w.highestSent {
+		return
+	}
+	if w.timedOut && seq <= w.timeoutPoint {
+		return
+	}
+
+	w.controller.OnTimeout(w.clock.Now())
+	w.recoveryPoint = w.highestSent
+	w.recovering = true
+	w.timeoutPoint = w.highestSent
+	w.timedOut = true
+	log.ERR.Printf("[cwnd] %s timeout at %d, window now %d\n", w.controller.Name(), seq, w.size())
+}
+
+func (w *sendWindow) signal() {
+	select {
+	case w.open <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,62 @@
+package faart
+
+import (
+	"testing"
+
+	"github.com/djreed/faart/congestion"
+	"github.com/djreed/faart/packet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdvertiseMovesEdgeBothWays(t *testing.T) {
+	w := newSendWindow(congestion.NewNewReno(100), 100, make(chan struct{}), newVirtualClock())
+	assert.False(t, w.Beyond(1000), "no limit until the receiver advertises one")
+
+	w.Advertise(0, 10)
+	assert.False(t, w.Beyond(9))
+	assert.True(t, w.Beyond(10))
+
+	// Counted in bigger datagrams once the path MTU grows, the room left
+	// can shrink; the sender has to hear that
+	w.Advertise(4, 4)
+	assert.True(t, w.Beyond(8))
+
+	// An ack from before then, arriving late, says nothing new
+	w.Advertise(2, 20)
+	assert.True(t, w.Beyond(8))
+
+	// while one as recent opens it up again
+	w.Advertise(4, 6)
+	assert.False(t, w.Beyond(9))
+	assert.True(t, w.Beyond(10))
+}
+
+func TestTimeoutCollapsesWindowOncePerFlight(t *testing.T) {
+	quietly(func() {
+		w := newSendWindow(congestion.NewNewReno(100), 100, make(chan struct{}), newVirtualClock())
+		for seq := packet.SeqID(0); seq < 10; seq++ {
+			assert.NoError(t, w.Acquire(seq, nil))
+		}
+
+		// A fast retransmit halves it, and a timeout in the same flight
+		// still collapses it
+		w.Lost(2)
+		assert.Equal(t, 5, w.size())
+		w.TimedOut(3)
+		assert.Equal(t, congestion.MIN_WINDOW, w.size())
+
+		// Everything else that timed out with it is the same event
+		for i := 0; i < 10; i++ {
+			w.Release(0)
+		}
+		grown := w.size()
+		assert.True(t, grown > congestion.MIN_WINDOW)
+		w.TimedOut(4)
+		assert.Equal(t, grown, w.size())
+
+		// but a timeout among packets sent since is a new one
+		assert.NoError(t, w.Acquire(10, nil))
+		w.TimedOut(10)
+		assert.Equal(t, congestion.MIN_WINDOW, w.size())
+	})
+}